@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Сессия, выданная при входе.
+type Session struct {
+	Id              string
+	ProfileId       uint32
+	ProfileNickname string //текущий никнейм владельца (SessionGetOne)
+	Expires         time.Time
+}
+
+// Маршруты, изменяющие запросы к которым не требуют токена и при auth.required: регистрация и вход.
+var publicRoutes = map[string]struct{}{
+	"/api/user/:nickname/create": {},
+	"/api/auth/login":            {},
+}
+
+// Токен - id сессии и его подпись HMAC-SHA256: <id>.<подпись> в base64url. Подпись отсекает подобранные
+// и испорченные токены без обращения к хранилищу, сессия в хранилище - отозванные (выход, смена пароля)
+// и истёкшие.
+type Auth struct {
+	Store    Store
+	secret   []byte
+	ttl      time.Duration
+	required bool
+	admins   []string
+
+	//хеш, с которым сравнивается пароль несуществующего пользователя, чтобы вход отвечал за то же время
+	dummyHash []byte
+}
+
+func NewAuth(store Store, config AuthConfig) (*Auth, error) {
+	secret := []byte(config.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	return &Auth{Store: store, secret: secret, ttl: config.TokenTTL, required: config.Required, admins: config.Admins,
+		dummyHash: dummyHash}, nil
+}
+
+func (auth *Auth) sign(id string) string {
+	mac := hmac.New(sha256.New, auth.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (auth *Auth) token(session Session) string {
+	return session.Id + "." + auth.sign(session.Id)
+}
+
+// Id сессии из токена с верной подписью.
+func (auth *Auth) sessionId(token string) (string, bool) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return "", false
+	}
+	id, signature := token[:dot], token[dot+1:]
+	return id, hmac.Equal([]byte(signature), []byte(auth.sign(id)))
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < 8 || len(password) > 72 { //bcrypt учитывает только первые 72 байта
+		return "", Validation("Invalid password: must be 8 to 72 bytes long")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkPassword(passwordHash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) == nil
+}
+
+// Новая сессия пользователя, если пароль верен.
+func (auth *Auth) Login(ctx context.Context, nickname, password string) (Session, string, error) {
+	profile, passwordHash, err := auth.Store.UserGetPassword(ctx, nickname)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return Session{}, "", err
+	}
+	if passwordHash == "" {
+		_ = bcrypt.CompareHashAndPassword(auth.dummyHash, []byte(password))
+		return Session{}, "", Unauthorized("Invalid nickname or password")
+	}
+	if !checkPassword(passwordHash, password) {
+		return Session{}, "", Unauthorized("Invalid nickname or password")
+	}
+
+	id := make([]byte, 18)
+	if _, err := rand.Read(id); err != nil {
+		return Session{}, "", err
+	}
+	session := Session{
+		Id:              base64.RawURLEncoding.EncodeToString(id),
+		ProfileId:       profile.Id,
+		ProfileNickname: profile.Nickname,
+		Expires:         time.Now().Add(auth.ttl).UTC(),
+	}
+	if err := auth.Store.SessionCreate(ctx, session); err != nil {
+		return Session{}, "", err
+	}
+	return session, auth.token(session), nil
+}
+
+// Находит сессию по заголовку Authorization: Bearer <токен>; запрос без него выполняется анонимно, если
+// auth.required не требует токена.
+func (auth *Auth) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(context echo.Context) error {
+		header := context.Request().Header.Get(echo.HeaderAuthorization)
+		if header == "" {
+			method := context.Request().Method
+			if _, public := publicRoutes[context.Path()]; auth.required && !public &&
+				method != http.MethodGet && method != http.MethodHead {
+				return Unauthorized("Authentication required")
+			}
+			return next(context)
+		}
+
+		token := strings.TrimPrefix(header, "Bearer ")
+		id, ok := auth.sessionId(token)
+		if token == header || !ok {
+			return errSessionNotFound()
+		}
+		session, err := auth.Store.SessionGetOne(context.Request().Context(), id)
+		if err != nil {
+			return err
+		}
+		context.Set("session", &session)
+		return next(context)
+	}
+}
+
+// Сессия вызывающего пользователя; nil - запрос без токена.
+func callerSession(context echo.Context) *Session {
+	session, _ := context.Get("session").(*Session)
+	return session
+}
+
+// Автор изменяющего запроса: с токеном - пользователь сессии, без него (только в режиме совместимости
+// auth.required: false) - из тела запроса.
+func callerNickname(context echo.Context, nickname string) string {
+	if session := callerSession(context); session != nil {
+		return session.ProfileNickname
+	}
+	return nickname
+}
+
+// Проверяет, что вызывающий пользователь может изменить object, принадлежащий пользователю owner: это сам owner
+// либо владелец или модератор форума forumSlug (если он указан). Токен нужен и при auth.required: false.
+func (handler *Handler) authorize(context echo.Context, owner, forumSlug, object string) error {
+	session := callerSession(context)
+	if session == nil {
+		return Unauthorized("Authentication required")
+	}
+	if strings.EqualFold(session.ProfileNickname, owner) {
+		return nil
+	}
+	if forumSlug != "" {
+		if moderator, err := handler.isModerator(context, forumSlug); err != nil || moderator {
+			return err
+		}
+	}
+	return Forbidden("User " + session.ProfileNickname + " can't change " + object)
+}
+
+// Владелец или модератор форума; запрос без токена - нет.
+func (handler *Handler) isModerator(context echo.Context, forumSlug string) (bool, error) {
+	session := callerSession(context)
+	if session == nil {
+		return false, nil
+	}
+	role, err := handler.Store.ForumGetRole(context.Request().Context(), forumSlug, session.ProfileNickname)
+	return role == "owner" || role == "moderator", err
+}
+
+func (auth *Auth) isAdmin(nickname string) bool {
+	for _, admin := range auth.admins {
+		if strings.EqualFold(admin, nickname) {
+			return true
+		}
+	}
+	return false
+}
+
+// Блокировки на всём сайте выдают и снимают только администраторы из auth.admins, тоже только с токеном.
+func (handler *Handler) requireAdmin(context echo.Context) (*Session, error) {
+	session := callerSession(context)
+	if session == nil {
+		return nil, Unauthorized("Authentication required")
+	}
+	if !handler.Auth.isAdmin(session.ProfileNickname) {
+		return nil, Forbidden("User " + session.ProfileNickname + " is not an administrator")
+	}
+	return session, nil
+}
+
+// Действия модерации требуют токена и при auth.required: false. role - owner (только владелец форума)
+// или moderator (владелец или модератор).
+func (handler *Handler) requireRole(context echo.Context, forumSlug, role string) (*Session, error) {
+	session := callerSession(context)
+	if session == nil {
+		return nil, Unauthorized("Authentication required")
+	}
+	callerRole, err := handler.Store.ForumGetRole(context.Request().Context(), forumSlug, session.ProfileNickname)
+	if err != nil {
+		return nil, err
+	}
+	if callerRole == "owner" || callerRole == "moderator" && role == "moderator" {
+		return session, nil
+	}
+	if role == "owner" {
+		return nil, Forbidden("User " + session.ProfileNickname + " is not the owner of forum " + forumSlug)
+	}
+	return nil, Forbidden("User " + session.ProfileNickname + " is not a moderator of forum " + forumSlug)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionId(t *testing.T) {
+	auth := &Auth{secret: []byte("secret")}
+	other := &Auth{secret: []byte("other")}
+	token := auth.token(Session{Id: "abc"})
+	tests := []struct {
+		name  string
+		token string
+		id    string
+		ok    bool
+	}{
+		{"valid", token, "abc", true},
+		{"other secret", other.token(Session{Id: "abc"}), "abc", false},
+		{"other id", "abd" + token[3:], "abd", false},
+		{"bad signature", token[:len(token)-1], "abc", false},
+		{"no signature", "abc.", "abc", false},
+		{"no dot", "abc", "", false},
+		{"empty", "", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if id, ok := auth.sessionId(test.token); id != test.id || ok != test.ok {
+				t.Errorf("sessionId(%q) = %q, %v, want %q, %v", test.token, id, ok, test.id, test.ok)
+			}
+		})
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestHandler(t)
+	bob, err := handler.Store.UserGetOne(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := Session{Id: "session", ProfileId: bob.Id, ProfileNickname: bob.Nickname, Expires: time.Now().Add(time.Hour)}
+	expired := Session{Id: "expired", ProfileId: bob.Id, ProfileNickname: bob.Nickname, Expires: time.Now().Add(-time.Hour)}
+	for _, session := range []Session{session, expired} {
+		if err := handler.Store.SessionCreate(ctx, session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name          string
+		required      bool
+		method        string
+		authorization string
+		status        int
+		nickname      string //пользователь сессии, которую видит обработчик
+	}{
+		{"token", false, http.MethodPost, "Bearer " + handler.Auth.token(session), http.StatusOK, "bob"},
+		{"anonymous", false, http.MethodPost, "", http.StatusOK, ""},
+		{"anonymous required", true, http.MethodPost, "", http.StatusUnauthorized, ""},
+		{"anonymous required get", true, http.MethodGet, "", http.StatusOK, ""},
+		{"expired", false, http.MethodPost, "Bearer " + handler.Auth.token(expired), http.StatusUnauthorized, ""},
+		{"unknown session", false, http.MethodPost, "Bearer " + handler.Auth.token(Session{Id: "unknown"}),
+			http.StatusUnauthorized, ""},
+		{"bad signature", false, http.MethodPost, "Bearer session.signature", http.StatusUnauthorized, ""},
+		{"not bearer", false, http.MethodPost, "Basic Ym9iOmhhc2g=", http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler.Auth.required = test.required
+			request := httptest.NewRequest(test.method, "/api/thread/th1/details", nil)
+			if test.authorization != "" {
+				request.Header.Set(echo.HeaderAuthorization, test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			context := echo.New().NewContext(request, recorder)
+			nickname := ""
+			err := handler.Auth.Middleware(func(context echo.Context) error {
+				if session := callerSession(context); session != nil {
+					nickname = session.ProfileNickname
+				}
+				return context.NoContent(http.StatusOK)
+			})(context)
+			if err != nil {
+				HTTPErrorHandler(err, context)
+			}
+			if recorder.Code != test.status || nickname != test.nickname {
+				t.Errorf("status %d, session %q, want %d, %q", recorder.Code, nickname, test.status, test.nickname)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name     string
+		handle   func(handler *Handler) echo.HandlerFunc
+		method   string
+		target   string
+		body     string
+		params   []string
+		statuses map[string]int //по пользователю сессии; "" - без токена
+	}{
+		{"post update", func(handler *Handler) echo.HandlerFunc { return handler.PostUpdate },
+			http.MethodPost, "/api/post/1/details", `{"message":"edited"}`, []string{"id", "1"},
+			map[string]int{"": 401, "zed": 403, "moderator": 200, "alice": 200, "bob": 200}},
+		{"post delete", func(handler *Handler) echo.HandlerFunc { return handler.PostDelete },
+			http.MethodDelete, "/api/post/1", "", []string{"id", "1"},
+			map[string]int{"": 401, "zed": 403, "moderator": 403, "alice": 403, "bob": 200}},
+		{"thread update", func(handler *Handler) echo.HandlerFunc { return handler.ThreadUpdate },
+			http.MethodPost, "/api/thread/th1/details", `{"title":"edited"}`, []string{"slug_or_id", "th1"},
+			map[string]int{"": 401, "zed": 403, "moderator": 200, "alice": 200, "bob": 200}},
+		{"thread delete", func(handler *Handler) echo.HandlerFunc { return handler.ThreadDelete },
+			http.MethodDelete, "/api/thread/th1", "", []string{"slug_or_id", "th1"},
+			map[string]int{"": 401, "zed": 403, "moderator": 200, "alice": 200, "bob": 200}},
+		{"forum update", func(handler *Handler) echo.HandlerFunc { return handler.ForumUpdate },
+			http.MethodPost, "/api/forum/f1/details", `{"title":"edited"}`, []string{"slug", "f1"},
+			map[string]int{"": 401, "zed": 403, "moderator": 403, "bob": 403, "alice": 200}},
+		{"forum delete", func(handler *Handler) echo.HandlerFunc { return handler.ForumDelete },
+			http.MethodDelete, "/api/forum/f1", "", []string{"slug", "f1"},
+			map[string]int{"": 401, "zed": 403, "moderator": 403, "bob": 403, "alice": 204}},
+		{"user update", func(handler *Handler) echo.HandlerFunc { return handler.UserUpdate },
+			http.MethodPost, "/api/user/bob/profile", `{"about":"edited"}`, []string{"nickname", "bob"},
+			map[string]int{"": 401, "zed": 403, "alice": 403, "bob": 200}},
+		{"user delete", func(handler *Handler) echo.HandlerFunc { return handler.UserDelete },
+			http.MethodDelete, "/api/user/bob", "", []string{"nickname", "bob"},
+			map[string]int{"": 401, "zed": 403, "alice": 403, "bob": 200}},
+		{"user purge", func(handler *Handler) echo.HandlerFunc { return handler.UserDelete },
+			http.MethodDelete, "/api/user/bob?mode=purge", "", []string{"nickname", "bob"},
+			map[string]int{"": 401, "zed": 403, "alice": 403, "bob": 204}},
+	}
+	for _, test := range tests {
+		for nickname, status := range test.statuses {
+			t.Run(test.name+" by "+nickname, func(t *testing.T) {
+				handler := newTestModeratedHandler(t)
+				response := testRequest(t, handler, test.handle(handler), test.method, test.target, test.body, nickname,
+					test.params...)
+				if response.Code != status {
+					t.Errorf("status %d, want %d, body %s", response.Code, status, response.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		nickname string
+		role     string
+		status   int
+	}{
+		{"", "moderator", http.StatusUnauthorized},
+		{"", "owner", http.StatusUnauthorized},
+		{"bob", "moderator", http.StatusForbidden},
+		{"bob", "owner", http.StatusForbidden},
+		{"moderator", "moderator", http.StatusOK},
+		{"moderator", "owner", http.StatusForbidden},
+		{"alice", "moderator", http.StatusOK},
+		{"alice", "owner", http.StatusOK},
+		{"zed", "moderator", http.StatusForbidden}, //владелец другого форума
+	}
+	for _, test := range tests {
+		t.Run(test.nickname+" as "+test.role, func(t *testing.T) {
+			handler := newTestModeratedHandler(t)
+			response := testRequest(t, handler, func(context echo.Context) error {
+				if _, err := handler.requireRole(context, "f1", test.role); err != nil {
+					return err
+				}
+				return context.NoContent(http.StatusOK)
+			}, http.MethodPost, "/", "", test.nickname)
+			if response.Code != test.status {
+				t.Errorf("status %d, want %d, body %s", response.Code, test.status, response.Body)
+			}
+		})
+	}
+}
+
+// newTestHandler с пользователем moderator - модератором форума f1.
+func newTestModeratedHandler(t *testing.T) *Handler {
+	t.Helper()
+	ctx := context.Background()
+	handler := newTestHandler(t)
+	if _, err := handler.Store.UserCreate(ctx, Profile{Nickname: "moderator", Email: "moderator@example.com"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Store.ForumModeratorCreate(ctx, "f1", "moderator", ModerationEntry{Forum: "f1"}); err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func TestAdminNicknameReserved(t *testing.T) {
+	tests := []struct {
+		nickname string
+		caller   string
+		status   int
+	}{
+		{"root", "", http.StatusForbidden},
+		{"ROOT", "bob", http.StatusForbidden},
+		{"root", "alice", http.StatusCreated},
+		{"carol", "", http.StatusCreated},
+		{"Search", "alice", http.StatusBadRequest}, //занят маршрутом /api/user/search
+	}
+	for _, test := range tests {
+		t.Run(test.nickname+" by "+test.caller, func(t *testing.T) {
+			handler := newTestHandler(t, "alice", "root")
+			response := testRequest(t, handler, handler.UserCreate, http.MethodPost, "/api/user/"+test.nickname+"/create",
+				`{"email":"`+test.nickname+`@example.com","fullname":"Root"}`, test.caller, "nickname", test.nickname)
+			if response.Code != test.status {
+				t.Errorf("status %d, want %d, body %s", response.Code, test.status, response.Body)
+			}
+		})
+	}
+}
+
+func TestUserCreatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		status   int
+		created  bool
+	}{
+		{"without password", "", http.StatusCreated, true},
+		{"with password", "password", http.StatusCreated, true},
+		{"short password", "short", http.StatusBadRequest, false}, //пользователь без пароля не создаётся
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestHandler(t)
+			response := testRequest(t, handler, handler.UserCreate, http.MethodPost, "/api/user/carol/create",
+				`{"email":"carol@example.com","password":"`+test.password+`"}`, "", "nickname", "carol")
+			if response.Code != test.status {
+				t.Fatalf("status %d, want %d, body %s", response.Code, test.status, response.Body)
+			}
+			_, passwordHash, err := handler.Store.UserGetPassword(context.Background(), "carol")
+			if created := err == nil; created != test.created {
+				t.Fatalf("user created %v, want %v", created, test.created)
+			}
+			if test.created && (passwordHash != "") != (test.password != "") {
+				t.Errorf("password hash %q for password %q", passwordHash, test.password)
+			}
+		})
+	}
+}
+
+func TestUserPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		nickname string //пользователь, которому меняют пароль
+		caller   string
+		body     string
+		status   int
+	}{
+		{"own", "bob", "bob", `{"password":"changed1","oldPassword":"password"}`, http.StatusNoContent},
+		{"own with wrong old password", "bob", "bob", `{"password":"changed1","oldPassword":"wrong"}`, http.StatusForbidden},
+		{"own without old password", "bob", "bob", `{"password":"changed1"}`, http.StatusForbidden},
+		{"other", "bob", "zed", `{"password":"changed1","oldPassword":"password"}`, http.StatusForbidden},
+		{"other by admin", "bob", "alice", `{"password":"changed1","oldPassword":"password"}`, http.StatusForbidden},
+		{"first by admin", "zed", "alice", `{"password":"changed1"}`, http.StatusNoContent},
+		{"first by user", "zed", "zed", `{"password":"changed1"}`, http.StatusForbidden},
+		{"anonymous", "bob", "", `{"password":"changed1","oldPassword":"password"}`, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestHandler(t, "alice")
+			passwordHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := handler.Store.UserSetPassword(context.Background(), "bob", string(passwordHash)); err != nil {
+				t.Fatal(err)
+			}
+			response := testRequest(t, handler, handler.UserPassword, http.MethodPost, "/api/user/"+test.nickname+"/password",
+				test.body, test.caller, "nickname", test.nickname)
+			if response.Code != test.status {
+				t.Errorf("status %d, want %d, body %s", response.Code, test.status, response.Body)
+			}
+		})
+	}
+}
+
+// История удалённого поста сохраняется, но видна только модераторам.
+func TestPostHistoryDeleted(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestModeratedHandler(t)
+	if err := handler.Store.PostUpdate(ctx, Post{Id: 1, Message: "edited"}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handler.Store.PostDelete(ctx, 1, &ModerationEntry{Forum: "f1", Moderator: "moderator"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		nickname string
+		status   int
+	}{
+		{"moderator", http.StatusOK},
+		{"alice", http.StatusOK},
+		{"bob", http.StatusConflict},
+		{"", http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.nickname, func(t *testing.T) {
+			response := testRequest(t, handler, handler.PostHistory, http.MethodGet, "/api/post/1/history", "",
+				test.nickname, "id", "1")
+			if response.Code != test.status {
+				t.Fatalf("status %d, want %d, body %s", response.Code, test.status, response.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			var revisions []PostRevision
+			if err := json.Unmarshal(response.Body.Bytes(), &revisions); err != nil {
+				t.Fatal(err)
+			}
+			var messages, authors []string
+			for _, revision := range revisions {
+				messages, authors = append(messages, revision.Message), append(authors, revision.ProfileNickname)
+			}
+			if !reflect.DeepEqual(messages, []string{"pth1", "edited", ""}) ||
+				!reflect.DeepEqual(authors, []string{"bob", "bob", "moderator"}) {
+				t.Errorf("revisions %v by %v", messages, authors)
+			}
+		})
+	}
+}
+
+// Архивирование чужой ветки записывается в журнал модерации, своей - нет.
+func TestThreadArchiveModeration(t *testing.T) {
+	tests := []struct {
+		nickname string
+		actions  []string
+	}{
+		{"bob", []string{}},
+		{"moderator", []string{"archive_thread"}},
+		{"alice", []string{"archive_thread"}},
+	}
+	for _, test := range tests {
+		t.Run(test.nickname, func(t *testing.T) {
+			handler := newTestModeratedHandler(t)
+			response := testRequest(t, handler, handler.ThreadDelete, http.MethodDelete, "/api/thread/th1",
+				`{"reason":"stale"}`, test.nickname, "slug_or_id", "th1")
+			if response.Code != http.StatusOK {
+				t.Fatalf("status %d, body %s", response.Code, response.Body)
+			}
+			entries, err := handler.Store.ForumGetLog(context.Background(), "f1", ModerationFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			actions := make([]string, 0)
+			for _, entry := range entries {
+				if entry.Action == "" { //назначение модератора в newTestModeratedHandler
+					continue
+				}
+				actions = append(actions, entry.Action)
+				if entry.Moderator != test.nickname || entry.Target != "thread 1" || entry.Reason != "stale" {
+					t.Errorf("entry %+v", entry)
+				}
+			}
+			if !reflect.DeepEqual(actions, test.actions) {
+				t.Errorf("actions %v, want %v", actions, test.actions)
+			}
+		})
+	}
+}
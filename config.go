@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Настройки сервера. Приоритет источников (от меньшего к большему): значения по умолчанию, YAML-файл,
+// переменные окружения, флаги командной строки.
+type Config struct {
+	Storage  string         `yaml:"storage"`
+	Server   ServerConfig   `yaml:"server"`
+	Database DatabaseConfig `yaml:"database"`
+	Auth     AuthConfig     `yaml:"auth"`
+	LogLevel string         `yaml:"log_level"`
+
+	LogSlowRequest time.Duration `yaml:"log_slow_request"`
+}
+
+type ServerConfig struct {
+	Listen          string        `yaml:"listen"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type DatabaseConfig struct {
+	DSN string `yaml:"dsn"`
+
+	//benchmark - UNLOGGED-таблицы и настройки PostgreSQL без fsync (данные теряются при сбое),
+	//durable - обычные таблицы и безопасные настройки; применяется командами migrate up и migrate settings
+	Profile string `yaml:"profile"`
+
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+
+	//тайм-аут запросов к хранилищу на время обработки одного HTTP-запроса; QueryTimeouts переопределяет его
+	//для отдельных маршрутов, например "/api/thread/:slug_or_id/posts": 30s
+	QueryTimeout  time.Duration            `yaml:"query_timeout"`
+	QueryTimeouts map[string]time.Duration `yaml:"query_timeouts"`
+}
+
+type AuthConfig struct {
+	//ключ HMAC-подписи токенов; если не задан, генерируется при запуске, и токены не переживают перезапуск
+	Secret   string        `yaml:"secret"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+
+	//true (по умолчанию) - изменяющие запросы без токена отклоняются (401); false - режим совместимости
+	//с прежним API, в котором автор постов, веток, форумов и голосов без токена берётся из тела запроса
+	Required bool `yaml:"required"`
+
+	//никнеймы администраторов, которые блокируют пользователей на всём сайте
+	Admins []string `yaml:"admins"`
+}
+
+const configEnvPrefix = "FORUMS_"
+
+var logLevels = []string{"debug", "info", "warn", "error", "off"}
+
+var storages = []string{"postgres", "memory"}
+
+var databaseProfiles = []string{"benchmark", "durable"}
+
+func DefaultConfig() Config {
+	return Config{
+		Storage: "postgres",
+		Server: ServerConfig{
+			Listen:          "0.0.0.0:5000",
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     60 * time.Second,
+			ShutdownTimeout: 10 * time.Second,
+		},
+		Database: DatabaseConfig{
+			DSN:             "host=localhost port=5432 user=forums_user password=forums_user dbname=forums sslmode=disable",
+			Profile:         "durable",
+			MaxOpenConns:    0,
+			MaxIdleConns:    2,
+			ConnMaxLifetime: 0,
+			ConnMaxIdleTime: 0,
+			QueryTimeout:    10 * time.Second,
+		},
+		Auth: AuthConfig{
+			TokenTTL: 7 * 24 * time.Hour,
+			Required: true,
+		},
+		LogLevel: "error",
+	}
+}
+
+type configSetting struct {
+	name  string //имя флага; имя переменной окружения получается из него: listen -> FORUMS_LISTEN
+	usage string
+	apply func(config *Config, value string) error
+}
+
+func stringSetting(name, usage string, field func(config *Config) *string) configSetting {
+	return configSetting{name, usage, func(config *Config, value string) error {
+		*field(config) = value
+		return nil
+	}}
+}
+
+func intSetting(name, usage string, field func(config *Config) *int) configSetting {
+	return configSetting{name, usage, func(config *Config, value string) error {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		*field(config) = parsed
+		return nil
+	}}
+}
+
+func boolSetting(name, usage string, field func(config *Config) *bool) configSetting {
+	return configSetting{name, usage, func(config *Config, value string) error {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*field(config) = parsed
+		return nil
+	}}
+}
+
+// Список через запятую.
+func listSetting(name, usage string, field func(config *Config) *[]string) configSetting {
+	return configSetting{name, usage, func(config *Config, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(config) = list
+		return nil
+	}}
+}
+
+func durationSetting(name, usage string, field func(config *Config) *time.Duration) configSetting {
+	return configSetting{name, usage, func(config *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration (e.g. 500ms, 10s, 1m)", value)
+		}
+		*field(config) = parsed
+		return nil
+	}}
+}
+
+var configSettings = []configSetting{
+	stringSetting("storage", "storage backend: "+strings.Join(storages, ", "),
+		func(config *Config) *string { return &config.Storage }),
+	stringSetting("listen", "address the HTTP server listens on",
+		func(config *Config) *string { return &config.Server.Listen }),
+	durationSetting("read-timeout", "maximum duration for reading an entire request",
+		func(config *Config) *time.Duration { return &config.Server.ReadTimeout }),
+	durationSetting("write-timeout", "maximum duration before timing out writes of a response",
+		func(config *Config) *time.Duration { return &config.Server.WriteTimeout }),
+	durationSetting("idle-timeout", "maximum time to wait for the next request on a keep-alive connection",
+		func(config *Config) *time.Duration { return &config.Server.IdleTimeout }),
+	durationSetting("shutdown-timeout", "how long to wait for in-flight requests on SIGINT/SIGTERM",
+		func(config *Config) *time.Duration { return &config.Server.ShutdownTimeout }),
+	stringSetting("dsn", "PostgreSQL connection string",
+		func(config *Config) *string { return &config.Database.DSN }),
+	stringSetting("db-profile", "database deployment profile: "+strings.Join(databaseProfiles, ", "),
+		func(config *Config) *string { return &config.Database.Profile }),
+	intSetting("db-max-open-conns", "maximum number of open database connections (0 - unlimited)",
+		func(config *Config) *int { return &config.Database.MaxOpenConns }),
+	intSetting("db-max-idle-conns", "maximum number of idle database connections",
+		func(config *Config) *int { return &config.Database.MaxIdleConns }),
+	durationSetting("db-conn-max-lifetime", "maximum lifetime of a database connection (0 - unlimited)",
+		func(config *Config) *time.Duration { return &config.Database.ConnMaxLifetime }),
+	durationSetting("db-conn-max-idle-time", "maximum idle time of a database connection (0 - unlimited)",
+		func(config *Config) *time.Duration { return &config.Database.ConnMaxIdleTime }),
+	durationSetting("query-timeout", "default deadline for database queries of a single request (0 - none)",
+		func(config *Config) *time.Duration { return &config.Database.QueryTimeout }),
+	stringSetting("auth-secret", "key for signing bearer tokens (random on every start if empty)",
+		func(config *Config) *string { return &config.Auth.Secret }),
+	durationSetting("auth-token-ttl", "lifetime of a bearer token issued on login",
+		func(config *Config) *time.Duration { return &config.Auth.TokenTTL }),
+	boolSetting("auth-required", "reject modifying requests without a bearer token (false trusts authors in request bodies)",
+		func(config *Config) *bool { return &config.Auth.Required }),
+	listSetting("auth-admins", "comma-separated nicknames of administrators who can suspend users",
+		func(config *Config) *[]string { return &config.Auth.Admins }),
+	stringSetting("log-level", "log level: "+strings.Join(logLevels, ", "),
+		func(config *Config) *string { return &config.LogLevel }),
+	durationSetting("log-slow-request", "log requests taking longer than this at warn level (0 - disabled)",
+		func(config *Config) *time.Duration { return &config.LogSlowRequest }),
+}
+
+func (setting configSetting) envName() string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(setting.name, "-", "_"))
+}
+
+// Возвращает также аргументы, оставшиеся после флагов.
+func LoadConfig(name string, args []string) (Config, []string, error) {
+	config := DefaultConfig()
+
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flagSet.String("config", "", "path to a YAML config file (env "+configEnvPrefix+"CONFIG)")
+	flagValues := make(map[string]*string, len(configSettings))
+	for _, setting := range configSettings {
+		flagValues[setting.name] = flagSet.String(setting.name, "", setting.usage+" (env "+setting.envName()+")")
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return config, nil, err
+	}
+
+	if *configFile == "" {
+		*configFile = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	if *configFile != "" {
+		file, err := os.Open(*configFile)
+		if err != nil {
+			return config, nil, fmt.Errorf("config: %w", err)
+		}
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		err = decoder.Decode(&config)
+		_ = file.Close()
+		if err != nil && err != io.EOF {
+			return config, nil, fmt.Errorf("config: %s: %w", *configFile, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value, ok := os.LookupEnv(setting.envName()); ok {
+			if err := setting.apply(&config, value); err != nil {
+				return config, nil, fmt.Errorf("config: %s: %w", setting.envName(), err)
+			}
+		}
+	}
+
+	var err error
+	flagSet.Visit(func(visited *flag.Flag) {
+		for _, setting := range configSettings {
+			if setting.name == visited.Name && err == nil {
+				if applyErr := setting.apply(&config, *flagValues[setting.name]); applyErr != nil {
+					err = fmt.Errorf("config: -%s: %w", setting.name, applyErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return config, nil, err
+	}
+
+	return config, flagSet.Args(), config.Validate()
+}
+
+func (config Config) Validate() error {
+	var problems []string
+	if !containsString(storages, config.Storage) {
+		problems = append(problems, fmt.Sprintf("storage must be one of %s, got %q",
+			strings.Join(storages, ", "), config.Storage))
+	}
+	if config.Server.Listen == "" {
+		problems = append(problems, "server.listen must not be empty")
+	}
+	if config.Server.ReadTimeout < 0 {
+		problems = append(problems, "server.read_timeout must not be negative")
+	}
+	if config.Server.WriteTimeout < 0 {
+		problems = append(problems, "server.write_timeout must not be negative")
+	}
+	if config.Server.IdleTimeout < 0 {
+		problems = append(problems, "server.idle_timeout must not be negative")
+	}
+	if config.Server.ShutdownTimeout < 0 {
+		problems = append(problems, "server.shutdown_timeout must not be negative")
+	}
+	if !containsString(databaseProfiles, config.Database.Profile) {
+		problems = append(problems, fmt.Sprintf("database.profile must be one of %s, got %q",
+			strings.Join(databaseProfiles, ", "), config.Database.Profile))
+	}
+	if config.Database.DSN == "" {
+		problems = append(problems, "database.dsn must not be empty")
+	}
+	if config.Database.MaxOpenConns < 0 {
+		problems = append(problems, "database.max_open_conns must not be negative")
+	}
+	if config.Database.MaxIdleConns < 0 {
+		problems = append(problems, "database.max_idle_conns must not be negative")
+	}
+	if config.Database.ConnMaxLifetime < 0 {
+		problems = append(problems, "database.conn_max_lifetime must not be negative")
+	}
+	if config.Database.ConnMaxIdleTime < 0 {
+		problems = append(problems, "database.conn_max_idle_time must not be negative")
+	}
+	if config.Database.QueryTimeout < 0 {
+		problems = append(problems, "database.query_timeout must not be negative")
+	}
+	for route, timeout := range config.Database.QueryTimeouts {
+		if timeout < 0 {
+			problems = append(problems, fmt.Sprintf("database.query_timeouts[%q] must not be negative", route))
+		}
+	}
+	if config.Auth.TokenTTL <= 0 {
+		problems = append(problems, "auth.token_ttl must be positive")
+	}
+	for _, admin := range config.Auth.Admins {
+		if strings.HasPrefix(strings.ToLower(admin), "deleted-") { //UserAnonymize переименовывает в deleted-<id>
+			problems = append(problems, fmt.Sprintf("auth.admins must not contain anonymized nickname %q", admin))
+		}
+	}
+	if !containsString(logLevels, config.LogLevel) {
+		problems = append(problems, fmt.Sprintf("log_level must be one of %s, got %q",
+			strings.Join(logLevels, ", "), config.LogLevel))
+	}
+	if config.LogSlowRequest < 0 {
+		problems = append(problems, "log_slow_request must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"time"
+)
+
+// Курсор постраничной выдачи - полный ключ сортировки последнего элемента страницы. Клиенту он передаётся
+// непрозрачной строкой (base64url от JSON) в заголовке Link и принимается обратно в параметре cursor.
+// List и Desc не дают передать курсор одного списка в другой или сменить порядок между страницами.
+type Cursor struct {
+	List     string     `json:"l"` //threads, users, flat, tree или parent_tree
+	Desc     bool       `json:"d,omitempty"`
+	Created  *time.Time `json:"c,omitempty"` //threads, flat
+	Id       uint64     `json:"i,omitempty"` //threads, flat; parent_tree - id корневого поста
+	Nickname string     `json:"n,omitempty"` //users
+	Path     []uint64   `json:"p,omitempty"` //tree
+}
+
+func (cursor Cursor) String() string {
+	value, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+func ParseCursor(value, list string, desc bool) (*Cursor, error) {
+	var cursor Cursor
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(decoded, &cursor) != nil || cursor.List != list || cursor.Desc != desc ||
+		(list == "threads" || list == "flat") && cursor.Created == nil {
+		return nil, Validation("Invalid cursor " + value)
+	}
+	return &cursor, nil
+}
+
+// Курсор из параметра cursor; вместе с since его использовать нельзя.
+func queryCursor(context echo.Context, list string, desc bool) (*Cursor, error) {
+	value := context.QueryParam("cursor")
+	if value == "" {
+		return nil, nil
+	}
+	if context.QueryParam("since") != "" {
+		return nil, Validation("Invalid cursor: since and cursor cannot be combined")
+	}
+	return ParseCursor(value, list, desc)
+}
+
+// Ссылка на следующую страницу: тот же запрос, в котором since заменён на cursor.
+func setNextCursor(context echo.Context, cursor Cursor) {
+	next := *context.Request().URL
+	query := next.Query()
+	query.Del("since")
+	query.Set("cursor", cursor.String())
+	next.RawQuery = query.Encode()
+	context.Response().Header().Set("Link", "<"+next.RequestURI()+`>; rel="next"`)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCursor(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		value  string
+		list   string
+		desc   bool
+		cursor *Cursor //nil - неверный курсор
+	}{
+		{"threads", Cursor{List: "threads", Created: &created, Id: 3}.String(), "threads", false,
+			&Cursor{List: "threads", Created: &created, Id: 3}},
+		{"flat desc", Cursor{List: "flat", Desc: true, Created: &created, Id: 7}.String(), "flat", true,
+			&Cursor{List: "flat", Desc: true, Created: &created, Id: 7}},
+		{"tree", Cursor{List: "tree", Path: []uint64{1, 4}}.String(), "tree", false,
+			&Cursor{List: "tree", Path: []uint64{1, 4}}},
+		{"parent_tree", Cursor{List: "parent_tree", Id: 2}.String(), "parent_tree", false,
+			&Cursor{List: "parent_tree", Id: 2}},
+		{"users", Cursor{List: "users", Nickname: "bob"}.String(), "users", false,
+			&Cursor{List: "users", Nickname: "bob"}},
+		{"other list", Cursor{List: "tree", Path: []uint64{1}}.String(), "flat", false, nil},
+		{"other order", Cursor{List: "users", Nickname: "bob"}.String(), "users", true, nil},
+		{"threads without created", Cursor{List: "threads", Id: 3}.String(), "threads", false, nil},
+		{"flat without created", Cursor{List: "flat", Id: 3}.String(), "flat", false, nil},
+		{"not base64", "!!!", "users", false, nil},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("users")), "users", false, nil},
+		{"empty", "", "users", false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cursor, err := ParseCursor(test.value, test.list, test.desc)
+			if test.cursor == nil {
+				if err == nil {
+					t.Errorf("ParseCursor(%q) = %+v, want error", test.value, cursor)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(cursor, test.cursor) {
+				t.Errorf("ParseCursor(%q) = %+v, %v, want %+v", test.value, cursor, err, test.cursor)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Больше этого числа сравнений (слов в одной версии на слова в другой) diff не ищется: текст целиком
+// считается удалённым и вставленным заново. Таблица diffMiddle занимает до ~3 МБ на запрос.
+const diffMaxComparisons = 400000
+
+// Разбивает текст на слова и промежутки между ними, чтобы diff не разрывал слова.
+func diffTokens(text string) []string {
+	var tokens []string
+	start := 0
+	for i, r := range text {
+		if i > start && unicode.IsSpace(r) != isSpaceAt(text, start) {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+func isSpaceAt(text string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(text[i:])
+	return unicode.IsSpace(r)
+}
+
+// Пословный diff двух версий текста по наибольшей общей подпоследовательности.
+func Diff(from, to string) []DiffChange {
+	left, right := diffTokens(from), diffTokens(to)
+
+	//общие начало и конец не участвуют в поиске подпоследовательности
+	prefix := 0
+	for prefix < len(left) && prefix < len(right) && left[prefix] == right[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(left)-prefix && suffix < len(right)-prefix &&
+		left[len(left)-1-suffix] == right[len(right)-1-suffix] {
+		suffix++
+	}
+
+	changes := make([]DiffChange, 0)
+	changes = appendChange(changes, "equal", left[:prefix])
+	middleLeft, middleRight := left[prefix:len(left)-suffix], right[prefix:len(right)-suffix]
+	if len(middleLeft)*len(middleRight) > diffMaxComparisons {
+		changes = appendChange(changes, "delete", middleLeft)
+		changes = appendChange(changes, "insert", middleRight)
+	} else {
+		changes = diffMiddle(changes, middleLeft, middleRight)
+	}
+	return appendChange(changes, "equal", left[len(left)-suffix:])
+}
+
+func diffMiddle(changes []DiffChange, left, right []string) []DiffChange {
+	//common[i][j] - длина наибольшей общей подпоследовательности left[i:] и right[j:]
+	common := make([][]int, len(left)+1)
+	for i := range common {
+		common[i] = make([]int, len(right)+1)
+	}
+	for i := len(left) - 1; i >= 0; i-- {
+		for j := len(right) - 1; j >= 0; j-- {
+			if left[i] == right[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(left) || j < len(right) {
+		switch {
+		case i < len(left) && j < len(right) && left[i] == right[j]:
+			changes = appendChange(changes, "equal", left[i:i+1])
+			i, j = i+1, j+1
+		case j == len(right) || i < len(left) && common[i+1][j] >= common[i][j+1]:
+			changes = appendChange(changes, "delete", left[i:i+1])
+			i++
+		default:
+			changes = appendChange(changes, "insert", right[j:j+1])
+			j++
+		}
+	}
+	return changes
+}
+
+// Добавляет токены к последнему изменению, если оно того же вида.
+func appendChange(changes []DiffChange, op string, tokens []string) []DiffChange {
+	for _, token := range tokens {
+		if last := len(changes) - 1; last >= 0 && changes[last].Op == op {
+			changes[last].Text += token
+		} else {
+			changes = append(changes, DiffChange{Op: op, Text: token})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		changes  []DiffChange
+	}{
+		{"empty", "", "", []DiffChange{}},
+		{"same", "a b", "a b", []DiffChange{{"equal", "a b"}}},
+		{"insert", "", "a b", []DiffChange{{"insert", "a b"}}},
+		{"delete", "a b", "", []DiffChange{{"delete", "a b"}}},
+		{"replace word", "the quick fox", "the slow fox",
+			[]DiffChange{{"equal", "the "}, {"delete", "quick"}, {"insert", "slow"}, {"equal", " fox"}}},
+		{"append", "hello", "hello world", []DiffChange{{"equal", "hello"}, {"insert", " world"}}},
+		{"whole words", "cat", "cart", []DiffChange{{"delete", "cat"}, {"insert", "cart"}}},
+		{"middle", "a b c d", "a c d e",
+			[]DiffChange{{"equal", "a "}, {"delete", "b "}, {"equal", "c d"}, {"insert", " e"}}},
+		{"unicode", "привет мир", "привет, мир",
+			[]DiffChange{{"delete", "привет"}, {"insert", "привет,"}, {"equal", " мир"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if changes := Diff(test.from, test.to); !reflect.DeepEqual(changes, test.changes) {
+				t.Errorf("Diff(%q, %q) = %v, want %v", test.from, test.to, changes, test.changes)
+			}
+		})
+	}
+}
+
+func TestDiffTooLarge(t *testing.T) {
+	//больше diffMaxComparisons сравнений: текст целиком удаляется и вставляется
+	from := strings.Repeat("a ", 1000) + "x"
+	to := "y" + strings.Repeat(" b", 1000)
+	changes := Diff(from, to)
+	if want := []DiffChange{{"delete", from}, {"insert", to}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("Diff of large texts = %d changes, want delete and insert", len(changes))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrValidation   = errors.New("validation failed")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrInternal     = errors.New("internal error")
+	ErrTimeout      = errors.New("timeout")
+	ErrUnavailable  = errors.New("unavailable")
+)
+
+// Ошибка предметной области: Kind (ErrNotFound, ErrConflict, ErrValidation, ErrUnauthorized, ErrForbidden,
+// ErrInternal, ErrTimeout, ErrUnavailable) определяет HTTP-статус,
+// Message уходит клиенту в теле Error, Cause - исходная ошибка (только для логов).
+type DomainError struct {
+	Kind    error
+	Message string
+	Cause   error
+}
+
+func (err *DomainError) Error() string {
+	if err.Cause != nil {
+		return err.Message + ": " + err.Cause.Error()
+	}
+	return err.Message
+}
+
+func (err *DomainError) Unwrap() error {
+	return err.Kind
+}
+
+func NotFound(message string) error {
+	return &DomainError{Kind: ErrNotFound, Message: message}
+}
+
+func Conflict(message string) error {
+	return &DomainError{Kind: ErrConflict, Message: message}
+}
+
+func Validation(message string) error {
+	return &DomainError{Kind: ErrValidation, Message: message}
+}
+
+func Unauthorized(message string) error {
+	return &DomainError{Kind: ErrUnauthorized, Message: message}
+}
+
+func Forbidden(message string) error {
+	return &DomainError{Kind: ErrForbidden, Message: message}
+}
+
+func Internal(cause error) error {
+	return &DomainError{Kind: ErrInternal, Message: "Internal server error", Cause: cause}
+}
+
+// Внутренняя ошибка хранилища с именем операции, в которой она возникла (для логов).
+type OperationError struct {
+	Operation string
+	Err       error
+}
+
+func (err *OperationError) Error() string {
+	return err.Operation + ": " + err.Err.Error()
+}
+
+func (err *OperationError) Unwrap() error {
+	return err.Err
+}
+
+// Запросы к хранилищу выполняются в контексте HTTP-запроса: истёкший тайм-аут отдаём как 504,
+// отменённый запрос (клиент отключился, сервер останавливается) - как 503. lib/pq при отмене возвращает
+// ошибку сервера, а не контекста, поэтому requestErr - ctx.Err() контекста запроса, пока он ещё не освобождён
+// (QueryTimeout); после освобождения он отменён всегда, и requestErr должен быть nil.
+func contextError(err, requestErr error) *DomainError {
+	var domainError *DomainError
+	var httpError *echo.HTTPError
+	if err == nil || errors.As(err, &domainError) || errors.As(err, &httpError) {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) || requestErr == context.DeadlineExceeded {
+		return &DomainError{Kind: ErrTimeout, Message: "Request timed out", Cause: err}
+	}
+	if errors.Is(err, context.Canceled) || requestErr == context.Canceled {
+		return &DomainError{Kind: ErrUnavailable, Message: "Request was cancelled", Cause: err}
+	}
+	return nil
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrValidation):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Единая точка преобразования ошибок обработчиков в HTTP-ответы с телом Error.
+func HTTPErrorHandler(err error, context echo.Context) {
+	if context.Response().Committed {
+		return
+	}
+
+	var status int
+	var message string
+	var domainError *DomainError
+	var httpError *echo.HTTPError
+	if errors.As(err, &domainError) {
+		status, message = errorStatus(domainError), domainError.Message
+	} else if errors.As(err, &httpError) {
+		status, message = httpError.Code, http.StatusText(httpError.Code)
+		if text, ok := httpError.Message.(string); ok {
+			message = text
+		}
+	} else if domainError = contextError(err, nil); domainError != nil {
+		err = domainError
+		status, message = errorStatus(domainError), domainError.Message
+	} else {
+		err = Internal(err)
+		status, message = http.StatusInternalServerError, "Internal server error"
+	}
+
+	response := Error{
+		Message: message,
+	}
+	if status == http.StatusUnauthorized {
+		context.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	}
+	if status >= http.StatusInternalServerError {
+		response.RequestId = context.Response().Header().Get(echo.HeaderXRequestID)
+		logRequestError(context, err)
+	}
+
+	if context.Request().Method == http.MethodHead {
+		err = context.NoContent(status)
+	} else {
+		err = context.JSON(status, response)
+	}
+	if err != nil {
+		logRequestError(context, err)
+	}
+}
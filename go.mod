@@ -4,6 +4,10 @@ go 1.16
 
 require (
 	github.com/labstack/echo/v4 v4.1.17
+	github.com/labstack/gommon v0.3.0
 	github.com/lib/pq v1.9.0
 	github.com/mailru/easyjson v0.7.6 // indirect
+	github.com/prometheus/client_golang v1.11.1
+	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	gopkg.in/yaml.v3 v3.0.1
 )
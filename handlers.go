@@ -1,11 +1,11 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/labstack/echo/v4"
-	_ "github.com/lib/pq"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -15,7 +15,8 @@ import (
 
 //easyjson:json
 type Error struct {
-	Message string `json:"message"`
+	Message   string `json:"message"`
+	RequestId string `json:"request_id,omitempty"`
 }
 
 //easyjson:json
@@ -49,6 +50,9 @@ type Thread struct {
 	Slug            string    `json:"slug"`
 	Title           string    `json:"title"`
 	Votes           int32     `json:"votes"`
+	Archived        bool      `json:"archived,omitempty"`
+	Locked          bool      `json:"locked,omitempty"` //новые посты пишут только модераторы
+	Pinned          bool      `json:"pinned,omitempty"` //выводится в начале списка веток форума
 }
 
 //easyjson:json
@@ -62,6 +66,9 @@ type Post struct {
 	Message         string    `json:"message"`
 	ParentPost      uint64    `json:"parent,omitempty"`
 	ThreadId        uint32    `   json:"thread"`
+	Deleted         string    `json:"deleted,omitempty"` //author или moderator; у удалённого поста пустой message
+	Hidden          bool      `json:"hidden,omitempty"`  //скрыт модератором; message видят только модераторы
+	Path            []uint64  `json:"-"`                 //path_, только для sort=tree (курсор)
 }
 
 //easyjson:json
@@ -72,6 +79,48 @@ type PostFull struct {
 	Thread  *Thread  `json:"thread,omitempty"`
 }
 
+// Правка поста: кто и когда изменил текст; Message - текст до правки.
+type PostEdit struct {
+	ProfileNickname string
+	Edited          time.Time
+	Message         string
+}
+
+//easyjson:json
+type PostRevision struct {
+	Revision        int       `json:"revision"` //1 - исходный текст поста, последняя версия - текущий
+	ProfileNickname string    `json:"author"`
+	Created         time.Time `json:"created"`
+	Message         string    `json:"message"`
+}
+
+//easyjson:json
+type DiffChange struct {
+	Op   string `json:"op"` //equal, insert или delete
+	Text string `json:"text"`
+}
+
+//easyjson:json
+type PostDiff struct {
+	From    int          `json:"from"`
+	To      int          `json:"to"`
+	Changes []DiffChange `json:"changes"`
+}
+
+//easyjson:json
+type SearchResult struct {
+	Thread  *Thread `json:"thread,omitempty"` //найдена ветка или пост
+	Post    *Post   `json:"post,omitempty"`
+	Rank    float32 `json:"rank"`
+	Snippet string  `json:"snippet"` //фрагмент текста, найденные слова выделены <b></b>
+}
+
+//easyjson:json
+type ThreadVotes struct {
+	Thread uint32 `json:"thread"`
+	Votes  int32  `json:"votes"`
+}
+
 //easyjson:json
 type Vote struct {
 	ProfileId       uint32 `json:"-"`
@@ -80,6 +129,55 @@ type Vote struct {
 	Voice           int8   `json:"voice"`
 }
 
+//easyjson:json
+type ForumRole struct {
+	Nickname string     `json:"nickname"`
+	Role     string     `json:"role"`              //owner, moderator или member
+	Created  *time.Time `json:"created,omitempty"` //когда назначен модератор
+}
+
+//easyjson:json
+type ForumBan struct {
+	ProfileId uint32     `json:"-"`
+	Forum     string     `json:"forum,omitempty"` //пустой - блокировка на всём сайте
+	Nickname  string     `json:"nickname"`
+	Moderator string     `json:"moderator"`
+	Reason    string     `json:"reason"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"` //nil - бессрочно
+}
+
+//easyjson:json
+type ModerationEntry struct {
+	Id        uint64    `json:"id"`
+	Forum     string    `json:"forum"`
+	Moderator string    `json:"moderator"` //пустой, если модератор удалён
+	Action    string    `json:"action"`    //grant_moderator, revoke_moderator, ban, unban, hide_post, unhide_post, delete_post, archive_thread, lock_thread, unlock_thread, pin_thread, unpin_thread, move_thread
+	Target    string    `json:"target"`    //post <id>, thread <id> или user <nickname>
+	Details   string    `json:"details,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+//easyjson:json
+type Moderation struct {
+	Reason  string     `json:"reason"`  //необязательная причина для журнала модерации
+	Forum   string     `json:"forum"`   //move: форум, в который переносится ветка
+	Expires *time.Time `json:"expires"` //бан и блокировка: до какого момента, по умолчанию бессрочно
+}
+
+//easyjson:json
+type Credentials struct {
+	Nickname string `json:"nickname"`
+	Password string `json:"password"`
+}
+
+//easyjson:json
+type Token struct {
+	Token   string    `json:"token"` //передаётся в заголовке Authorization: Bearer <token>
+	Expires time.Time `json:"expires"`
+}
+
 //easyjson:json
 type Status struct {
 	Forum  uint32 `json:"forum"`
@@ -91,400 +189,522 @@ type Status struct {
 //TODO: сгенерировать easyjson?
 //TODO: вставку полей типа INSERT INTO ... (profile_nickname, ...) SELECT profile.nickname, ... FROM profile ... оставлять на откуп СУБД (в триггерах), а не приложению
 
-/*var apiCalls uint8
+type Handler struct {
+	Store Store
+	Auth  *Auth
 
-func Api(_ echo.Context) error {
-	if apiCalls++; apiCalls == 3 {
-		if _, err := DBConnection.Exec("VACUUM ANALYZE;"); err != nil {
-			panic(err)
-		}
+	//отменяется при остановке сервера, чтобы потоки событий не задерживали её до shutdown_timeout
+	streams      context.Context
+	closeStreams context.CancelFunc
+}
+
+func NewHandler(store Store, auth *Auth) *Handler {
+	streams, closeStreams := context.WithCancel(context.Background())
+	return &Handler{Store: store, Auth: auth, streams: streams, closeStreams: closeStreams}
+}
+
+func (handler *Handler) CloseStreams() {
+	handler.closeStreams()
+}
+
+func bindBody(context echo.Context, value interface{}) error {
+	if err := context.Bind(value); err != nil {
+		return Validation("Invalid request body")
 	}
 	return nil
-}*/
+}
+
+func queryLimit(context echo.Context, defaultLimit int) (int, error) {
+	limit := context.QueryParam("limit")
+	if limit == "" {
+		return defaultLimit, nil
+	}
+	parsed, err := strconv.Atoi(limit)
+	if err != nil || parsed < 0 {
+		return 0, Validation("Invalid limit " + limit)
+	}
+	return parsed, nil
+}
 
-func ForumCreate(context echo.Context) error {
+func paramPostId(context echo.Context) (uint64, error) {
+	id, err := strconv.ParseUint(context.Param("id"), 10, 64)
+	if err != nil {
+		return 0, Validation("Invalid post id " + context.Param("id"))
+	}
+	return id, nil
+}
+
+func (handler *Handler) ForumCreate(context echo.Context) error {
+	ctx := context.Request().Context()
 	var forum Forum
-	if err := context.Bind(&forum); err != nil {
-		panic(err)
+	if err := bindBody(context, &forum); err != nil {
+		return err
 	}
+	forum.ProfileNickname = callerNickname(context, forum.ProfileNickname)
 
-	if err := DBConnection.QueryRow("INSERT INTO forum (slug, title, profile_nickname) SELECT $1, $2, profile.nickname FROM profile WHERE profile.nickname = $3 RETURNING forum.profile_nickname;",
-		forum.Slug, forum.Title, forum.ProfileNickname).Scan(&forum.ProfileNickname); err != nil {
-		if err == sql.ErrNoRows {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find user with nickname " + forum.ProfileNickname,
-			})
-		} else {
-			if err := DBConnection.QueryRow("SELECT forum.slug, forum.title, forum.profile_nickname FROM forum WHERE forum.slug = $1;",
-				forum.Slug).Scan(&forum.Slug, &forum.Title, &forum.ProfileNickname); err != nil {
-				panic(err)
-			}
-			return context.JSON(http.StatusConflict, forum)
-		}
+	forum, err := handler.Store.ForumCreate(ctx, forum)
+	if err == ErrConflict {
+		return context.JSON(http.StatusConflict, forum)
+	} else if err != nil {
+		return err
 	}
 
 	return context.JSON(http.StatusCreated, forum)
 }
 
-func ThreadCreate(context echo.Context) error {
+func (handler *Handler) ThreadCreate(context echo.Context) error {
+	ctx := context.Request().Context()
 	var thread Thread
-	if err := context.Bind(&thread); err != nil {
-		panic(err)
+	if err := bindBody(context, &thread); err != nil {
+		return err
 	}
 	thread.ForumSlug = context.Param("slug_")
+	thread.ProfileNickname = callerNickname(context, thread.ProfileNickname)
+	if err := handler.checkBans(ctx, thread.ForumSlug, []string{thread.ProfileNickname}); err != nil {
+		return err
+	}
 
-	if err := DBConnection.QueryRow("INSERT INTO thread (profile_nickname, created, forum_slug, message, slug, title) SELECT profile.nickname, $2, forum.slug, $4, $5, $6 FROM profile, forum WHERE profile.nickname = $1 AND forum.slug = $3 RETURNING thread.id, thread.profile_nickname, thread.forum_slug;",
-		thread.ProfileNickname, thread.Created, thread.ForumSlug, thread.Message, thread.Slug, thread.Title).
-		Scan(&thread.Id, &thread.ProfileNickname, &thread.ForumSlug); err != nil {
-		if err == sql.ErrNoRows {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find user with nickname " + thread.ProfileNickname + " or forum with slug " + thread.ForumSlug,
-			})
-		} else {
-			if err := DBConnection.QueryRow("SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title FROM thread WHERE thread.slug = $1;",
-				thread.Slug).Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
-				&thread.Slug, &thread.Title); err != nil {
-				panic(err)
-			}
-			return context.JSON(http.StatusConflict, thread)
-		}
+	thread, err := handler.Store.ThreadCreate(ctx, thread)
+	if err == ErrConflict {
+		return context.JSON(http.StatusConflict, thread)
+	} else if err != nil {
+		return err
 	}
 
 	return context.JSON(http.StatusCreated, thread)
 }
 
-func ForumGetOne(context echo.Context) error {
-	var forum Forum
-	forum.Slug = context.Param("slug")
-	if err := DBConnection.QueryRow("SELECT forum.slug, forum.title, forum.profile_nickname, forum.threads, forum.posts FROM forum WHERE forum.slug = $1;", //"EXECUTE prepared_forum_get_one($1);", //
-		forum.Slug).Scan(&forum.Slug, &forum.Title, &forum.ProfileNickname, &forum.Threads, &forum.Posts); err == sql.ErrNoRows {
-		return context.JSON(http.StatusNotFound, Error{
-			Message: "Can't find forum with slug " + forum.Slug,
-		})
+func (handler *Handler) ForumGetOne(context echo.Context) error {
+	ctx := context.Request().Context()
+	forum, err := handler.Store.ForumGetOne(ctx, context.Param("slug"))
+	if err != nil {
+		return err
 	}
 
 	return context.JSON(http.StatusOK, forum)
 }
 
-func ForumGetThreads(context echo.Context) error {
-	limit := context.QueryParam("limit")
-	if limit == "" {
-		limit = "NULL"
+func (handler *Handler) ForumUpdate(context echo.Context) error {
+	ctx := context.Request().Context()
+	forum, err := handler.Store.ForumGetOne(ctx, context.Param("slug"))
+	if err != nil {
+		return err
+	}
+	if err := handler.authorize(context, forum.ProfileNickname, "", "forum with slug "+forum.Slug); err != nil {
+		return err
 	}
 
-	var forum Forum
-	forum.Slug = context.Param("slug")
-	if err := DBConnection.QueryRow("SELECT forum.slug FROM forum WHERE forum.slug = $1;",
-		forum.Slug).Scan(&forum.Slug); err == sql.ErrNoRows {
-		return context.JSON(http.StatusNotFound, Error{
-			Message: "Can't find forum with slug " + forum.Slug,
-		})
+	updatedForum := forum
+	if err := bindBody(context, &updatedForum); err != nil {
+		return err
 	}
+	updatedForum.Slug = forum.Slug
+
+	if updatedForum, err = handler.Store.ForumUpdate(ctx, updatedForum); err != nil {
+		return err
+	}
+
+	return context.JSON(http.StatusOK, updatedForum)
+}
 
-	var rows *sql.Rows
+func (handler *Handler) ForumDelete(context echo.Context) error {
+	ctx := context.Request().Context()
+	forum, err := handler.Store.ForumGetOne(ctx, context.Param("slug"))
+	if err != nil {
+		return err
+	}
+	if err := handler.authorize(context, forum.ProfileNickname, "", "forum with slug "+forum.Slug); err != nil {
+		return err
+	}
+
+	if err := handler.Store.ForumDelete(ctx, forum.Slug); err != nil {
+		return err
+	}
+
+	return context.NoContent(http.StatusNoContent)
+}
+
+func (handler *Handler) ForumGetThreads(context echo.Context) error {
+	ctx := context.Request().Context()
+	var filter ThreadsFilter
 	var err error
-	since := context.QueryParam("since")
-	if context.QueryParam("desc") != "true" {
-		if since == "" {
-			rows, err = DBConnection.Query("SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.forum_slug = $1 ORDER BY thread.created LIMIT $2;",
-				forum.Slug, limit)
-		} else {
-			rows, err = DBConnection.Query("SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.forum_slug = $1 AND thread.created >= $2 ORDER BY thread.created LIMIT $3;",
-				forum.Slug, since, limit)
-		}
-	} else {
-		if since == "" {
-			rows, err = DBConnection.Query("SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.forum_slug = $1 ORDER BY thread.created DESC LIMIT $2;",
-				forum.Slug, limit)
-		} else {
-			rows, err = DBConnection.Query("SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.forum_slug = $1 AND thread.created <= $2 ORDER BY thread.created DESC LIMIT $3;",
-				forum.Slug, since, limit)
+	if filter.Limit, err = queryLimit(context, 0); err != nil {
+		return err
+	}
+	if since := context.QueryParam("since"); since != "" {
+		created, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return Validation("Invalid since " + since)
 		}
+		filter.Since = &created
+	}
+	filter.Desc = context.QueryParam("desc") == "true"
+	filter.Archived = context.QueryParam("archived") == "true"
+	if filter.Cursor, err = queryCursor(context, "threads", filter.Desc); err != nil {
+		return err
 	}
+
+	threads, err := handler.Store.ForumGetThreads(ctx, context.Param("slug"), filter)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			panic(err)
+	pinned := 0
+	for _, thread := range threads {
+		if thread.Pinned {
+			pinned++
 		}
-	}()
+	}
+	if filter.Limit > 0 && len(threads)-pinned == filter.Limit { //закреплённые ветки не входят в limit
+		last := threads[len(threads)-1]
+		setNextCursor(context, Cursor{List: "threads", Desc: filter.Desc, Created: &last.Created, Id: uint64(last.Id)})
+	}
 
-	var threads = make([]Thread, 0)
-	for rows.Next() {
-		var thread Thread
-		var threadSlug sql.NullString
-		if err := rows.Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.Message, &threadSlug,
-			&thread.Title, &thread.Votes); err != nil {
-			panic(err)
-		}
+	return context.JSON(http.StatusOK, threads)
+}
 
-		if threadSlug.Valid {
-			thread.Slug = threadSlug.String
-		}
-		thread.ForumSlug = forum.Slug
+func (handler *Handler) ForumGetUsers(context echo.Context) error {
+	ctx := context.Request().Context()
+	var filter UsersFilter
+	var err error
+	if filter.Limit, err = queryLimit(context, 100); err != nil {
+		return err
+	}
+	filter.Since = context.QueryParam("since")
+	filter.Desc = context.QueryParam("desc") == "true"
+	if filter.Cursor, err = queryCursor(context, "users", filter.Desc); err != nil {
+		return err
+	}
 
-		threads = append(threads, thread)
+	profiles, err := handler.Store.ForumGetUsers(ctx, context.Param("slug"), filter)
+	if err != nil {
+		return err
+	}
+	if filter.Limit > 0 && len(profiles) == filter.Limit {
+		setNextCursor(context, Cursor{List: "users", Desc: filter.Desc, Nickname: profiles[len(profiles)-1].Nickname})
 	}
 
-	return context.JSON(http.StatusOK, threads)
+	return context.JSON(http.StatusOK, profiles)
 }
 
-func ForumGetUsers(context echo.Context) error {
-	limit := context.QueryParam("limit")
-	if limit == "" {
-		limit = "100"
+func (handler *Handler) ForumGetModerators(context echo.Context) error {
+	ctx := context.Request().Context()
+	roles, err := handler.Store.ForumGetModerators(ctx, context.Param("slug"))
+	if err != nil {
+		return err
 	}
 
-	var forum Forum
-	forum.Slug = context.Param("slug")
-	if err := DBConnection.QueryRow("SELECT forum.slug FROM forum WHERE forum.slug = $1;",
-		forum.Slug).Scan(&forum.Slug); err == sql.ErrNoRows {
-		return context.JSON(http.StatusNotFound, Error{
-			Message: "Can't find forum with slug " + forum.Slug,
-		})
+	return context.JSON(http.StatusOK, roles)
+}
+
+func (handler *Handler) ForumGetRole(context echo.Context) error {
+	ctx := context.Request().Context()
+	profile, err := handler.Store.UserGetOne(ctx, context.Param("nickname"))
+	if err != nil {
+		return err
+	}
+	role, err := handler.Store.ForumGetRole(ctx, context.Param("slug"), profile.Nickname)
+	if err != nil {
+		return err
 	}
 
-	var profiles = make([]Profile, 0)
-	var rows *sql.Rows
+	return context.JSON(http.StatusOK, ForumRole{Nickname: profile.Nickname, Role: role})
+}
+
+func moderationEntry(session *Session, forumSlug, action, target string, moderation Moderation) ModerationEntry {
+	return ModerationEntry{Forum: forumSlug, Moderator: session.ProfileNickname, Action: action, Target: target,
+		Reason: moderation.Reason}
+}
+
+// Форум и пользователь из параметров :slug и :nickname для действий модерации над пользователем.
+func (handler *Handler) moderatedUser(context echo.Context, role string) (*Session, Forum, Profile, Moderation, error) {
+	ctx := context.Request().Context()
+	var moderation Moderation
+	forum, err := handler.Store.ForumGetOne(ctx, context.Param("slug"))
+	if err != nil {
+		return nil, forum, Profile{}, moderation, err
+	}
+	session, err := handler.requireRole(context, forum.Slug, role)
+	if err != nil {
+		return nil, forum, Profile{}, moderation, err
+	}
+	profile, err := handler.Store.UserGetOne(ctx, context.Param("nickname"))
+	if err != nil {
+		return nil, forum, profile, moderation, err
+	}
+	if err := bindBody(context, &moderation); err != nil {
+		return nil, forum, profile, moderation, err
+	}
+	return session, forum, profile, moderation, nil
+}
+
+func (handler *Handler) ForumModeratorCreate(context echo.Context) error {
+	ctx := context.Request().Context()
+	session, forum, profile, moderation, err := handler.moderatedUser(context, "owner")
+	if err != nil {
+		return err
+	}
+
+	role, err := handler.Store.ForumModeratorCreate(ctx, forum.Slug, profile.Nickname,
+		moderationEntry(session, forum.Slug, "grant_moderator", "user "+profile.Nickname, moderation))
+	if err != nil {
+		return err
+	}
+
+	return context.JSON(http.StatusOK, role)
+}
+
+func (handler *Handler) ForumModeratorDelete(context echo.Context) error {
+	ctx := context.Request().Context()
+	session, forum, profile, moderation, err := handler.moderatedUser(context, "owner")
+	if err != nil {
+		return err
+	}
+
+	if err := handler.Store.ForumModeratorDelete(ctx, forum.Slug, profile.Nickname,
+		moderationEntry(session, forum.Slug, "revoke_moderator", "user "+profile.Nickname, moderation)); err != nil {
+		return err
+	}
+
+	return context.NoContent(http.StatusNoContent)
+}
+
+// Владельца и модераторов забанить нельзя: модератора сначала нужно снять.
+func (handler *Handler) ForumBanCreate(context echo.Context) error {
+	ctx := context.Request().Context()
+	session, forum, profile, moderation, err := handler.moderatedUser(context, "moderator")
+	if err != nil {
+		return err
+	}
+	role, err := handler.Store.ForumGetRole(ctx, forum.Slug, profile.Nickname)
+	if err != nil {
+		return err
+	}
+	if role != "member" {
+		return Forbidden("Can't ban " + role + " " + profile.Nickname + " of forum " + forum.Slug)
+	}
+	expires, err := banExpires(moderation)
+	if err != nil {
+		return err
+	}
+
+	ban := ForumBan{Forum: forum.Slug, Nickname: profile.Nickname, Moderator: session.ProfileNickname,
+		Reason: moderation.Reason, Expires: moderation.Expires}
+	entry := moderationEntry(session, forum.Slug, "ban", "user "+profile.Nickname, moderation)
+	entry.Details = expires
+	if ban, err = handler.Store.ForumBanCreate(ctx, ban, entry); err != nil {
+		return err
+	}
+
+	return context.JSON(http.StatusOK, ban)
+}
+
+func (handler *Handler) ForumBanDelete(context echo.Context) error {
+	ctx := context.Request().Context()
+	session, forum, profile, moderation, err := handler.moderatedUser(context, "moderator")
+	if err != nil {
+		return err
+	}
+
+	if err := handler.Store.ForumBanDelete(ctx, forum.Slug, profile.Nickname,
+		moderationEntry(session, forum.Slug, "unban", "user "+profile.Nickname, moderation)); err != nil {
+		return err
+	}
+
+	return context.NoContent(http.StatusNoContent)
+}
+
+func (handler *Handler) ForumGetBans(context echo.Context) error {
+	ctx := context.Request().Context()
+	forum, err := handler.Store.ForumGetOne(ctx, context.Param("slug"))
+	if err != nil {
+		return err
+	}
+	if _, err := handler.requireRole(context, forum.Slug, "moderator"); err != nil {
+		return err
+	}
+
+	bans, err := handler.Store.ForumGetBans(ctx, forum.Slug)
+	if err != nil {
+		return err
+	}
+
+	return context.JSON(http.StatusOK, bans)
+}
+
+// Заблокированные на всём сайте и забаненные в форуме пользователи не могут создавать ветки и посты
+// и голосовать; 403 с причиной первого найденного бана.
+func (handler *Handler) checkBans(ctx context.Context, forumSlug string, nicknames []string) error {
+	bans, err := handler.Store.UserGetBans(ctx, forumSlug, nicknames)
+	if err != nil {
+		return err
+	}
+	if len(bans) > 0 {
+		return errForumBanned(bans[0])
+	}
+	return nil
+}
+
+// Срок бана или блокировки, если он указан, должен быть в будущем.
+func banExpires(moderation Moderation) (string, error) {
+	if moderation.Expires == nil {
+		return "", nil
+	}
+	if !moderation.Expires.After(time.Now()) {
+		return "", Validation("Invalid expires: must be in the future")
+	}
+	return "until " + moderation.Expires.UTC().Format(time.RFC3339), nil
+}
+
+func (handler *Handler) ForumGetLog(context echo.Context) error {
+	ctx := context.Request().Context()
+	var filter ModerationFilter
 	var err error
-	since := context.QueryParam("since")
-	if context.QueryParam("desc") != "true" {
-		if since == "" {
-			rows, err = DBConnection.Query("SELECT forum_user.profile_nickname, forum_user.profile_about, forum_user.profile_email, forum_user.profile_fullname FROM forum_user WHERE forum_user.forum_slug = $1 ORDER BY forum_user.profile_nickname LIMIT $2;",
-				forum.Slug, limit)
-		} else {
-			rows, err = DBConnection.Query("SELECT forum_user.profile_nickname, forum_user.profile_about, forum_user.profile_email, forum_user.profile_fullname FROM forum_user WHERE forum_user.forum_slug = $1 AND forum_user.profile_nickname > $2 ORDER BY forum_user.profile_nickname LIMIT $3;",
-				forum.Slug, since, limit)
-		}
-	} else {
-		if since == "" {
-			rows, err = DBConnection.Query("SELECT forum_user.profile_nickname, forum_user.profile_about, forum_user.profile_email, forum_user.profile_fullname FROM forum_user WHERE forum_user.forum_slug = $1 ORDER BY forum_user.profile_nickname DESC LIMIT $2;",
-				forum.Slug, limit)
-		} else {
-			rows, err = DBConnection.Query("SELECT forum_user.profile_nickname, forum_user.profile_about, forum_user.profile_email, forum_user.profile_fullname FROM forum_user WHERE forum_user.forum_slug = $1 AND forum_user.profile_nickname < $2 ORDER BY forum_user.profile_nickname DESC LIMIT $3;",
-				forum.Slug, since, limit)
+	if filter.Limit, err = queryLimit(context, 100); err != nil {
+		return err
+	}
+	if since := context.QueryParam("since"); since != "" {
+		if filter.Since, err = strconv.ParseUint(since, 10, 64); err != nil {
+			return Validation("Invalid since " + since)
 		}
 	}
+	filter.Desc = context.QueryParam("desc") == "true"
+
+	forum, err := handler.Store.ForumGetOne(ctx, context.Param("slug"))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if _, err := handler.requireRole(context, forum.Slug, "moderator"); err != nil {
+		return err
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			panic(err)
-		}
-	}()
 
-	for rows.Next() {
-		var profile Profile
-		if err := rows.Scan(&profile.Nickname, &profile.About, &profile.Email, &profile.Fullname); err != nil {
-			panic(err)
-		}
-		profiles = append(profiles, profile)
+	entries, err := handler.Store.ForumGetLog(ctx, forum.Slug, filter)
+	if err != nil {
+		return err
 	}
 
-	return context.JSON(http.StatusOK, profiles)
+	return context.JSON(http.StatusOK, entries)
+}
+
+// Текст скрытых постов видят только владелец и модераторы форума.
+func (handler *Handler) hideMessages(context echo.Context, forumSlug string, posts []Post) error {
+	hidden := false
+	for _, post := range posts {
+		hidden = hidden || post.Hidden
+	}
+	if !hidden {
+		return nil
+	}
+	if moderator, err := handler.isModerator(context, forumSlug); err != nil || moderator {
+		return err
+	}
+	for i := range posts {
+		if posts[i].Hidden {
+			posts[i].Message = ""
+		}
+	}
+	return nil
 }
 
-func PostGetOne(context echo.Context) error {
+func (handler *Handler) PostGetOne(context echo.Context) error {
+	ctx := context.Request().Context()
 	var postFull PostFull
-	id := context.Param("id")
-	postFull.Post.Id, _ = strconv.ParseUint(id, 10, 64)
+	id, err := paramPostId(context)
+	if err != nil {
+		return err
+	}
 	var user, forum, thread bool
-	var bitFlag uint8
 	for _, related := range strings.Split(context.QueryParam("related"), ",") {
 		switch related {
 		case "user":
 			user = true
-			bitFlag |= 1
 			break
 		case "forum":
 			forum = true
-			bitFlag |= 2
 		case "thread":
 			thread = true
-			bitFlag |= 4
 			break
 		}
 	}
 
-	/*var parentPostId sql.NullInt64
-	switch bitFlag {
-	case 7: //post + thread + forum + user
-		postFull.Thread = &Thread{}
-		var threadSlug sql.NullString
-		postFull.Forum = &Forum{}
-		postFull.Profile = &Profile{}
-		if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug, thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes FROM post, thread WHERE post.id = $1 AND thread.id = $2;",
-			postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-			&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find post with id " + id,
-			})
-		}
-		if threadSlug.Valid {
-			postFull.Thread.Slug = threadSlug.String
-		}
-		break
-	case 6: //post + thread + forum
-		postFull.Thread = &Thread{}
-		var threadSlug sql.NullString
-		postFull.Forum = &Forum{}
-		if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug, thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes FROM post WHERE post.id = $1;",
-			postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-			&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find post with id " + id,
-			})
-		}
-		if threadSlug.Valid {
-			postFull.Thread.Slug = threadSlug.String
-		}
-		break
-	case 5: //post + thread + user
-		postFull.Thread = &Thread{}
-		var threadSlug sql.NullString
-		postFull.Profile = &Profile{}
-		if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug FROM post WHERE post.id = $1;",
-			postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-			&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find post with id " + id,
-			})
-		}
-		if threadSlug.Valid {
-			postFull.Thread.Slug = threadSlug.String
-		}
-		break
-	case 4: //post + thread
-		postFull.Thread = &Thread{}
-		var threadSlug sql.NullString
-		if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug FROM post WHERE post.id = $1;",
-			postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-			&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find post with id " + id,
-			})
-		}
-		if threadSlug.Valid {
-			postFull.Thread.Slug = threadSlug.String
-		}
-		break
-	case 3: //post + forum + user
-		postFull.Forum = &Forum{}
-		postFull.Profile = &Profile{}
-		if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug FROM post WHERE post.id = $1;",
-			postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-			&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find post with id " + id,
-			})
-		}
-		break
-	case 2: //post + forum
-		postFull.Forum = &Forum{}
-		if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug FROM post WHERE post.id = $1;",
-			postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-			&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find post with id " + id,
-			})
-		}
-		break
-	case 1: //post + user
-		postFull.Profile = &Profile{}
-		if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug FROM post WHERE post.id = $1;",
-			postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-			&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find post with id " + id,
-			})
-		}
-		break
-	default: //post
-		if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug FROM post WHERE post.id = $1;",
-			postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-			&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find post with id " + id,
-			})
-		}
-		break
-	}
-
-	if parentPostId.Valid {
-		postFull.Post.ParentPost = uint64(parentPostId.Int64)
-	}*/
-
-	var parentPostId sql.NullInt64
-	if err := DBConnection.QueryRow("SELECT post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug FROM post WHERE post.id = $1;",
-		postFull.Post.Id).Scan(&postFull.Post.ProfileNickname, &postFull.Post.Created, &postFull.Post.IsEdited,
-		&postFull.Post.Message, &parentPostId, &postFull.Post.ThreadId, &postFull.Post.ForumSlug); err != nil {
-		return context.JSON(http.StatusNotFound, Error{
-			Message: "Can't find post with id " + id,
-		})
+	if postFull.Post, err = handler.Store.PostGetOne(ctx, id); err != nil {
+		return err
 	}
-	if parentPostId.Valid {
-		postFull.Post.ParentPost = uint64(parentPostId.Int64)
+	posts := []Post{postFull.Post}
+	if err := handler.hideMessages(context, postFull.Post.ForumSlug, posts); err != nil {
+		return err
 	}
+	postFull.Post = posts[0]
 
 	if user {
-		postFull.Profile = &Profile{}
-		if err := DBConnection.QueryRow("SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE profile.nickname = $1;", postFull.Post.ProfileNickname).
-			Scan(&postFull.Profile.Nickname, &postFull.Profile.About, &postFull.Profile.Email,
-				&postFull.Profile.Fullname); err != nil {
-			panic(err)
+		relatedProfile, err := handler.Store.UserGetOne(ctx, postFull.Post.ProfileNickname)
+		if err != nil {
+			return err
 		}
+		postFull.Profile = &relatedProfile
 	}
 
 	if forum {
-		postFull.Forum = &Forum{}
-		if err := DBConnection.QueryRow("SELECT forum.slug, forum.title, forum.profile_nickname, forum.threads, forum.posts FROM forum WHERE forum.slug = $1;", postFull.Post.ForumSlug).
-			Scan(&postFull.Forum.Slug, &postFull.Forum.Title, &postFull.Forum.ProfileNickname, &postFull.Forum.Threads,
-				&postFull.Forum.Posts); err != nil {
-			panic(err)
+		relatedForum, err := handler.Store.ForumGetOne(ctx, postFull.Post.ForumSlug)
+		if err != nil {
+			return err
 		}
+		postFull.Forum = &relatedForum
 	}
 
 	if thread {
-		postFull.Thread = &Thread{}
-		var threadSlug sql.NullString
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.id = $1;", postFull.Post.ThreadId).
-			Scan(&postFull.Thread.Id, &postFull.Thread.ProfileNickname, &postFull.Thread.Created,
-				&postFull.Thread.ForumSlug, &postFull.Thread.Message, &threadSlug, &postFull.Thread.Title,
-				&postFull.Thread.Votes); err != nil {
-			panic(err)
-		}
-
-		if threadSlug.Valid {
-			postFull.Thread.Slug = threadSlug.String
+		relatedThread, err := handler.Store.ThreadGetOne(ctx, ThreadKey{Id: postFull.Post.ThreadId})
+		if err != nil {
+			return err
 		}
+		postFull.Thread = &relatedThread
 	}
 
 	return context.JSON(http.StatusOK, postFull)
 }
 
-func PostUpdate(context echo.Context) error { //TODO: тоже можно сократить количество походов в СУБД, но есть ли смысл? это update...
-	var post Post
-	id := context.Param("id")
-	post.Id, _ = strconv.ParseUint(id, 10, 64)
-	if err := DBConnection.QueryRow("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.thread_id, post.forum_slug FROM post WHERE post.id = $1;", post.Id).
-		Scan(&post.Id, &post.ProfileNickname, &post.Created, &post.IsEdited, &post.Message, &post.ThreadId,
-			&post.ForumSlug); err != nil {
-		return context.JSON(http.StatusNotFound, Error{
-			Message: "Can't find post with id " + id,
-		})
+// Посты архивной ветки доступны только для чтения.
+func (handler *Handler) checkPostWritable(ctx context.Context, post Post) error {
+	thread, err := handler.Store.ThreadGetOne(ctx, ThreadKey{Id: post.ThreadId})
+	if err != nil {
+		return err
 	}
+	if thread.Archived {
+		return errThreadArchived(ThreadKey{Id: thread.Id})
+	}
+	return nil
+}
 
-	updatedPost := post
-	if err := context.Bind(&updatedPost); err != nil {
-		panic(err)
+func (handler *Handler) PostUpdate(context echo.Context) error {
+	ctx := context.Request().Context()
+	id, err := paramPostId(context)
+	if err != nil {
+		return err
+	}
+	post, err := handler.Store.PostGetOne(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := handler.authorize(context, post.ProfileNickname, post.ForumSlug, "post with id "+context.Param("id")); err != nil {
+		return err
 	}
 
+	//из тела берётся только текст: id, ветка, форум и автор поста остаются прежними
+	body := post
+	if err := bindBody(context, &body); err != nil {
+		return err
+	}
+	updatedPost := post
+	updatedPost.Message = body.Message
+
+	if post.Deleted != "" {
+		return errPostDeleted(post.Id)
+	}
 	if updatedPost.Message != post.Message {
-		if _, err := DBConnection.Exec("UPDATE post SET message = $1 WHERE id = $2;",
-			updatedPost.Message, updatedPost.Id); err != nil {
-			panic(err)
+		if err := handler.checkPostWritable(ctx, post); err != nil {
+			return err
+		}
+		if err := handler.Store.PostUpdate(ctx, updatedPost, callerNickname(context, post.ProfileNickname)); err != nil {
+			return err
 		}
 		updatedPost.IsEdited = true
 	}
@@ -492,398 +712,869 @@ func PostUpdate(context echo.Context) error { //TODO: тоже можно сок
 	return context.JSON(http.StatusOK, updatedPost)
 }
 
-func ServiceClear(context echo.Context) error {
-	if _, err := DBConnection.Exec("TRUNCATE TABLE profile RESTART IDENTITY CASCADE;"); err != nil {
-		panic(err)
+func (handler *Handler) postRevisions(context echo.Context) ([]PostRevision, error) {
+	ctx := context.Request().Context()
+	id, err := paramPostId(context)
+	if err != nil {
+		return nil, err
 	}
-	return context.JSON(http.StatusOK, nil)
+	post, err := handler.Store.PostGetOne(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	//историю удалённого или скрытого поста видят только модераторы
+	if post.Deleted != "" || post.Hidden {
+		if moderator, err := handler.isModerator(context, post.ForumSlug); err != nil {
+			return nil, err
+		} else if !moderator && post.Deleted != "" {
+			return nil, errPostDeleted(post.Id)
+		} else if !moderator {
+			return nil, errPostHidden(post.Id)
+		}
+	}
+	edits, err := handler.Store.PostHistory(ctx, post.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	//версия i - текст до правки i (автор версии - автор предыдущей правки), последняя - текущий текст
+	revisions := make([]PostRevision, 0, len(edits)+1)
+	author, created := post.ProfileNickname, post.Created
+	for _, edit := range append(edits, PostEdit{Message: post.Message}) {
+		revisions = append(revisions, PostRevision{
+			Revision:        len(revisions) + 1,
+			ProfileNickname: author,
+			Created:         created,
+			Message:         edit.Message,
+		})
+		author, created = edit.ProfileNickname, edit.Edited
+	}
+	return revisions, nil
 }
 
-func ServiceStatus(context echo.Context) error {
-	var status Status
-	if err := DBConnection.QueryRow("SELECT (SELECT COUNT(*) FROM forum), (SELECT COUNT(*) FROM post), (SELECT COUNT(*) FROM thread), (SELECT COUNT(*) FROM profile);").
-		Scan(&status.Forum, &status.Post, &status.Thread, &status.User); err != nil {
-		panic(err)
+func (handler *Handler) PostHistory(context echo.Context) error {
+	revisions, err := handler.postRevisions(context)
+	if err != nil {
+		return err
 	}
 
-	return context.JSON(http.StatusOK, status)
+	return context.JSON(http.StatusOK, revisions)
 }
 
-func PostsCreate(context echo.Context) error {
-	var thread Thread
-	var threadSlug sql.NullString
-	slugOrId := context.Param("slug_or_id")
+func queryRevision(context echo.Context, name string, defaultRevision int, revisions []PostRevision) (int, error) {
+	value := context.QueryParam(name)
+	if value == "" {
+		return defaultRevision, nil
+	}
+	revision, err := strconv.Atoi(value)
+	if err != nil || revision < 1 || revision > len(revisions) {
+		return 0, Validation("Invalid revision " + value)
+	}
+	return revision, nil
+}
 
-	if _, err := strconv.Atoi(slugOrId); err == nil {
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.slug, thread.forum_slug FROM thread WHERE thread.id = $1;",
-			slugOrId).Scan(&thread.Id, &threadSlug, &thread.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find thread with id " + slugOrId,
-			})
-		}
+func (handler *Handler) PostDiff(context echo.Context) error {
+	revisions, err := handler.postRevisions(context)
+	if err != nil {
+		return err
+	}
+	//по умолчанию - последняя правка
+	diff := PostDiff{}
+	if diff.To, err = queryRevision(context, "to", len(revisions), revisions); err != nil {
+		return err
+	}
+	defaultFrom := diff.To - 1
+	if defaultFrom < 1 {
+		defaultFrom = 1
+	}
+	if diff.From, err = queryRevision(context, "from", defaultFrom, revisions); err != nil {
+		return err
+	}
+
+	diff.Changes = Diff(revisions[diff.From-1].Message, revisions[diff.To-1].Message)
+	return context.JSON(http.StatusOK, diff)
+}
+
+// Удаление поста автором.
+func (handler *Handler) PostDelete(context echo.Context) error {
+	ctx := context.Request().Context()
+	id, err := paramPostId(context)
+	if err != nil {
+		return err
+	}
+	post, err := handler.Store.PostGetOne(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := handler.authorize(context, post.ProfileNickname, "", "post with id "+context.Param("id")); err != nil {
+		return err
+	}
+	if err := handler.checkPostWritable(ctx, post); err != nil {
+		return err
+	}
+
+	if post, err = handler.Store.PostDelete(ctx, id, nil); err != nil {
+		return err
+	}
+
+	return context.JSON(http.StatusOK, post)
+}
+
+// Удаление поста модератором форума.
+func (handler *Handler) PostModerate(context echo.Context) error {
+	return handler.postModerate(context, "delete_post")
+}
+
+func (handler *Handler) PostHide(context echo.Context) error {
+	return handler.postModerate(context, "hide_post")
+}
+
+func (handler *Handler) PostUnhide(context echo.Context) error {
+	return handler.postModerate(context, "unhide_post")
+}
+
+func (handler *Handler) postModerate(context echo.Context, action string) error {
+	ctx := context.Request().Context()
+	id, err := paramPostId(context)
+	if err != nil {
+		return err
+	}
+	post, err := handler.Store.PostGetOne(ctx, id)
+	if err != nil {
+		return err
+	}
+	session, err := handler.requireRole(context, post.ForumSlug, "moderator")
+	if err != nil {
+		return err
+	}
+	var moderation Moderation
+	if err := bindBody(context, &moderation); err != nil {
+		return err
+	}
+	if err := handler.checkPostWritable(ctx, post); err != nil {
+		return err
+	}
+
+	entry := moderationEntry(session, post.ForumSlug, action, "post "+strconv.FormatUint(post.Id, 10), moderation)
+	if action == "delete_post" {
+		post, err = handler.Store.PostDelete(ctx, id, &entry)
 	} else {
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.slug, thread.forum_slug FROM thread WHERE thread.slug = $1;",
-			slugOrId).Scan(&thread.Id, &threadSlug, &thread.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find thread with slug " + slugOrId,
-			})
+		post, err = handler.Store.PostHide(ctx, id, action == "hide_post", entry)
+	}
+	if err != nil {
+		return err
+	}
+
+	return context.JSON(http.StatusOK, post)
+}
+
+func (handler *Handler) Search(context echo.Context) error {
+	ctx := context.Request().Context()
+	filter := SearchFilter{Query: strings.TrimSpace(context.QueryParam("q"))}
+	var err error
+	if filter.Query == "" {
+		return Validation("Invalid query")
+	}
+	if filter.Limit, err = queryLimit(context, 100); err != nil {
+		return err
+	}
+	if since := context.QueryParam("since"); since != "" {
+		created, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return Validation("Invalid since " + since)
 		}
+		filter.Since = &created
 	}
+	filter.Desc = context.QueryParam("desc") == "true"
 
-	if threadSlug.Valid {
-		thread.Slug = threadSlug.String
+	if forum := context.QueryParam("forum"); forum != "" {
+		relatedForum, err := handler.Store.ForumGetOne(ctx, forum)
+		if err != nil {
+			return err
+		}
+		filter.Forum = relatedForum.Slug
+	}
+	if author := context.QueryParam("author"); author != "" {
+		relatedProfile, err := handler.Store.UserGetOne(ctx, author)
+		if err != nil {
+			return err
+		}
+		filter.Author = relatedProfile.Nickname
 	}
 
-	var posts []*Post
-	result, err := ioutil.ReadAll(context.Request().Body)
+	results, err := handler.Store.Search(ctx, filter)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = json.Unmarshal(result, &posts) //TODO
-	if err != nil {
-		panic(err)
+	return context.JSON(http.StatusOK, results)
+}
+
+func (handler *Handler) ServiceClear(context echo.Context) error {
+	ctx := context.Request().Context()
+	if err := handler.Store.ServiceClear(ctx); err != nil {
+		return err
 	}
+	return context.JSON(http.StatusOK, nil)
+}
 
-	if len(posts) == 0 {
-		return context.JSON(http.StatusCreated, posts)
+func (handler *Handler) ServiceStatus(context echo.Context) error {
+	ctx := context.Request().Context()
+	status, err := handler.Store.ServiceStatus(ctx)
+	if err != nil {
+		return err
 	}
 
-	location, _ := time.LoadLocation("UTC")
-	now := time.Now().In(location).Round(time.Microsecond)
+	return context.JSON(http.StatusOK, status)
+}
 
-	tx, err := DBConnection.Begin()
-	defer func() {
-		_ = tx.Rollback()
-	}()
+func (handler *Handler) PostsCreate(context echo.Context) error {
+	ctx := context.Request().Context()
+	key := ParseThreadKey(context.Param("slug_or_id"))
+	thread, err := handler.Store.ThreadGetOne(ctx, key)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if thread.Archived {
+		return errThreadArchived(key)
 	}
 
-	statement, err := tx.Prepare("INSERT INTO post (profile_nickname, created, message, post_parent_id, thread_id, forum_slug) SELECT profile.nickname, $2, $3, $4, $5, $6 FROM profile WHERE profile.nickname = $1 RETURNING post.id;")
-	defer func() {
-		if err := statement.Close(); err != nil {
-			panic(err)
-		}
-	}()
+	var posts []*Post
+	result, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		return err
+	}
 
-	for _, post := range posts { //TODO: возможно везде заменить создание массивов/данных в стеке на make... везде так
-		if post.Created.IsZero() {
-			post.Created = now
+	if err := json.Unmarshal(result, &posts); err != nil {
+		return Validation("Invalid request body")
+	}
+	for _, post := range posts {
+		if post == nil {
+			return Validation("Invalid request body: post must be an object")
 		}
+	}
 
-		if err = statement.QueryRow(post.ProfileNickname, post.Created, post.Message, post.ParentPost, thread.Id,
-			thread.ForumSlug).Scan(&post.Id); err != nil {
-			if err == sql.ErrNoRows {
-				return context.JSON(http.StatusNotFound, Error{
-					Message: "Can't find post author by nickname " + post.ProfileNickname,
-				})
-			} else {
-				return context.JSON(http.StatusConflict, Error{
-					Message: "One of parent posts doesn't exists or it was created in another thread",
-				})
-			}
+	if len(posts) == 0 {
+		return context.JSON(http.StatusCreated, posts)
+	}
+	authors := make([]string, 0, 1)
+	for _, post := range posts {
+		post.ProfileNickname = callerNickname(context, post.ProfileNickname)
+		authors = append(authors, post.ProfileNickname)
+	}
+	if thread.Locked {
+		if moderator, err := handler.isModerator(context, thread.ForumSlug); err != nil {
+			return err
+		} else if !moderator {
+			return errThreadLocked(key)
 		}
-
-		post.ThreadId = thread.Id
-		post.ForumSlug = thread.ForumSlug
 	}
-	if err = tx.Commit(); err != nil {
-		panic(err)
+	if err := handler.checkBans(ctx, thread.ForumSlug, authors); err != nil {
+		return err
+	}
+
+	if err := handler.Store.PostsCreate(ctx, thread, posts); err != nil {
+		return err
 	}
 
 	return context.JSON(http.StatusCreated, posts)
 }
 
-func ThreadGetOne(context echo.Context) error {
-	var thread Thread
-	var threadSlug sql.NullString
-	slugOrId := context.Param("slug_or_id")
-	if _, err := strconv.Atoi(slugOrId); err == nil {
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.id = $1;",
-			slugOrId).Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
-			&threadSlug, &thread.Title, &thread.Votes); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find thread with id " + slugOrId,
-			})
-		}
-	} else {
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.slug = $1;",
-			slugOrId).Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
-			&threadSlug, &thread.Title, &thread.Votes); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find thread with slug " + slugOrId,
-			})
-		}
+func (handler *Handler) ThreadGetOne(context echo.Context) error {
+	ctx := context.Request().Context()
+	thread, err := handler.Store.ThreadGetOne(ctx, ParseThreadKey(context.Param("slug_or_id")))
+	if err != nil {
+		return err
 	}
 
-	if threadSlug.Valid {
-		thread.Slug = threadSlug.String
+	return context.JSON(http.StatusOK, thread)
+}
+
+func (handler *Handler) ThreadUpdate(context echo.Context) error {
+	ctx := context.Request().Context()
+	key := ParseThreadKey(context.Param("slug_or_id"))
+	thread, err := handler.Store.ThreadGetOne(ctx, key)
+	if err != nil {
+		return err
+	}
+	if thread.Archived {
+		return errThreadArchived(key)
+	}
+	if err := handler.authorize(context, thread.ProfileNickname, thread.ForumSlug, "thread with "+key.String()); err != nil {
+		return err
+	}
+
+	//из тела берутся только заголовок и текст: id, slug, форум и автор ветки остаются прежними
+	body := thread
+	if err := bindBody(context, &body); err != nil {
+		return err
+	}
+	thread.Message, thread.Title = body.Message, body.Title
+
+	if err := handler.Store.ThreadUpdate(ctx, thread); err != nil {
+		return err
 	}
 
 	return context.JSON(http.StatusOK, thread)
 }
 
-func ThreadUpdate(context echo.Context) error { //TODO: тоже можно сократить количество походов в СУБД, но есть ли смысл? это update...
-	var thread Thread
-	var threadSlug sql.NullString
-	slugOrId := context.Param("slug_or_id")
-	if _, err := strconv.Atoi(slugOrId); err == nil {
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.id = $1;",
-			slugOrId).Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
-			&threadSlug, &thread.Title, &thread.Votes); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find thread with id " + slugOrId,
-			})
+// ?mode=archive (по умолчанию) переносит ветку в архив (не автором - действие модерации), ?mode=delete удаляет её
+// вместе с постами и голосами.
+func (handler *Handler) ThreadDelete(context echo.Context) error {
+	ctx := context.Request().Context()
+	key := ParseThreadKey(context.Param("slug_or_id"))
+	thread, err := handler.Store.ThreadGetOne(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := handler.authorize(context, thread.ProfileNickname, thread.ForumSlug, "thread with "+key.String()); err != nil {
+		return err
+	}
+
+	switch mode := context.QueryParam("mode"); mode {
+	case "", "archive":
+		var entry *ModerationEntry
+		if session := callerSession(context); !strings.EqualFold(session.ProfileNickname, thread.ProfileNickname) {
+			var moderation Moderation
+			if err := bindBody(context, &moderation); err != nil {
+				return err
+			}
+			moderated := moderationEntry(session, thread.ForumSlug, "archive_thread",
+				"thread "+strconv.FormatUint(uint64(thread.Id), 10), moderation)
+			entry = &moderated
+		}
+		thread, err := handler.Store.ThreadArchive(ctx, key, entry)
+		if err != nil {
+			return err
 		}
+		return context.JSON(http.StatusOK, thread)
+	case "delete":
+		if err := handler.Store.ThreadDelete(ctx, key); err != nil {
+			return err
+		}
+		return context.NoContent(http.StatusNoContent)
+	default:
+		return Validation("Invalid mode " + mode)
+	}
+}
+
+func (handler *Handler) ThreadLock(context echo.Context) error {
+	return handler.threadModerate(context, "lock_thread")
+}
+
+func (handler *Handler) ThreadUnlock(context echo.Context) error {
+	return handler.threadModerate(context, "unlock_thread")
+}
+
+func (handler *Handler) ThreadPin(context echo.Context) error {
+	return handler.threadModerate(context, "pin_thread")
+}
+
+func (handler *Handler) ThreadUnpin(context echo.Context) error {
+	return handler.threadModerate(context, "unpin_thread")
+}
+
+// Переносить ветку может модератор и исходного, и нового форума.
+func (handler *Handler) ThreadMove(context echo.Context) error {
+	return handler.threadModerate(context, "move_thread")
+}
+
+func (handler *Handler) threadModerate(context echo.Context, action string) error {
+	ctx := context.Request().Context()
+	key := ParseThreadKey(context.Param("slug_or_id"))
+	thread, err := handler.Store.ThreadGetOne(ctx, key)
+	if err != nil {
+		return err
+	}
+	session, err := handler.requireRole(context, thread.ForumSlug, "moderator")
+	if err != nil {
+		return err
+	}
+	var moderation Moderation
+	if err := bindBody(context, &moderation); err != nil {
+		return err
+	}
+	if thread.Archived {
+		return errThreadArchived(key)
+	}
+
+	entry := moderationEntry(session, thread.ForumSlug, action, "thread "+strconv.FormatUint(uint64(thread.Id), 10),
+		moderation)
+	if action == "lock_thread" || action == "unlock_thread" {
+		thread, err = handler.Store.ThreadLock(ctx, key, action == "lock_thread", entry)
+	} else if action == "pin_thread" || action == "unpin_thread" {
+		thread, err = handler.Store.ThreadPin(ctx, key, action == "pin_thread", entry)
+	} else if moderation.Forum == "" {
+		return Validation("Invalid forum")
 	} else {
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.slug = $1;",
-			slugOrId).Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
-			&threadSlug, &thread.Title, &thread.Votes); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find thread with slug " + slugOrId,
-			})
+		var forum Forum
+		if forum, err = handler.Store.ForumGetOne(ctx, moderation.Forum); err != nil {
+			return err
+		}
+		if _, err = handler.requireRole(context, forum.Slug, "moderator"); err != nil {
+			return err
 		}
+		entry.Details = "forum " + forum.Slug
+		thread, err = handler.Store.ThreadMove(ctx, key, forum.Slug, entry)
+	}
+	if err != nil {
+		return err
 	}
 
-	if threadSlug.Valid {
-		thread.Slug = threadSlug.String
+	return context.JSON(http.StatusOK, thread)
+}
+
+// Неизвестная сортировка постов, как и отсутствующая, - flat.
+func postsSort(sort string) string {
+	if sort != "tree" && sort != "parent_tree" {
+		return "flat"
 	}
+	return sort
+}
 
-	if err := context.Bind(&thread); err != nil {
-		panic(err)
+func (handler *Handler) ThreadGetPosts(context echo.Context) error {
+	ctx := context.Request().Context()
+	var filter PostsFilter
+	var err error
+	if filter.Limit, err = queryLimit(context, 0); err != nil {
+		return err
+	}
+	if since := context.QueryParam("since"); since != "" {
+		if filter.Since, err = strconv.ParseUint(since, 10, 64); err != nil {
+			return Validation("Invalid since " + since)
+		}
+	}
+	filter.Desc = context.QueryParam("desc") == "true"
+	filter.Sort = postsSort(context.QueryParam("sort"))
+	list := filter.Sort
+	if filter.Cursor, err = queryCursor(context, list, filter.Desc); err != nil {
+		return err
 	}
 
-	if _, err := DBConnection.Exec("UPDATE thread SET message = $2, title = $3 WHERE id = $1;",
-		thread.Id, thread.Message, thread.Title); err != nil {
-		panic(err)
+	thread, err := handler.Store.ThreadGetOne(ctx, ParseThreadKey(context.Param("slug_or_id")))
+	if err != nil {
+		return err
 	}
 
-	return context.JSON(http.StatusOK, thread)
+	posts, err := handler.Store.ThreadGetPosts(ctx, thread, filter)
+	if err != nil {
+		return err
+	}
+	if err := handler.hideMessages(context, thread.ForumSlug, posts); err != nil {
+		return err
+	}
+	if cursor, ok := nextPostsCursor(posts, list, filter); ok {
+		setNextCursor(context, cursor)
+	}
+
+	return context.JSON(http.StatusOK, posts)
 }
 
-func ThreadGetPosts(context echo.Context) error {
-	limit := context.QueryParam("limit")
-	if limit == "" {
-		limit = "NULL"
+// Для parent_tree limit ограничивает число корневых постов, курсор - id последнего из них.
+func nextPostsCursor(posts []Post, list string, filter PostsFilter) (Cursor, bool) {
+	cursor := Cursor{List: list, Desc: filter.Desc}
+	if filter.Limit == 0 || len(posts) == 0 {
+		return cursor, false
+	}
+	last := posts[len(posts)-1]
+	switch list {
+	case "tree":
+		cursor.Path = last.Path
+	case "parent_tree":
+		roots := 0
+		for _, post := range posts {
+			if post.ParentPost == 0 {
+				roots++
+				cursor.Id = post.Id
+			}
+		}
+		return cursor, roots == filter.Limit
+	default:
+		cursor.Created, cursor.Id = &last.Created, last.Id
 	}
+	return cursor, len(posts) == filter.Limit
+}
 
-	since := context.QueryParam("since")
+func (handler *Handler) ThreadVote(context echo.Context) error {
+	ctx := context.Request().Context()
+	var vote Vote
+	if err := bindBody(context, &vote); err != nil {
+		return err
+	}
+	if vote.Voice < -1 || vote.Voice > 1 { //0 - отозвать голос
+		return Validation("Invalid voice " + strconv.Itoa(int(vote.Voice)))
+	}
+	vote.ProfileNickname = callerNickname(context, vote.ProfileNickname)
+	key := ParseThreadKey(context.Param("slug_or_id"))
+	if thread, err := handler.Store.ThreadGetOne(ctx, key); err == nil {
+		if err := handler.checkBans(ctx, thread.ForumSlug, []string{vote.ProfileNickname}); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, ErrNotFound) { //несуществующую ветку, как и раньше, не находит ThreadVote
+		return err
+	}
 
-	var desc string
-	if context.QueryParam("desc") == "true" {
-		desc = "DESC"
+	thread, err := handler.Store.ThreadVote(ctx, key, vote)
+	if err != nil {
+		return err
 	}
 
-	var thread Thread
-	slugOrId := context.Param("slug_or_id")
-	if _, err := strconv.Atoi(slugOrId); err == nil {
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.forum_slug FROM thread WHERE thread.id = $1;",
-			slugOrId).Scan(&thread.Id, &thread.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find thread with id " + slugOrId,
-			})
+	return context.JSON(http.StatusOK, thread)
+}
+
+// Server-Sent Events: post и edit передают пост, vote - новый рейтинг ветки. Поток завершается при отключении
+// клиента, остановке сервера или переполнении очереди событий; EventSource переподключается сам.
+func (handler *Handler) ThreadStream(context echo.Context) error {
+	ctx := context.Request().Context()
+	thread, err := handler.Store.ThreadGetOne(ctx, ParseThreadKey(context.Param("slug_or_id")))
+	if err != nil {
+		return err
+	}
+	moderator, err := handler.isModerator(context, thread.ForumSlug)
+	if err != nil {
+		return err
+	}
+	events, err := handler.Store.Subscribe(ctx, thread.Id) //подписка снимается, когда обработчик завершается
+	if err != nil {
+		return err
+	}
+
+	//id событий post - id поста: после переподключения EventSource передаёт последний в Last-Event-ID,
+	//и пропущенные посты отправляются заново вместе с текущим рейтингом ветки
+	var missed []ThreadEvent
+	replayed := make(map[uint64]struct{}) //подписка оформлена раньше, и эти посты могут прийти и из неё
+	if lastEventId := context.Request().Header.Get("Last-Event-ID"); lastEventId != "" {
+		lastPostId, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			return Validation("Invalid Last-Event-ID " + lastEventId)
 		}
-	} else {
-		if err := DBConnection.QueryRow("SELECT thread.id, thread.forum_slug FROM thread WHERE thread.slug = $1;",
-			slugOrId).Scan(&thread.Id, &thread.ForumSlug); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find thread with slug " + slugOrId,
-			})
+		posts, err := handler.Store.ThreadGetPosts(ctx, thread, PostsFilter{Since: lastPostId, Sort: "flat"})
+		if err != nil {
+			return err
 		}
+		for _, post := range posts {
+			missed = append(missed, ThreadEvent{Type: "post", Post: post})
+			replayed[post.Id] = struct{}{}
+		}
+		current, err := handler.Store.ThreadGetOne(ctx, ThreadKey{Id: thread.Id}) //рейтинг - после подписки
+		if err != nil {
+			return err
+		}
+		missed = append(missed, ThreadEvent{Type: "vote", Votes: current.Votes})
 	}
 
-	var rows *sql.Rows
-	var err error
-	switch context.QueryParam("sort") { //TODO: заменить " на `
-	case "tree":
-		if since == "" {
-			rows, err = DBConnection.Query(fmt.Sprintf("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.thread_id = $1 ORDER BY post.path_ %s, post.created, post.id LIMIT $2;", desc),
-				thread.Id, limit)
-		} else {
-			if desc == "" {
-				rows, err = DBConnection.Query("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.thread_id = $1 AND post.path_ > (SELECT post.path_ FROM post WHERE post.id = $2) ORDER BY post.path_, post.created, post.id LIMIT $3;",
-					thread.Id, since, limit)
-			} else {
-				rows, err = DBConnection.Query("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.thread_id = $1 AND post.path_ < (SELECT post.path_ FROM post WHERE post.id = $2) ORDER BY post.path_ DESC, post.created, post.id LIMIT $3;",
-					thread.Id, since, limit)
-			}
+	//server.write_timeout оборвал бы поток на первой записи после дедлайна
+	if conn, ok := requestConn(ctx); ok {
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			return err
 		}
-		break
-	case "parent_tree":
-		if since == "" {
-			rows, err = DBConnection.Query(fmt.Sprintf("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.post_root_id IN (SELECT post.id FROM post WHERE post.post_parent_id IS NULL AND post.thread_id = $1 ORDER BY post.id %s LIMIT $2) ORDER BY post.post_root_id %s, post.path_, post.created, post.id;", desc, desc),
-				thread.Id, limit)
-		} else {
-			if desc == "" {
-				rows, err = DBConnection.Query("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.post_root_id IN (SELECT post.id FROM post WHERE post.post_parent_id IS NULL AND post.thread_id = $1 AND post.post_root_id > (SELECT post.post_root_id FROM post WHERE post.id = $2) ORDER BY post.id LIMIT $3) ORDER BY post.post_root_id, post.path_, post.created, post.id;",
-					thread.Id, since, limit)
-			} else {
-				rows, err = DBConnection.Query("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.post_root_id IN (SELECT post.id FROM post WHERE post.post_parent_id IS NULL AND post.thread_id = $1 AND post.post_root_id < (SELECT post.post_root_id FROM post WHERE post.id = $2) ORDER BY post.id DESC LIMIT $3) ORDER BY post.post_root_id DESC, post.path_, post.created, post.id;",
-					thread.Id, since, limit)
-			}
+	}
+	response := context.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+	message := "retry: 1000\n\n"
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		if _, err := io.WriteString(response, message); err != nil {
+			return nil
 		}
-		break
-	default: //flat
-		if since == "" {
-			rows, err = DBConnection.Query(fmt.Sprintf("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.thread_id = $1 ORDER BY post.created %s, post.id %s LIMIT $2;", desc, desc),
-				thread.Id, limit)
+		response.Flush()
+
+		var event ThreadEvent
+		if len(missed) > 0 {
+			event, missed = missed[0], missed[1:]
 		} else {
-			if desc == "" {
-				rows, err = DBConnection.Query("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.thread_id = $1 AND post.id > $2 ORDER BY post.created, post.id LIMIT $3;",
-					thread.Id, since, limit)
-			} else {
-				rows, err = DBConnection.Query("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id FROM post WHERE post.thread_id = $1 AND post.id < $2 ORDER BY post.created DESC, post.id DESC LIMIT $3;",
-					thread.Id, since, limit)
+			select {
+			case received, ok := <-events:
+				if !ok {
+					return nil
+				}
+				if _, ok := replayed[received.Post.Id]; ok && received.Type == "post" {
+					message = ""
+					continue
+				}
+				event = received
+			case <-keepAlive.C:
+				message = ": keep-alive\n\n"
+				continue
+			case <-ctx.Done():
+				return nil
+			case <-handler.streams.Done():
+				return nil
 			}
 		}
-		break
+		if message, err = streamMessage(thread.Id, event, moderator); err != nil {
+			return err
+		}
 	}
-	if err != nil {
-		panic(err)
+}
+
+func streamMessage(threadId uint32, event ThreadEvent, moderator bool) (string, error) {
+	if event.Type == "vote" {
+		data, err := json.Marshal(ThreadVotes{Thread: threadId, Votes: event.Votes})
+		return "event: vote\ndata: " + string(data) + "\n\n", err
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			panic(err)
-		}
-	}()
+	if event.Type == "archive" {
+		return "event: archive\ndata: {\"thread\":" + strconv.FormatUint(uint64(threadId), 10) + "}\n\n", nil
+	}
+	id := ""
+	if event.Type == "post" {
+		id = "id: " + strconv.FormatUint(event.Post.Id, 10) + "\n"
+	}
+	if event.Post.Hidden && !moderator {
+		event.Post.Message = ""
+	}
+	data, err := json.Marshal(event.Post)
+	return id + "event: " + event.Type + "\ndata: " + string(data) + "\n\n", err
+}
 
-	var posts = make([]Post, 0)
-	for rows.Next() {
-		var post Post
-		var parentPostId sql.NullInt64
-		if err := rows.Scan(&post.Id, &post.ProfileNickname, &post.Created, &post.IsEdited, &post.Message,
-			&parentPostId); err != nil {
-			panic(err)
+// Необязательное поле password сразу задаёт пароль для входа.
+func (handler *Handler) UserCreate(context echo.Context) error {
+	ctx := context.Request().Context()
+	var body struct {
+		Profile
+		Password string `json:"password"`
+	}
+	if err := bindBody(context, &body); err != nil {
+		return err
+	}
+	profile := body.Profile
+	profile.Nickname = context.Param("nickname")
+	//статический маршрут /api/user/search важнее /api/user/:nickname: такого пользователя нельзя было бы удалить
+	if strings.EqualFold(profile.Nickname, "search") {
+		return Validation("Nickname " + profile.Nickname + " is reserved")
+	}
+	//администраторы заданы никнеймами: освободившийся никнейм администратора (после обезличивания или удаления)
+	//может занять только другой администратор
+	if handler.Auth.isAdmin(profile.Nickname) {
+		if session := callerSession(context); session == nil || !handler.Auth.isAdmin(session.ProfileNickname) {
+			return Forbidden("Nickname " + profile.Nickname + " is reserved for an administrator")
 		}
-		if parentPostId.Valid {
-			post.ParentPost = uint64(parentPostId.Int64)
+	}
+	var passwordHash string
+	if body.Password != "" {
+		var err error
+		if passwordHash, err = hashPassword(body.Password); err != nil {
+			return err
 		}
+	}
 
-		post.ForumSlug = thread.ForumSlug
-		post.ThreadId = thread.Id
+	existingProfiles, err := handler.Store.UserCreate(ctx, profile, passwordHash)
+	if err == ErrConflict {
+		return context.JSON(http.StatusConflict, existingProfiles)
+	} else if err != nil {
+		return err
+	}
 
-		posts = append(posts, post)
+	return context.JSON(http.StatusCreated, profile)
+}
+
+func (handler *Handler) UserGetOne(context echo.Context) error {
+	ctx := context.Request().Context()
+	profile, err := handler.Store.UserGetOne(ctx, context.Param("nickname"))
+	if err != nil {
+		return err
 	}
 
-	return context.JSON(http.StatusOK, posts)
+	return context.JSON(http.StatusOK, profile)
 }
 
-func ThreadVote(context echo.Context) error {
-	var vote Vote
-	if err := context.Bind(&vote); err != nil {
-		panic(err)
+func (handler *Handler) UserUpdate(context echo.Context) error {
+	ctx := context.Request().Context()
+	profile, err := handler.Store.UserGetOne(ctx, context.Param("nickname"))
+	if err != nil {
+		return err
+	}
+	if err := handler.authorize(context, profile.Nickname, "", "user "+profile.Nickname); err != nil {
+		return err
 	}
 
-	var thread Thread
-	slugOrId := context.Param("slug_or_id")
-	if _, err := strconv.Atoi(slugOrId); err == nil { //TODO: тут какая-то хрень, если делать Exec
-		if err := DBConnection.QueryRow("INSERT INTO vote (profile_id, thread_id, voice) SELECT profile.id, thread.id, $3 FROM profile, thread WHERE profile.nickname = $1 AND thread.id = $2 ON CONFLICT (profile_id, thread_id) DO UPDATE SET voice = $3 RETURNING vote.thread_id;",
-			vote.ProfileNickname, slugOrId, vote.Voice).Scan(&vote.ThreadId); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find user by nickname " + vote.ProfileNickname + " or thread by id " + slugOrId,
-			})
-		}
-	} else {
-		if err = DBConnection.QueryRow("INSERT INTO vote (profile_id, thread_id, voice) SELECT profile.id, thread.id, $3 FROM profile, thread WHERE profile.nickname = $1 AND thread.slug = $2 ON CONFLICT (profile_id, thread_id) DO UPDATE SET voice = $3 RETURNING vote.thread_id;",
-			vote.ProfileNickname, slugOrId, vote.Voice).Scan(&vote.ThreadId); err != nil {
-			return context.JSON(http.StatusNotFound, Error{
-				Message: "Can't find user by nickname " + vote.ProfileNickname + " or thread by slug " + slugOrId,
-			})
-		}
+	updatedProfile := profile
+	if err := bindBody(context, &updatedProfile); err != nil {
+		return err
 	}
+	updatedProfile.Nickname = profile.Nickname
 
-	var threadSlug sql.NullString
-	if err := DBConnection.QueryRow("SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes FROM thread WHERE thread.id = $1;",
-		vote.ThreadId).Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
-		&threadSlug, &thread.Title, &thread.Votes); err != nil {
-		panic(err)
+	if err := handler.Store.UserUpdate(ctx, updatedProfile); err != nil {
+		return err
 	}
 
-	if threadSlug.Valid {
-		thread.Slug = threadSlug.String
+	return context.JSON(http.StatusOK, updatedProfile)
+}
+
+func (handler *Handler) UserSearch(context echo.Context) error {
+	ctx := context.Request().Context()
+	query := strings.TrimSpace(context.QueryParam("q"))
+	if query == "" {
+		return Validation("Invalid query")
 	}
+	var filter UsersFilter
+	var err error
+	if filter.Limit, err = queryLimit(context, 100); err != nil {
+		return err
+	}
+	filter.Since = context.QueryParam("since")
+	filter.Desc = context.QueryParam("desc") == "true"
 
-	return context.JSON(http.StatusOK, thread)
+	profiles, err := handler.Store.UserSearch(ctx, query, filter)
+	if err != nil {
+		return err
+	}
+
+	return context.JSON(http.StatusOK, profiles)
 }
 
-func UserCreate(context echo.Context) error {
-	var profile Profile
-	if err := context.Bind(&profile); err != nil {
-		panic(err)
+// Пароль меняет сам пользователь; первый пароль пользователю без пароля задаёт администратор (остальные
+// задают его при регистрации). Все сессии пользователя после этого отзываются.
+func (handler *Handler) UserPassword(context echo.Context) error {
+	ctx := context.Request().Context()
+	session := callerSession(context)
+	if session == nil {
+		return Unauthorized("Authentication required")
+	}
+	var body struct {
+		Credentials
+		OldPassword string `json:"oldPassword"`
+	}
+	if err := bindBody(context, &body); err != nil {
+		return err
+	}
+	profile, passwordHash, err := handler.Store.UserGetPassword(ctx, context.Param("nickname"))
+	if err != nil {
+		return err
+	}
+	if passwordHash == "" && !handler.Auth.isAdmin(session.ProfileNickname) {
+		return Forbidden("User " + session.ProfileNickname + " is not an administrator")
+	} else if passwordHash != "" && session.ProfileId != profile.Id {
+		return Forbidden("Can't change password of user " + profile.Nickname)
+	} else if passwordHash != "" && !checkPassword(passwordHash, body.OldPassword) {
+		//украденного токена недостаточно, чтобы сменить пароль и отозвать сессии владельца
+		return Forbidden("Invalid old password")
 	}
-	profile.Nickname = context.Param("nickname")
 
-	_, err := DBConnection.Exec("INSERT INTO profile (nickname, about, email, fullname) VALUES ($1, $2, $3, $4);",
-		profile.Nickname, profile.About, profile.Email, profile.Fullname)
-	if err == nil {
-		return context.JSON(http.StatusCreated, profile)
+	if passwordHash, err = hashPassword(body.Password); err != nil {
+		return err
+	}
+	if err := handler.Store.UserSetPassword(ctx, profile.Nickname, passwordHash); err != nil {
+		return err
 	}
 
-	rows, err := DBConnection.Query("SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE profile.nickname = $1 OR profile.email = $2;",
-		profile.Nickname, profile.Email)
+	return context.NoContent(http.StatusNoContent)
+}
+
+// Администратора заблокировать нельзя: его сначала нужно убрать из auth.admins.
+func (handler *Handler) UserSuspend(context echo.Context) error {
+	ctx := context.Request().Context()
+	session, err := handler.requireAdmin(context)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	profile, err := handler.Store.UserGetOne(ctx, context.Param("nickname"))
+	if err != nil {
+		return err
+	}
+	if handler.Auth.isAdmin(profile.Nickname) {
+		return Forbidden("Can't suspend administrator " + profile.Nickname)
+	}
+	var moderation Moderation
+	if err := bindBody(context, &moderation); err != nil {
+		return err
+	}
+	if _, err := banExpires(moderation); err != nil {
+		return err
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			panic(err)
-		}
-	}()
 
-	var existingProfiles []Profile
-	for rows.Next() {
-		var existingProfile Profile
-		if err := rows.Scan(&existingProfile.Nickname, &existingProfile.About, &existingProfile.Email,
-			&existingProfile.Fullname); err != nil {
-			panic(err)
-		}
-		existingProfiles = append(existingProfiles, existingProfile)
+	suspension, err := handler.Store.SuspensionCreate(ctx, ForumBan{Nickname: profile.Nickname,
+		Moderator: session.ProfileNickname, Reason: moderation.Reason, Expires: moderation.Expires})
+	if err != nil {
+		return err
 	}
 
-	return context.JSON(http.StatusConflict, existingProfiles)
+	return context.JSON(http.StatusOK, suspension)
 }
 
-func UserGetOne(context echo.Context) error {
-	var profile Profile
-	if err := DBConnection.QueryRow("SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE profile.nickname = $1;",
-		context.Param("nickname")).Scan(&profile.Nickname, &profile.About, &profile.Email,
-		&profile.Fullname); err == sql.ErrNoRows {
-		return context.JSON(http.StatusNotFound, Error{
-			Message: "Can't find user with nickname " + profile.Nickname,
-		})
+func (handler *Handler) UserUnsuspend(context echo.Context) error {
+	ctx := context.Request().Context()
+	if _, err := handler.requireAdmin(context); err != nil {
+		return err
 	}
 
-	return context.JSON(http.StatusOK, profile)
+	if err := handler.Store.SuspensionDelete(ctx, context.Param("nickname")); err != nil {
+		return err
+	}
+
+	return context.NoContent(http.StatusNoContent)
 }
 
-func UserUpdate(context echo.Context) error { //TODO: тоже можно сократить количество походов в СУБД, но есть ли смысл? это update...
-	var profile Profile
-	profile.Nickname = context.Param("nickname")
-	if err := DBConnection.QueryRow("SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE profile.nickname = $1;",
-		profile.Nickname).Scan(&profile.Nickname, &profile.About, &profile.Email, &profile.Fullname); err == sql.ErrNoRows {
-		return context.JSON(http.StatusNotFound, Error{
-			Message: "Can't find user with nickname " + profile.Nickname,
-		})
+func (handler *Handler) SuspensionGetAll(context echo.Context) error {
+	ctx := context.Request().Context()
+	if _, err := handler.requireAdmin(context); err != nil {
+		return err
 	}
 
-	updatedProfile := profile
-	if err := context.Bind(&updatedProfile); err != nil {
-		panic(err)
+	suspensions, err := handler.Store.SuspensionGetAll(ctx)
+	if err != nil {
+		return err
 	}
 
-	err := DBConnection.QueryRow("SELECT profile.nickname FROM profile WHERE profile.email = $1 AND profile.nickname != $2;",
-		updatedProfile.Email, profile.Nickname).Scan(&updatedProfile.Nickname)
-	if err != sql.ErrNoRows {
-		return context.JSON(http.StatusConflict, Error{
-			Message: "This email is already registered by user " + updatedProfile.Nickname,
-		})
+	return context.JSON(http.StatusOK, suspensions)
+}
+
+func (handler *Handler) AuthLogin(context echo.Context) error {
+	ctx := context.Request().Context()
+	var credentials Credentials
+	if err := bindBody(context, &credentials); err != nil {
+		return err
 	}
 
-	if _, err := DBConnection.Exec("UPDATE profile SET about = $2, email = $3, fullname = $4 WHERE nickname = $1;",
-		updatedProfile.Nickname, updatedProfile.About, updatedProfile.Email, updatedProfile.Fullname); err != nil {
-		panic(err)
+	session, token, err := handler.Auth.Login(ctx, credentials.Nickname, credentials.Password)
+	if err != nil {
+		return err
 	}
 
-	return context.JSON(http.StatusOK, updatedProfile)
+	return context.JSON(http.StatusOK, Token{Token: token, Expires: session.Expires})
+}
+
+func (handler *Handler) AuthLogout(context echo.Context) error {
+	ctx := context.Request().Context()
+	session := callerSession(context)
+	if session == nil {
+		return Unauthorized("Authentication required")
+	}
+	if err := handler.Store.SessionDelete(ctx, session.Id); err != nil {
+		return err
+	}
+
+	return context.NoContent(http.StatusNoContent)
+}
+
+// ?mode=anonymize (по умолчанию) заменяет никнейм на deleted-<id> и стирает личные данные, сохраняя ветки и посты;
+// ?mode=purge удаляет пользователя вместе со всем, что он создал, кроме того, на чём держатся посты других
+// пользователей.
+func (handler *Handler) UserDelete(context echo.Context) error {
+	ctx := context.Request().Context()
+	nickname := context.Param("nickname")
+	if err := handler.authorize(context, nickname, "", "user "+nickname); err != nil {
+		return err
+	}
+
+	switch mode := context.QueryParam("mode"); mode {
+	case "", "anonymize":
+		profile, err := handler.Store.UserAnonymize(ctx, nickname)
+		if err != nil {
+			return err
+		}
+		return context.JSON(http.StatusOK, profile)
+	case "purge":
+		if err := handler.Store.UserDelete(ctx, nickname); err != nil {
+			return err
+		}
+		return context.NoContent(http.StatusNoContent)
+	default:
+		return Validation("Invalid mode " + mode)
+	}
 }
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Форум f1 пользователя alice с веткой th1 (id 1) и постом 1 пользователя bob, форум f2 пользователя zed
+// с веткой th2 (id 2) и постом 2 пользователя zed.
+func newTestHandler(t *testing.T, admins ...string) *Handler {
+	t.Helper()
+	ctx := context.Background()
+	store := NewMemoryStore()
+	for _, nickname := range []string{"alice", "bob", "zed"} {
+		if _, err := store.UserCreate(ctx, Profile{Nickname: nickname, Email: nickname + "@example.com"}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, forum := range []Forum{{Slug: "f1", ProfileNickname: "alice"}, {Slug: "f2", ProfileNickname: "zed"}} {
+		if _, err := store.ForumCreate(ctx, forum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, thread := range []Thread{
+		{ForumSlug: "f1", Slug: "th1", ProfileNickname: "bob", Title: "t1", Message: "m1", Created: created},
+		{ForumSlug: "f2", Slug: "th2", ProfileNickname: "zed", Title: "t2", Message: "m2", Created: created},
+	} {
+		thread, err := store.ThreadCreate(ctx, thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+		post := &Post{ProfileNickname: thread.ProfileNickname, Message: "p" + thread.Slug, Created: created}
+		if err := store.PostsCreate(ctx, thread, []*Post{post}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	auth, err := NewAuth(store, AuthConfig{Secret: "secret", TokenTTL: time.Hour, Admins: admins})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHandler(store, auth)
+}
+
+// Вызывает обработчик как маршрутизатор echo: params - пары имя, значение параметров пути; nickname - владелец
+// сессии ("" - запрос без токена). Ошибки обработчика превращаются в ответ HTTPErrorHandler.
+func testRequest(t *testing.T, handler *Handler, handle echo.HandlerFunc, method, target, body, nickname string,
+	params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	recorder := httptest.NewRecorder()
+	context := echo.New().NewContext(request, recorder)
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names, values = append(names, params[i]), append(values, params[i+1])
+	}
+	context.SetParamNames(names...)
+	context.SetParamValues(values...)
+	if nickname != "" {
+		profile, err := handler.Store.UserGetOne(request.Context(), nickname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		context.Set("session", &Session{ProfileId: profile.Id, ProfileNickname: profile.Nickname})
+	}
+	if err := handle(context); err != nil {
+		HTTPErrorHandler(err, context)
+	}
+	return recorder
+}
+
+func TestUpdateIgnoresBodyIds(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestHandler(t)
+
+	response := testRequest(t, handler, handler.PostUpdate, http.MethodPost, "/api/post/1/details",
+		`{"id":2,"thread":2,"forum":"f2","author":"zed","message":"edited"}`, "bob", "id", "1")
+	if response.Code != http.StatusOK {
+		t.Fatalf("PostUpdate: status %d, body %s", response.Code, response.Body)
+	}
+	if post, err := handler.Store.PostGetOne(ctx, 1); err != nil || post.Message != "edited" {
+		t.Errorf("post 1: %+v, %v", post, err)
+	}
+	if post, err := handler.Store.PostGetOne(ctx, 2); err != nil || post.Message != "pth2" {
+		t.Errorf("post 2 changed through body id: %+v, %v", post, err)
+	}
+	if !strings.Contains(response.Body.String(), `"id":1,"author":"bob"`) {
+		t.Errorf("PostUpdate response: %s", response.Body)
+	}
+
+	response = testRequest(t, handler, handler.ThreadUpdate, http.MethodPost, "/api/thread/th1/details",
+		`{"id":2,"slug":"th2","forum":"f2","author":"zed","title":"edited"}`, "bob", "slug_or_id", "th1")
+	if response.Code != http.StatusOK {
+		t.Fatalf("ThreadUpdate: status %d, body %s", response.Code, response.Body)
+	}
+	if thread, err := handler.Store.ThreadGetOne(ctx, ThreadKey{Id: 1}); err != nil || thread.Title != "edited" {
+		t.Errorf("thread 1: %+v, %v", thread, err)
+	}
+	if thread, err := handler.Store.ThreadGetOne(ctx, ThreadKey{Id: 2}); err != nil || thread.Title != "t2" {
+		t.Errorf("thread 2 changed through body id: %+v, %v", thread, err)
+	}
+	if !strings.Contains(response.Body.String(), `"id":1,"author":"bob"`) {
+		t.Errorf("ThreadUpdate response: %s", response.Body)
+	}
+}
+
+func TestNextPostsCursor(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	posts := []Post{
+		{Id: 1, Created: created, Path: []uint64{1}},
+		{Id: 2, ParentPost: 1, Created: created, Path: []uint64{1, 2}},
+		{Id: 3, Created: created, Path: []uint64{3}},
+		{Id: 4, ParentPost: 3, Created: created.Add(time.Second), Path: []uint64{3, 4}},
+	}
+	tests := []struct {
+		name   string
+		posts  []Post
+		list   string
+		filter PostsFilter
+		cursor Cursor
+		next   bool
+	}{
+		{"flat full page", posts, "flat", PostsFilter{Limit: 4},
+			Cursor{List: "flat", Created: &posts[3].Created, Id: 4}, true},
+		{"flat last page", posts, "flat", PostsFilter{Limit: 5, Desc: true},
+			Cursor{List: "flat", Desc: true, Created: &posts[3].Created, Id: 4}, false},
+		{"tree", posts[:2], "tree", PostsFilter{Limit: 2}, Cursor{List: "tree", Path: []uint64{1, 2}}, true},
+		{"parent_tree counts roots", posts, "parent_tree", PostsFilter{Limit: 2},
+			Cursor{List: "parent_tree", Id: 3}, true},
+		{"parent_tree last page", posts, "parent_tree", PostsFilter{Limit: 3},
+			Cursor{List: "parent_tree", Id: 3}, false},
+		{"no limit", posts, "flat", PostsFilter{}, Cursor{List: "flat"}, false},
+		{"empty", nil, "tree", PostsFilter{Limit: 1}, Cursor{List: "tree"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cursor, next := nextPostsCursor(test.posts, test.list, test.filter)
+			if !reflect.DeepEqual(cursor, test.cursor) || next != test.next {
+				t.Errorf("nextPostsCursor = %+v, %v, want %+v, %v", cursor, next, test.cursor, test.next)
+			}
+		})
+	}
+}
+
+func TestBansEnforced(t *testing.T) {
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name   string
+		ban    *ForumBan //Forum "" - блокировка на всём сайте
+		status int       //ответ на пост, ветку и голос bob в форуме f1
+	}{
+		{"no ban", nil, 0},
+		{"forum ban", &ForumBan{Forum: "f1", Nickname: "bob", Reason: "spam"}, http.StatusForbidden},
+		{"temporary forum ban", &ForumBan{Forum: "f1", Nickname: "bob", Expires: &future}, http.StatusForbidden},
+		{"expired forum ban", &ForumBan{Forum: "f1", Nickname: "bob", Expires: &past}, 0},
+		{"other forum ban", &ForumBan{Forum: "f2", Nickname: "bob"}, 0},
+		{"suspension", &ForumBan{Nickname: "bob"}, http.StatusForbidden},
+		{"expired suspension", &ForumBan{Nickname: "bob", Expires: &past}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestHandler(t)
+			var err error
+			switch {
+			case test.ban == nil:
+			case test.ban.Forum == "":
+				_, err = handler.Store.SuspensionCreate(ctx, *test.ban)
+			default:
+				_, err = handler.Store.ForumBanCreate(ctx, *test.ban, ModerationEntry{Forum: test.ban.Forum})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			requests := []struct {
+				handle       echo.HandlerFunc
+				target, body string
+				params       []string
+				status       int
+			}{
+				{handler.PostsCreate, "/api/thread/th1/create", `[{"message":"m"}]`,
+					[]string{"slug_or_id", "th1"}, http.StatusCreated},
+				{handler.ThreadCreate, "/api/forum/f1/create", `{"title":"t","message":"m"}`,
+					[]string{"slug_", "f1"}, http.StatusCreated},
+				{handler.ThreadVote, "/api/thread/th1/vote", `{"voice":1}`,
+					[]string{"slug_or_id", "th1"}, http.StatusOK},
+			}
+			for _, request := range requests {
+				status := test.status
+				if status == 0 {
+					status = request.status
+				}
+				response := testRequest(t, handler, request.handle, http.MethodPost, request.target, request.body, "bob",
+					request.params...)
+				if response.Code != status {
+					t.Errorf("%s: status %d, want %d, body %s", request.target, response.Code, status, response.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestPostsCreateInvalidBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"null post", `[null]`},
+		{"null among posts", `[{"message":"m"},null]`},
+		{"not an array", `{"message":"m"}`},
+		{"not json", `[{`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestHandler(t)
+			response := testRequest(t, handler, handler.PostsCreate, http.MethodPost, "/api/thread/th1/create",
+				test.body, "bob", "slug_or_id", "th1")
+			if response.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want %d, body %s", response.Code, http.StatusBadRequest, response.Body)
+			}
+		})
+	}
+}
+
+func TestThreadStream(t *testing.T) {
+	ctx := context.Background()
+	handler := newTestHandler(t)
+	e := echo.New()
+	e.GET("/api/thread/:slug_or_id/stream", handler.ThreadStream)
+	server := httptest.NewUnstartedServer(e)
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Config.ConnContext = withConn
+	server.Start()
+	defer server.Close()
+	defer handler.CloseStreams()
+
+	//строки потока до строки want; ошибка, если она не пришла за секунду
+	stream := func(lastEventId string) func(want string) []string {
+		request, err := http.NewRequest(http.MethodGet, server.URL+"/api/thread/th1/stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventId != "" {
+			request.Header.Set("Last-Event-ID", lastEventId)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = response.Body.Close()
+		})
+		lines := make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(response.Body)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			close(lines)
+		}()
+		return func(want string) []string {
+			t.Helper()
+			var read []string
+			timeout := time.After(time.Second)
+			for {
+				select {
+				case line, ok := <-lines:
+					if !ok {
+						t.Fatalf("stream closed before %q, read %q", want, read)
+					}
+					read = append(read, line)
+					if line == want {
+						return read
+					}
+				case <-timeout:
+					t.Fatalf("no %q in a second, read %q", want, read)
+				}
+			}
+		}
+	}
+	createPost := func(message string) {
+		thread, err := handler.Store.ThreadGetOne(ctx, ThreadKey{Slug: "th1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := handler.Store.PostsCreate(ctx, thread, []*Post{{ProfileNickname: "alice", Message: message}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := stream("")
+	read("retry: 1000")
+	time.Sleep(300 * time.Millisecond) //дольше server.write_timeout
+	createPost("after write timeout")
+	read("id: 3")
+
+	createPost("missed")
+	read = stream("3")
+	lines := read(`data: {"thread":1,"votes":0}`)
+	if len(lines) < 5 || lines[2] != "id: 4" || !strings.Contains(lines[4], `"message":"missed"`) {
+		t.Errorf("replayed after Last-Event-ID 3: %q", lines)
+	}
+
+	if _, err := handler.Store.ThreadArchive(ctx, ThreadKey{Slug: "th1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	read(`data: {"thread":1}`)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"sync/atomic"
+	"time"
+)
+
+const requestLoggerKey = "logger"
+
+// Логи пишутся JSON-строками в stderr; уровень и порог медленного запроса можно поменять на лету (SIGHUP).
+type Logging struct {
+	Logger      *log.Logger
+	slowRequest int64 //time.Duration; 0 - не выделять медленные запросы
+}
+
+func NewLogging(config Config) *Logging {
+	logger := log.New("forums")
+	logger.DisableColor()
+	logger.SetHeader(`{"time":"${time_rfc3339_nano}","level":"${level}"}`)
+
+	logging := &Logging{Logger: logger}
+	logging.Apply(config)
+	return logging
+}
+
+func (logging *Logging) Apply(config Config) {
+	logging.Logger.SetLevel(logLevel(config.LogLevel))
+	atomic.StoreInt64(&logging.slowRequest, int64(config.LogSlowRequest))
+}
+
+func logLevel(level string) log.Lvl {
+	switch level {
+	case "debug":
+		return log.DEBUG
+	case "info":
+		return log.INFO
+	case "warn":
+		return log.WARN
+	case "error":
+		return log.ERROR
+	default:
+		return log.OFF
+	}
+}
+
+// Логгер запроса: каждая запись дополняется request_id, маршрутом и методом.
+type RequestLogger struct {
+	logger *log.Logger
+	fields log.JSON
+}
+
+func (requestLogger RequestLogger) with(message string, fields log.JSON) log.JSON {
+	record := make(log.JSON, len(requestLogger.fields)+len(fields)+1)
+	for key, value := range requestLogger.fields {
+		record[key] = value
+	}
+	for key, value := range fields {
+		record[key] = value
+	}
+	record["message"] = message
+	return record
+}
+
+func (requestLogger RequestLogger) Debug(message string, fields log.JSON) {
+	if requestLogger.logger.Level() <= log.DEBUG {
+		requestLogger.logger.Debugj(requestLogger.with(message, fields))
+	}
+}
+
+func (requestLogger RequestLogger) Info(message string, fields log.JSON) {
+	if requestLogger.logger.Level() <= log.INFO {
+		requestLogger.logger.Infoj(requestLogger.with(message, fields))
+	}
+}
+
+func (requestLogger RequestLogger) Warn(message string, fields log.JSON) {
+	if requestLogger.logger.Level() <= log.WARN {
+		requestLogger.logger.Warnj(requestLogger.with(message, fields))
+	}
+}
+
+func (requestLogger RequestLogger) Error(message string, fields log.JSON) {
+	if requestLogger.logger.Level() <= log.ERROR {
+		requestLogger.logger.Errorj(requestLogger.with(message, fields))
+	}
+}
+
+func requestLoggerOf(ctx echo.Context) RequestLogger {
+	if requestLogger, ok := ctx.Get(requestLoggerKey).(RequestLogger); ok {
+		return requestLogger
+	}
+	logger, ok := ctx.Logger().(*log.Logger)
+	if !ok {
+		logger = log.New("forums")
+	}
+	return RequestLogger{logger: logger, fields: log.JSON{
+		"request_id": ctx.Response().Header().Get(echo.HeaderXRequestID),
+	}}
+}
+
+// Журнал доступа: одна запись на запрос. Медленные запросы пишутся с уровнем WARN, ответы 5xx - с уровнем ERROR.
+func (logging *Logging) AccessLog(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		start := time.Now()
+		requestLogger := RequestLogger{logger: logging.Logger, fields: log.JSON{
+			"request_id": ctx.Response().Header().Get(echo.HeaderXRequestID),
+			"method":     ctx.Request().Method,
+			"route":      ctx.Path(),
+		}}
+		ctx.Set(requestLoggerKey, requestLogger)
+
+		err := next(ctx)
+		if err != nil {
+			ctx.Error(err)
+		}
+		if err == echo.ErrNotFound || err == echo.ErrMethodNotAllowed {
+			requestLogger.fields["route"] = "unmatched"
+		}
+
+		latency := time.Since(start)
+		fields := log.JSON{
+			"uri":        ctx.Request().RequestURI,
+			"status":     ctx.Response().Status,
+			"latency_ms": float64(latency.Microseconds()) / 1000,
+			"bytes_in":   ctx.Request().ContentLength,
+			"bytes_out":  ctx.Response().Size,
+			"remote_ip":  ctx.RealIP(),
+		}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+
+		slowRequest := time.Duration(atomic.LoadInt64(&logging.slowRequest))
+		switch {
+		case ctx.Response().Status >= 500:
+			requestLogger.Error("request failed", fields)
+		case slowRequest > 0 && latency >= slowRequest:
+			requestLogger.Warn("slow request", fields)
+		default:
+			requestLogger.Info("request", fields)
+		}
+		return err
+	}
+}
+
+// Пишет в лог ошибку обработчика (5xx); для ошибок хранилища указывается операция.
+func logRequestError(ctx echo.Context, err error) {
+	fields := log.JSON{
+		"error": err.Error(),
+	}
+	cause := err
+	var domainError *DomainError
+	if errors.As(err, &domainError) && domainError.Cause != nil { //DomainError.Unwrap() возвращает Kind, а не Cause
+		cause = domainError.Cause
+	}
+	var operationError *OperationError
+	if errors.As(cause, &operationError) {
+		fields["operation"] = operationError.Operation
+	}
+	requestLoggerOf(ctx).Error("request error", fields)
+}
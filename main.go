@@ -1,79 +1,320 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
-var DBConnection *sql.DB
-
 func main() {
-	var err error
-	DBConnection, err = sql.Open("postgres", "host=localhost port=5432 user=forums_user password=forums_user dbname=forums sslmode=disable")
-	defer func() {
-		_ = DBConnection.Close()
-	}()
-	if err != nil {
-		panic(err)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrateCommand(os.Args[0]+" migrate", os.Args[2:]))
+	}
+
+	config, args, err := LoadConfig(os.Args[0], os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	} else if len(args) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "unexpected argument %q\n", args[0])
+		os.Exit(2)
 	}
 
-	if err := DBConnection.Ping(); err != nil {
+	logging := NewLogging(config)
+	metrics := NewMetrics()
+
+	var store Store
+	if config.Storage == "memory" {
+		store = NewMemoryStore()
+	} else {
+		db, err := openDatabase(config.Database)
+		if err != nil {
+			panic(err)
+		}
+		if err := checkSchema(db, config.Database.Profile, logging); err != nil {
+			_ = db.Close()
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		metrics.RegisterDB(db)
+		store = NewPostgresStore(db, config.Database.DSN)
+	}
+	store = metrics.Store(store)
+
+	auth, err := NewAuth(store, config.Auth)
+	if err != nil {
+		_ = store.Close()
 		panic(err)
 	}
+	if config.Auth.Secret == "" {
+		logging.Logger.Warnj(log.JSON{"message": "auth.secret is not set, tokens are signed with a random key and expire on restart"})
+	}
 
 	e := echo.New() //TODO: возможно, echo не нужен
+	e.Logger = logging.Logger
+	e.HideBanner, e.HidePort = true, true
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.Use(middleware.RequestID(), logging.AccessLog, metrics.Middleware, middleware.Recover(),
+		QueryTimeout(config.Database.QueryTimeout, config.Database.QueryTimeouts), auth.Middleware)
+	e.Server.ReadTimeout = config.Server.ReadTimeout
+	e.Server.WriteTimeout = config.Server.WriteTimeout //кроме потоков событий (ThreadStream)
+	e.Server.ConnContext = withConn
+	e.Server.IdleTimeout = config.Server.IdleTimeout
 
-	//e.GET("/api", Api)
+	handler := NewHandler(store, auth)
 
-	e.POST("/api/forum/create", ForumCreate)
+	e.GET("/metrics", metrics.Handler())
 
-	e.POST("/api/forum/:slug_/create", ThreadCreate)
+	e.POST("/api/forum/create", handler.ForumCreate)
 
-	e.GET("/api/forum/:slug/details", ForumGetOne)
+	e.POST("/api/forum/:slug_/create", handler.ThreadCreate)
 
-	e.GET("/api/forum/:slug/threads", ForumGetThreads)
+	e.GET("/api/forum/:slug/details", handler.ForumGetOne)
 
-	e.GET("/api/forum/:slug/users", ForumGetUsers)
+	e.POST("/api/forum/:slug/details", handler.ForumUpdate)
 
-	e.GET("/api/post/:id/details", PostGetOne)
+	e.DELETE("/api/forum/:slug", handler.ForumDelete)
 
-	e.POST("/api/post/:id/details", PostUpdate)
+	e.GET("/api/forum/:slug/threads", handler.ForumGetThreads)
 
-	e.POST("/api/service/clear", ServiceClear)
+	e.GET("/api/forum/:slug/users", handler.ForumGetUsers)
 
-	e.GET("/api/service/status", ServiceStatus)
+	e.GET("/api/forum/:slug/moderators", handler.ForumGetModerators)
 
-	e.POST("/api/thread/:slug_or_id/create", PostsCreate)
+	e.PUT("/api/forum/:slug/moderators/:nickname", handler.ForumModeratorCreate)
 
-	e.GET("/api/thread/:slug_or_id/details", ThreadGetOne)
+	e.DELETE("/api/forum/:slug/moderators/:nickname", handler.ForumModeratorDelete)
 
-	e.POST("/api/thread/:slug_or_id/details", ThreadUpdate)
+	e.GET("/api/forum/:slug/roles/:nickname", handler.ForumGetRole)
 
-	e.GET("/api/thread/:slug_or_id/posts", ThreadGetPosts)
+	e.PUT("/api/forum/:slug/bans/:nickname", handler.ForumBanCreate)
 
-	e.POST("/api/thread/:slug_or_id/vote", ThreadVote)
+	e.DELETE("/api/forum/:slug/bans/:nickname", handler.ForumBanDelete)
 
-	e.POST("/api/user/:nickname/create", UserCreate)
+	e.GET("/api/forum/:slug/bans", handler.ForumGetBans)
 
-	e.GET("/api/user/:nickname/profile", UserGetOne)
+	e.GET("/api/forum/:slug/moderation-log", handler.ForumGetLog)
 
-	e.POST("/api/user/:nickname/profile", UserUpdate)
+	e.GET("/api/post/:id/details", handler.PostGetOne)
 
-	//e.Use(middleware.Logger(), AccessLog)
-	if err := e.Start("0.0.0.0:5000"); err != nil {
-		panic(err)
+	e.POST("/api/post/:id/details", handler.PostUpdate)
+
+	e.GET("/api/post/:id/history", handler.PostHistory)
+
+	e.GET("/api/post/:id/history/diff", handler.PostDiff)
+
+	e.DELETE("/api/post/:id", handler.PostDelete)
+
+	e.DELETE("/api/post/:id/moderate", handler.PostModerate)
+
+	e.POST("/api/post/:id/hide", handler.PostHide)
+
+	e.POST("/api/post/:id/unhide", handler.PostUnhide)
+
+	e.GET("/api/search", handler.Search)
+
+	e.POST("/api/auth/login", handler.AuthLogin)
+
+	e.POST("/api/auth/logout", handler.AuthLogout)
+
+	e.POST("/api/service/clear", handler.ServiceClear)
+
+	e.GET("/api/service/status", handler.ServiceStatus)
+
+	e.POST("/api/thread/:slug_or_id/create", handler.PostsCreate)
+
+	e.GET("/api/thread/:slug_or_id/details", handler.ThreadGetOne)
+
+	e.POST("/api/thread/:slug_or_id/details", handler.ThreadUpdate)
+
+	e.DELETE("/api/thread/:slug_or_id", handler.ThreadDelete)
+
+	e.GET("/api/thread/:slug_or_id/posts", handler.ThreadGetPosts)
+
+	e.POST("/api/thread/:slug_or_id/vote", handler.ThreadVote)
+
+	e.POST("/api/thread/:slug_or_id/lock", handler.ThreadLock)
+
+	e.POST("/api/thread/:slug_or_id/unlock", handler.ThreadUnlock)
+
+	e.POST("/api/thread/:slug_or_id/pin", handler.ThreadPin)
+
+	e.POST("/api/thread/:slug_or_id/unpin", handler.ThreadUnpin)
+
+	e.POST("/api/thread/:slug_or_id/move", handler.ThreadMove)
+
+	e.GET("/api/thread/:slug_or_id/stream", handler.ThreadStream)
+	e.Server.RegisterOnShutdown(handler.CloseStreams)
+
+	e.GET("/api/user/search", handler.UserSearch)
+
+	e.POST("/api/user/:nickname/create", handler.UserCreate)
+
+	e.GET("/api/user/:nickname/profile", handler.UserGetOne)
+
+	e.POST("/api/user/:nickname/profile", handler.UserUpdate)
+
+	e.POST("/api/user/:nickname/password", handler.UserPassword)
+
+	e.PUT("/api/user/:nickname/suspension", handler.UserSuspend)
+
+	e.DELETE("/api/user/:nickname/suspension", handler.UserUnsuspend)
+
+	e.GET("/api/suspensions", handler.SuspensionGetAll)
+
+	e.DELETE("/api/user/:nickname", handler.UserDelete)
+
+	if err := checkRoutes(e, config.Database.QueryTimeouts); err != nil {
+		_ = store.Close()
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	serverErrors := make(chan error, 1)
+	go func() {
+		e.Logger.Infoj(log.JSON{"message": "listening", "address": config.Server.Listen, "storage": config.Storage})
+		serverErrors <- e.Start(config.Server.Listen)
+	}()
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-serverErrors:
+			if err != http.ErrServerClosed {
+				_ = store.Close()
+				panic(err)
+			}
+			return
+		case <-reload:
+			reloadLogging(logging)
+		case <-signals.Done():
+			shutdown(e, store, config.Server.ShutdownTimeout)
+			return
+		}
+	}
+}
+
+// По SIGHUP перечитывает настройки и применяет те, что можно поменять без перезапуска (уровень логов,
+// порог медленного запроса).
+func reloadLogging(logging *Logging) {
+	config, _, err := LoadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		logging.Logger.Errorj(log.JSON{"message": "config reload failed", "error": err.Error()})
+		return
+	}
+	logging.Apply(config)
+	logging.Logger.Infoj(log.JSON{"message": "config reloaded", "log_level": config.LogLevel,
+		"log_slow_request": config.LogSlowRequest.String()})
+}
+
+// Перестаёт принимать новые соединения, ждёт завершения обрабатываемых запросов не дольше timeout,
+// после чего откатывает оставшиеся транзакции и закрывает хранилище.
+func shutdown(e *echo.Echo, store Store, timeout time.Duration) {
+	e.Logger.Info("shutting down")
+	drain, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.Shutdown(drain); err != nil {
+		e.Logger.Warnf("in-flight requests did not finish in %s: %v", timeout, err)
+		_ = e.Close()
 	}
+
+	if err := store.Close(); err != nil {
+		e.Logger.Error(err)
+	}
+}
+
+func openDatabase(config DatabaseConfig) (*sql.DB, error) {
+	db, err := sql.Open("postgres", config.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	db.SetMaxIdleConns(config.MaxIdleConns)
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-func AccessLog(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		start := time.Now()
-		err := next(ctx)
-		end := time.Now()
-		fmt.Println("Request time: ", end.Sub(start))
-		fmt.Println()
+// Сервер не запускается, если схема базы старее, чем ожидают запросы хранилища.
+func checkSchema(db *sql.DB, profile string, logging *Logging) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
 		return err
 	}
+	tables, err := migrator.Check(context.Background(), profile)
+	if err == nil && len(tables) > 0 {
+		logging.Logger.Warnj(log.JSON{"message": "table persistence does not match database profile, run migrate up",
+			"profile": profile, "tables": tables})
+	}
+	return err
+}
+
+// Маршруты, которые держат соединение открытым: на них query_timeout не распространяется.
+var streamRoutes = map[string]struct{}{
+	"/api/thread/:slug_or_id/stream": {},
+}
+
+// Ограничивает время работы с хранилищем: контекст запроса получает дедлайн по маршруту (ctx.Path()).
+// Ошибки, вызванные истёкшим дедлайном или отменой запроса, превращаются в 504 и 503 здесь, пока контекст
+// ещё не освобождён: после cancel он отменён всегда.
+func QueryTimeout(defaultTimeout time.Duration, timeouts map[string]time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if _, ok := streamRoutes[ctx.Path()]; ok {
+				return next(ctx)
+			}
+			timeout, ok := timeouts[ctx.Path()]
+			if !ok {
+				timeout = defaultTimeout
+			}
+			if timeout > 0 {
+				requestContext, cancel := context.WithTimeout(ctx.Request().Context(), timeout)
+				defer cancel()
+				ctx.SetRequest(ctx.Request().WithContext(requestContext))
+			}
+			err := next(ctx)
+			if domainError := contextError(err, ctx.Request().Context().Err()); domainError != nil {
+				return domainError
+			}
+			return err
+		}
+	}
+}
+
+// Проверяет, что в настройках упомянуты только существующие маршруты.
+func checkRoutes(e *echo.Echo, timeouts map[string]time.Duration) error {
+	for route := range timeouts {
+		found := false
+		for _, registered := range e.Routes() {
+			if registered.Path == route {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid config:\n  database.query_timeouts: unknown route %q", route)
+		}
+	}
+	return nil
 }
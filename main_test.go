@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	storeError := errors.New("pq: canceling statement due to user request")
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		handle  echo.HandlerFunc
+		status  int
+	}{
+		{"store error with deadline", time.Minute, func(ctx echo.Context) error {
+			return storeError
+		}, http.StatusInternalServerError},
+		{"store error without deadline", 0, func(ctx echo.Context) error {
+			return storeError
+		}, http.StatusInternalServerError},
+		{"domain error with deadline", time.Minute, func(ctx echo.Context) error {
+			return NotFound("Can't find post with id 1")
+		}, http.StatusNotFound},
+		//lib/pq возвращает ошибку сервера, а не контекста
+		{"store error after deadline", time.Millisecond, func(ctx echo.Context) error {
+			<-ctx.Request().Context().Done()
+			return storeError
+		}, http.StatusGatewayTimeout},
+		{"context error after deadline", time.Millisecond, func(ctx echo.Context) error {
+			<-ctx.Request().Context().Done()
+			return ctx.Request().Context().Err()
+		}, http.StatusGatewayTimeout},
+		{"ok", time.Minute, func(ctx echo.Context) error {
+			return ctx.NoContent(http.StatusOK)
+		}, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := echo.New()
+			e.HTTPErrorHandler = HTTPErrorHandler
+			e.Logger.SetOutput(httptest.NewRecorder())
+			e.Use(QueryTimeout(test.timeout, nil))
+			e.POST("/api/thread/:slug_or_id/create", test.handle)
+
+			recorder := httptest.NewRecorder()
+			e.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/thread/1/create", nil))
+			if recorder.Code != test.status {
+				t.Errorf("status %d, want %d, body %s", recorder.Code, test.status, recorder.Body)
+			}
+		})
+	}
+}
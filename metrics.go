@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"strconv"
+	"time"
+)
+
+const metricsNamespace = "forums"
+
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+
+	storeDuration *prometheus.HistogramVec
+	storeErrors   *prometheus.CounterVec
+
+	usersCreated   prometheus.Counter
+	forumsCreated  prometheus.Counter
+	threadsCreated prometheus.Counter
+	postsCreated   prometheus.Counter
+	postsDeleted   *prometheus.CounterVec
+	votesCast      *prometheus.CounterVec
+
+	moderationActions *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method, status code and posts sort mode.",
+		}, []string{"route", "method", "status", "sort"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route, method and posts sort mode.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"route", "method", "sort"}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_query_duration_seconds",
+			Help:      "Storage operation latency by operation.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"operation"}),
+		storeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_query_errors_total",
+			Help:      "Storage operations that failed with an internal error (not found and conflicts excluded).",
+		}, []string{"operation"}),
+		usersCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "users_created_total",
+			Help:      "Users created.",
+		}),
+		forumsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "forums_created_total",
+			Help:      "Forums created.",
+		}),
+		threadsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "threads_created_total",
+			Help:      "Threads created.",
+		}),
+		postsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "posts_created_total",
+			Help:      "Posts created.",
+		}),
+		postsDeleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "posts_deleted_total",
+			Help:      "Post deletion requests by who deleted the post (author or moderator).",
+		}, []string{"deleted_by"}),
+		votesCast: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "votes_cast_total",
+			Help:      "Thread votes cast by voice (0 - retracted).",
+		}, []string{"voice"}),
+		moderationActions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "moderation_actions_total",
+			Help:      "Moderation actions (forum moderation log entries and site-wide suspensions) by action.",
+		}, []string{"action"}),
+	}
+
+	metrics.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.requests, metrics.requestDuration,
+		metrics.storeDuration, metrics.storeErrors,
+		metrics.usersCreated, metrics.forumsCreated, metrics.threadsCreated, metrics.postsCreated, metrics.postsDeleted,
+		metrics.votesCast, metrics.moderationActions,
+	)
+	return metrics
+}
+
+// Статистика пула соединений sql.DB (go_sql_*{db_name="forums"}).
+func (metrics *Metrics) RegisterDB(db *sql.DB) {
+	metrics.registry.MustRegister(collectors.NewDBStatsCollector(db, "forums"))
+}
+
+func (metrics *Metrics) Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
+}
+
+func (metrics *Metrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		start := time.Now()
+		err := next(ctx)
+		if err != nil {
+			ctx.Error(err) //статус ответа известен только после обработки ошибки
+		}
+
+		route := ctx.Path()
+		if err == echo.ErrNotFound || err == echo.ErrMethodNotAllowed { //для несуществующих маршрутов Path() - это URL запроса
+			route = "unmatched"
+		}
+		var sort string
+		if route == "/api/thread/:slug_or_id/posts" { //метка - только из известных значений, иначе число рядов не ограничено
+			sort = postsSort(ctx.QueryParam("sort"))
+		}
+		method := ctx.Request().Method
+
+		metrics.requests.WithLabelValues(route, method, strconv.Itoa(ctx.Response().Status), sort).Inc()
+		metrics.requestDuration.WithLabelValues(route, method, sort).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// Хранилище-обёртка: замеряет длительность операций и считает бизнес-события.
+type metricsStore struct {
+	Store
+	metrics *Metrics
+}
+
+func (metrics *Metrics) Store(store Store) Store {
+	return &metricsStore{Store: store, metrics: metrics}
+}
+
+func (store *metricsStore) observe(operation string, start time.Time, err *error) {
+	store.metrics.storeDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	var domainError *DomainError
+	if *err != nil && *err != ErrConflict && !errors.As(*err, &domainError) {
+		store.metrics.storeErrors.WithLabelValues(operation).Inc()
+		*err = &OperationError{Operation: operation, Err: *err}
+	}
+}
+
+func (store *metricsStore) UserCreate(ctx context.Context, profile Profile, passwordHash string) (existingProfiles []Profile, err error) {
+	defer store.observe("UserCreate", time.Now(), &err)
+	if existingProfiles, err = store.Store.UserCreate(ctx, profile, passwordHash); err == nil {
+		store.metrics.usersCreated.Inc()
+	}
+	return existingProfiles, err
+}
+
+func (store *metricsStore) UserGetOne(ctx context.Context, nickname string) (profile Profile, err error) {
+	defer store.observe("UserGetOne", time.Now(), &err)
+	return store.Store.UserGetOne(ctx, nickname)
+}
+
+func (store *metricsStore) UserUpdate(ctx context.Context, profile Profile) (err error) {
+	defer store.observe("UserUpdate", time.Now(), &err)
+	return store.Store.UserUpdate(ctx, profile)
+}
+
+func (store *metricsStore) UserAnonymize(ctx context.Context, nickname string) (profile Profile, err error) {
+	defer store.observe("UserAnonymize", time.Now(), &err)
+	return store.Store.UserAnonymize(ctx, nickname)
+}
+
+func (store *metricsStore) UserDelete(ctx context.Context, nickname string) (err error) {
+	defer store.observe("UserDelete", time.Now(), &err)
+	return store.Store.UserDelete(ctx, nickname)
+}
+
+func (store *metricsStore) UserSearch(ctx context.Context, query string, filter UsersFilter) (profiles []Profile, err error) {
+	defer store.observe("UserSearch", time.Now(), &err)
+	return store.Store.UserSearch(ctx, query, filter)
+}
+
+func (store *metricsStore) UserGetPassword(ctx context.Context, nickname string) (profile Profile, passwordHash string, err error) {
+	defer store.observe("UserGetPassword", time.Now(), &err)
+	return store.Store.UserGetPassword(ctx, nickname)
+}
+
+func (store *metricsStore) UserSetPassword(ctx context.Context, nickname, passwordHash string) (err error) {
+	defer store.observe("UserSetPassword", time.Now(), &err)
+	return store.Store.UserSetPassword(ctx, nickname, passwordHash)
+}
+
+func (store *metricsStore) SessionCreate(ctx context.Context, session Session) (err error) {
+	defer store.observe("SessionCreate", time.Now(), &err)
+	return store.Store.SessionCreate(ctx, session)
+}
+
+func (store *metricsStore) SessionGetOne(ctx context.Context, id string) (session Session, err error) {
+	defer store.observe("SessionGetOne", time.Now(), &err)
+	return store.Store.SessionGetOne(ctx, id)
+}
+
+func (store *metricsStore) SessionDelete(ctx context.Context, id string) (err error) {
+	defer store.observe("SessionDelete", time.Now(), &err)
+	return store.Store.SessionDelete(ctx, id)
+}
+
+func (store *metricsStore) ForumCreate(ctx context.Context, forum Forum) (_ Forum, err error) {
+	defer store.observe("ForumCreate", time.Now(), &err)
+	if forum, err = store.Store.ForumCreate(ctx, forum); err == nil {
+		store.metrics.forumsCreated.Inc()
+	}
+	return forum, err
+}
+
+func (store *metricsStore) ForumGetOne(ctx context.Context, slug string) (forum Forum, err error) {
+	defer store.observe("ForumGetOne", time.Now(), &err)
+	return store.Store.ForumGetOne(ctx, slug)
+}
+
+func (store *metricsStore) ForumUpdate(ctx context.Context, forum Forum) (_ Forum, err error) {
+	defer store.observe("ForumUpdate", time.Now(), &err)
+	return store.Store.ForumUpdate(ctx, forum)
+}
+
+func (store *metricsStore) ForumDelete(ctx context.Context, slug string) (err error) {
+	defer store.observe("ForumDelete", time.Now(), &err)
+	return store.Store.ForumDelete(ctx, slug)
+}
+
+func (store *metricsStore) ForumGetThreads(ctx context.Context, slug string, filter ThreadsFilter) (threads []Thread, err error) {
+	defer store.observe("ForumGetThreads", time.Now(), &err)
+	return store.Store.ForumGetThreads(ctx, slug, filter)
+}
+
+func (store *metricsStore) ForumGetUsers(ctx context.Context, slug string, filter UsersFilter) (profiles []Profile, err error) {
+	defer store.observe("ForumGetUsers", time.Now(), &err)
+	return store.Store.ForumGetUsers(ctx, slug, filter)
+}
+
+func (store *metricsStore) ForumGetRole(ctx context.Context, slug, nickname string) (role string, err error) {
+	defer store.observe("ForumGetRole", time.Now(), &err)
+	return store.Store.ForumGetRole(ctx, slug, nickname)
+}
+
+func (store *metricsStore) ForumGetModerators(ctx context.Context, slug string) (roles []ForumRole, err error) {
+	defer store.observe("ForumGetModerators", time.Now(), &err)
+	return store.Store.ForumGetModerators(ctx, slug)
+}
+
+func (store *metricsStore) ForumModeratorCreate(ctx context.Context, slug, nickname string, entry ModerationEntry) (role ForumRole, err error) {
+	defer store.observe("ForumModeratorCreate", time.Now(), &err)
+	if role, err = store.Store.ForumModeratorCreate(ctx, slug, nickname, entry); err == nil {
+		store.metrics.moderationActions.WithLabelValues(entry.Action).Inc()
+	}
+	return role, err
+}
+
+func (store *metricsStore) ForumModeratorDelete(ctx context.Context, slug, nickname string, entry ModerationEntry) (err error) {
+	defer store.observe("ForumModeratorDelete", time.Now(), &err)
+	if err = store.Store.ForumModeratorDelete(ctx, slug, nickname, entry); err == nil {
+		store.metrics.moderationActions.WithLabelValues(entry.Action).Inc()
+	}
+	return err
+}
+
+func (store *metricsStore) ForumBanCreate(ctx context.Context, ban ForumBan, entry ModerationEntry) (_ ForumBan, err error) {
+	defer store.observe("ForumBanCreate", time.Now(), &err)
+	if ban, err = store.Store.ForumBanCreate(ctx, ban, entry); err == nil {
+		store.metrics.moderationActions.WithLabelValues(entry.Action).Inc()
+	}
+	return ban, err
+}
+
+func (store *metricsStore) ForumBanDelete(ctx context.Context, slug, nickname string, entry ModerationEntry) (err error) {
+	defer store.observe("ForumBanDelete", time.Now(), &err)
+	if err = store.Store.ForumBanDelete(ctx, slug, nickname, entry); err == nil {
+		store.metrics.moderationActions.WithLabelValues(entry.Action).Inc()
+	}
+	return err
+}
+
+func (store *metricsStore) ForumGetBans(ctx context.Context, slug string) (bans []ForumBan, err error) {
+	defer store.observe("ForumGetBans", time.Now(), &err)
+	return store.Store.ForumGetBans(ctx, slug)
+}
+
+func (store *metricsStore) ForumGetLog(ctx context.Context, slug string, filter ModerationFilter) (entries []ModerationEntry, err error) {
+	defer store.observe("ForumGetLog", time.Now(), &err)
+	return store.Store.ForumGetLog(ctx, slug, filter)
+}
+
+func (store *metricsStore) SuspensionCreate(ctx context.Context, suspension ForumBan) (_ ForumBan, err error) {
+	defer store.observe("SuspensionCreate", time.Now(), &err)
+	if suspension, err = store.Store.SuspensionCreate(ctx, suspension); err == nil {
+		store.metrics.moderationActions.WithLabelValues("suspend").Inc()
+	}
+	return suspension, err
+}
+
+func (store *metricsStore) SuspensionDelete(ctx context.Context, nickname string) (err error) {
+	defer store.observe("SuspensionDelete", time.Now(), &err)
+	if err = store.Store.SuspensionDelete(ctx, nickname); err == nil {
+		store.metrics.moderationActions.WithLabelValues("unsuspend").Inc()
+	}
+	return err
+}
+
+func (store *metricsStore) SuspensionGetAll(ctx context.Context) (suspensions []ForumBan, err error) {
+	defer store.observe("SuspensionGetAll", time.Now(), &err)
+	return store.Store.SuspensionGetAll(ctx)
+}
+
+func (store *metricsStore) UserGetBans(ctx context.Context, forumSlug string, nicknames []string) (bans []ForumBan, err error) {
+	defer store.observe("UserGetBans", time.Now(), &err)
+	return store.Store.UserGetBans(ctx, forumSlug, nicknames)
+}
+
+func (store *metricsStore) ThreadCreate(ctx context.Context, thread Thread) (_ Thread, err error) {
+	defer store.observe("ThreadCreate", time.Now(), &err)
+	if thread, err = store.Store.ThreadCreate(ctx, thread); err == nil {
+		store.metrics.threadsCreated.Inc()
+	}
+	return thread, err
+}
+
+func (store *metricsStore) ThreadGetOne(ctx context.Context, key ThreadKey) (thread Thread, err error) {
+	defer store.observe("ThreadGetOne", time.Now(), &err)
+	return store.Store.ThreadGetOne(ctx, key)
+}
+
+func (store *metricsStore) ThreadUpdate(ctx context.Context, thread Thread) (err error) {
+	defer store.observe("ThreadUpdate", time.Now(), &err)
+	return store.Store.ThreadUpdate(ctx, thread)
+}
+
+func (store *metricsStore) ThreadGetPosts(ctx context.Context, thread Thread, filter PostsFilter) (posts []Post, err error) {
+	operation := "ThreadGetPosts"
+	if filter.Sort == "tree" || filter.Sort == "parent_tree" {
+		operation += "_" + filter.Sort
+	}
+	defer store.observe(operation, time.Now(), &err)
+	return store.Store.ThreadGetPosts(ctx, thread, filter)
+}
+
+func (store *metricsStore) ThreadVote(ctx context.Context, key ThreadKey, vote Vote) (thread Thread, err error) {
+	defer store.observe("ThreadVote", time.Now(), &err)
+	if thread, err = store.Store.ThreadVote(ctx, key, vote); err == nil {
+		store.metrics.votesCast.WithLabelValues(strconv.Itoa(int(vote.Voice))).Inc()
+	}
+	return thread, err
+}
+
+func (store *metricsStore) ThreadArchive(ctx context.Context, key ThreadKey, moderation *ModerationEntry) (thread Thread, err error) {
+	defer store.observe("ThreadArchive", time.Now(), &err)
+	return store.Store.ThreadArchive(ctx, key, moderation)
+}
+
+func (store *metricsStore) ThreadDelete(ctx context.Context, key ThreadKey) (err error) {
+	defer store.observe("ThreadDelete", time.Now(), &err)
+	return store.Store.ThreadDelete(ctx, key)
+}
+
+func (store *metricsStore) ThreadPin(ctx context.Context, key ThreadKey, pinned bool, entry ModerationEntry) (thread Thread, err error) {
+	defer store.observe("ThreadPin", time.Now(), &err)
+	if thread, err = store.Store.ThreadPin(ctx, key, pinned, entry); err == nil {
+		store.metrics.moderationActions.WithLabelValues(entry.Action).Inc()
+	}
+	return thread, err
+}
+
+func (store *metricsStore) ThreadLock(ctx context.Context, key ThreadKey, locked bool, entry ModerationEntry) (thread Thread, err error) {
+	defer store.observe("ThreadLock", time.Now(), &err)
+	if thread, err = store.Store.ThreadLock(ctx, key, locked, entry); err == nil {
+		store.metrics.moderationActions.WithLabelValues(entry.Action).Inc()
+	}
+	return thread, err
+}
+
+func (store *metricsStore) ThreadMove(ctx context.Context, key ThreadKey, forumSlug string, entry ModerationEntry) (thread Thread, err error) {
+	defer store.observe("ThreadMove", time.Now(), &err)
+	if thread, err = store.Store.ThreadMove(ctx, key, forumSlug, entry); err == nil {
+		store.metrics.moderationActions.WithLabelValues(entry.Action).Inc()
+	}
+	return thread, err
+}
+
+func (store *metricsStore) PostsCreate(ctx context.Context, thread Thread, posts []*Post) (err error) {
+	defer store.observe("PostsCreate", time.Now(), &err)
+	if err = store.Store.PostsCreate(ctx, thread, posts); err == nil {
+		store.metrics.postsCreated.Add(float64(len(posts)))
+	}
+	return err
+}
+
+func (store *metricsStore) PostGetOne(ctx context.Context, id uint64) (post Post, err error) {
+	defer store.observe("PostGetOne", time.Now(), &err)
+	return store.Store.PostGetOne(ctx, id)
+}
+
+func (store *metricsStore) PostUpdate(ctx context.Context, post Post, editor string) (err error) {
+	defer store.observe("PostUpdate", time.Now(), &err)
+	return store.Store.PostUpdate(ctx, post, editor)
+}
+
+func (store *metricsStore) PostDelete(ctx context.Context, id uint64, moderation *ModerationEntry) (post Post, err error) {
+	defer store.observe("PostDelete", time.Now(), &err)
+	if post, err = store.Store.PostDelete(ctx, id, moderation); err == nil {
+		if moderation == nil {
+			store.metrics.postsDeleted.WithLabelValues("author").Inc()
+		} else {
+			store.metrics.postsDeleted.WithLabelValues("moderator").Inc()
+			store.metrics.moderationActions.WithLabelValues(moderation.Action).Inc()
+		}
+	}
+	return post, err
+}
+
+func (store *metricsStore) PostHide(ctx context.Context, id uint64, hidden bool, entry ModerationEntry) (post Post, err error) {
+	defer store.observe("PostHide", time.Now(), &err)
+	if post, err = store.Store.PostHide(ctx, id, hidden, entry); err == nil {
+		store.metrics.moderationActions.WithLabelValues(entry.Action).Inc()
+	}
+	return post, err
+}
+
+func (store *metricsStore) PostHistory(ctx context.Context, id uint64) (edits []PostEdit, err error) {
+	defer store.observe("PostHistory", time.Now(), &err)
+	return store.Store.PostHistory(ctx, id)
+}
+
+func (store *metricsStore) Search(ctx context.Context, filter SearchFilter) (results []SearchResult, err error) {
+	defer store.observe("Search", time.Now(), &err)
+	return store.Store.Search(ctx, filter)
+}
+
+func (store *metricsStore) Subscribe(ctx context.Context, threadId uint32) (events <-chan ThreadEvent, err error) {
+	defer store.observe("Subscribe", time.Now(), &err)
+	return store.Store.Subscribe(ctx, threadId)
+}
+
+func (store *metricsStore) ServiceClear(ctx context.Context) (err error) {
+	defer store.observe("ServiceClear", time.Now(), &err)
+	return store.Store.ServiceClear(ctx)
+}
+
+func (store *metricsStore) ServiceStatus(ctx context.Context) (status Status, err error) {
+	defer store.observe("ServiceStatus", time.Now(), &err)
+	return store.Store.ServiceStatus(ctx)
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"github.com/lib/pq"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+//go:embed settings/*.sql
+var settingsFiles embed.FS
+
+// Версия схемы, которую создавал db.sql до появления миграций: такая база принимается как уже мигрированная.
+const legacySchemaVersion = 3
+
+// Ключ pg_advisory_xact_lock: миграции с нескольких экземпляров сервера выполняются по очереди.
+const migrationsLock = 7236571
+
+// Таблицы, режим хранения которых (LOGGED/UNLOGGED) задаётся профилем, в порядке внешних ключей:
+// SET LOGGED требует, чтобы таблицы, на которые ссылается таблица, уже были LOGGED, SET UNLOGGED - наоборот.
+var profileTables = []string{"profile", "forum", "thread", "post", "vote", "forum_user", "post_revision",
+	"profile_session", "forum_moderator", "forum_ban", "moderation_log", "profile_suspension"}
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (migration Migration) String() string {
+	return fmt.Sprintf("%04d_%s", migration.Version, migration.Name)
+}
+
+// Миграции нумеруются подряд с 1, у каждой есть up- и down-файл.
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migrations: unexpected file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migrations: version %d has two names: %s and %s", version, migration.Name, match[2])
+		}
+
+		content, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("migrations: version %d is missing", i+1)
+		}
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migrations: %s must have both up and down files", migration)
+		}
+	}
+	return migrations, nil
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func (migrator *Migrator) Latest() int {
+	return len(migrator.migrations)
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Текущая версия схемы. База без schema_migrations, но с таблицами из db.sql, считается базой версии
+// legacySchemaVersion (recorded = false: версия ещё не записана в schema_migrations, это сделает step).
+func (migrator *Migrator) version(ctx context.Context, db queryer) (version int, recorded bool, err error) {
+	var migrationsTable, profileTable sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations')::TEXT, to_regclass('profile')::TEXT;").
+		Scan(&migrationsTable, &profileTable); err != nil {
+		return 0, false, err
+	}
+	if !migrationsTable.Valid {
+		if profileTable.Valid {
+			return legacySchemaVersion, false, nil
+		}
+		return 0, false, nil
+	}
+
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(schema_migrations.version), 0) FROM schema_migrations;").
+		Scan(&version)
+	return version, true, err
+}
+
+func (migrator *Migrator) Version(ctx context.Context) (int, error) {
+	version, _, err := migrator.version(ctx, migrator.db)
+	return version, err
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied *time.Time
+}
+
+func (migrator *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	version, recorded, err := migrator.version(ctx, migrator.db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	if recorded {
+		rows, err := migrator.db.QueryContext(ctx, "SELECT schema_migrations.version, schema_migrations.applied FROM schema_migrations;")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+		for rows.Next() {
+			var appliedVersion int
+			var appliedAt time.Time
+			if err := rows.Scan(&appliedVersion, &appliedAt); err != nil {
+				return nil, err
+			}
+			applied[appliedVersion] = appliedAt
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrator.migrations))
+	for _, migration := range migrator.migrations {
+		status := MigrationStatus{Migration: migration}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.Applied = &appliedAt
+		} else if !recorded && migration.Version <= version {
+			status.Applied = &time.Time{} //схема из db.sql: время применения неизвестно
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Применяет миграции до версии target (0 - до последней), каждую в отдельной транзакции.
+func (migrator *Migrator) Up(ctx context.Context, target int, applied func(Migration)) error {
+	if target == 0 {
+		target = migrator.Latest()
+	}
+	if target < 0 || target > migrator.Latest() {
+		return fmt.Errorf("migrate: unknown version %d (latest is %d)", target, migrator.Latest())
+	}
+
+	for {
+		migration, err := migrator.step(ctx, func(tx *sql.Tx, version int) (*Migration, error) {
+			if version >= target {
+				return nil, nil
+			}
+			migration := migrator.migrations[version]
+			if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+				return nil, fmt.Errorf("migrate: %s up: %w", migration, err)
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2);",
+				migration.Version, migration.Name); err != nil {
+				return nil, err
+			}
+			return &migration, nil
+		})
+		if err != nil || migration == nil {
+			return err
+		}
+		applied(*migration)
+	}
+}
+
+// Откатывает steps последних миграций, каждую в отдельной транзакции.
+func (migrator *Migrator) Down(ctx context.Context, steps int, reverted func(Migration)) error {
+	for ; steps > 0; steps-- {
+		migration, err := migrator.step(ctx, func(tx *sql.Tx, version int) (*Migration, error) {
+			if version == 0 {
+				return nil, nil
+			}
+			if version > migrator.Latest() {
+				return nil, fmt.Errorf("migrate: database version %d is newer than this binary (%d)", version, migrator.Latest())
+			}
+			migration := migrator.migrations[version-1]
+			if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+				return nil, fmt.Errorf("migrate: %s down: %w", migration, err)
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE schema_migrations.version = $1;",
+				migration.Version); err != nil {
+				return nil, err
+			}
+			return &migration, nil
+		})
+		if err != nil || migration == nil {
+			return err
+		}
+		reverted(*migration)
+	}
+	return nil
+}
+
+// Одна транзакция миграции: берёт блокировку, при необходимости создаёт schema_migrations (записывая в неё
+// схему из db.sql) и вызывает apply с текущей версией.
+func (migrator *Migrator) step(ctx context.Context, apply func(tx *sql.Tx, version int) (*Migration, error)) (*Migration, error) {
+	tx, err := migrator.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1);", migrationsLock); err != nil {
+		return nil, err
+	}
+	version, recorded, err := migrator.version(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if !recorded {
+		if _, err := tx.ExecContext(ctx, `CREATE TABLE schema_migrations (
+    version INT PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied TIMESTAMPTZ NOT NULL DEFAULT now()
+);`); err != nil {
+			return nil, err
+		}
+		for _, migration := range migrator.migrations[:version] {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2);",
+				migration.Version, migration.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	migration, err := apply(tx, version)
+	if err != nil {
+		return nil, err
+	}
+	return migration, tx.Commit()
+}
+
+// Таблицы из profileTables, режим хранения которых не соответствует профилю.
+func (migrator *Migrator) profileMismatch(ctx context.Context, db queryer, profile string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT pg_class.relname FROM pg_class WHERE pg_class.relkind = 'r' AND pg_class.relnamespace = (SELECT pg_namespace.oid FROM pg_namespace WHERE pg_namespace.nspname = current_schema()) AND pg_class.relname = ANY($1) AND (pg_class.relpersistence = 'u') != $2;",
+		pq.Array(profileTables), profile == "benchmark")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	mismatched := make(map[string]bool)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		mismatched[table] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tables := make([]string, 0, len(mismatched))
+	for _, table := range profileTables {
+		if mismatched[table] {
+			tables = append(tables, table)
+		}
+	}
+	if profile == "benchmark" {
+		for i, j := 0, len(tables)-1; i < j; i, j = i+1, j-1 {
+			tables[i], tables[j] = tables[j], tables[i]
+		}
+	}
+	return tables, nil
+}
+
+// Переводит таблицы в режим хранения профиля (ALTER TABLE ... SET LOGGED переписывает таблицу целиком).
+func (migrator *Migrator) ApplyProfile(ctx context.Context, profile string, altered func(table string)) error {
+	tx, err := migrator.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1);", migrationsLock); err != nil {
+		return err
+	}
+	tables, err := migrator.profileMismatch(ctx, tx, profile)
+	if err != nil {
+		return err
+	}
+	persistence := "LOGGED"
+	if profile == "benchmark" {
+		persistence = "UNLOGGED"
+	}
+	for _, table := range tables {
+		if _, err := tx.ExecContext(ctx, "ALTER TABLE "+pq.QuoteIdentifier(table)+" SET "+persistence+";"); err != nil {
+			return fmt.Errorf("migrate: %s SET %s: %w", table, persistence, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		altered(table)
+	}
+	return nil
+}
+
+// Записывает настройки профиля через ALTER SYSTEM (нужны права суперпользователя) и перечитывает конфигурацию.
+// Возвращает настройки, которые вступят в силу только после перезапуска PostgreSQL.
+func (migrator *Migrator) ApplySettings(ctx context.Context, profile string) ([]string, error) {
+	content, err := settingsFiles.ReadFile("settings/" + profile + ".sql")
+	if err != nil {
+		return nil, err
+	}
+	for _, statement := range sqlStatements(string(content)) { //ALTER SYSTEM нельзя выполнять в транзакции
+		if _, err := migrator.db.ExecContext(ctx, statement); err != nil {
+			return nil, fmt.Errorf("migrate: %s: %w", statement, err)
+		}
+	}
+	if _, err := migrator.db.ExecContext(ctx, "SELECT pg_reload_conf();"); err != nil {
+		return nil, err
+	}
+
+	rows, err := migrator.db.QueryContext(ctx, "SELECT pg_settings.name FROM pg_settings WHERE pg_settings.pending_restart;")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var pendingRestart []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		pendingRestart = append(pendingRestart, name)
+	}
+	return pendingRestart, rows.Err()
+}
+
+// Разбивает SQL-файл на отдельные команды (только для простых файлов без ; внутри строк).
+func sqlStatements(content string) []string {
+	var statements []string
+	var statement strings.Builder
+	for _, line := range strings.Split(content, "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			statements = append(statements, strings.TrimSpace(statement.String()))
+			statement.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(statement.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// Проверка при запуске: сервер не работает со схемой старее, чем ожидают его запросы. Возвращает также таблицы,
+// режим хранения которых не соответствует профилю (это не мешает работе, но стоит исправить через migrate up).
+func (migrator *Migrator) Check(ctx context.Context, profile string) ([]string, error) {
+	version, err := migrator.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version < migrator.Latest() {
+		return nil, fmt.Errorf("database schema version %d is behind %d: run migrate up", version, migrator.Latest())
+	}
+	return migrator.profileMismatch(ctx, migrator.db, profile)
+}
+
+// technopark_db migrate [флаги] status|up [VERSION]|down [STEPS]|settings
+func migrateCommand(name string, args []string) int {
+	config, args, err := LoadConfig(name, args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if config.Storage != "postgres" {
+		_, _ = fmt.Fprintln(os.Stderr, "migrate: only postgres storage has a schema")
+		return 2
+	}
+	if len(args) == 0 || len(args) > 2 {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: "+name+" [flags] status|up [VERSION]|down [STEPS]|settings")
+		return 2
+	}
+	number := 0
+	if len(args) == 2 {
+		if number, err = strconv.Atoi(args[1]); err != nil || number < 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "migrate: invalid number %q\n", args[1])
+			return 2
+		}
+	}
+
+	db, err := openDatabase(config.Database)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "status":
+		var statuses []MigrationStatus
+		if statuses, err = migrator.Status(ctx); err == nil {
+			for _, status := range statuses {
+				switch {
+				case status.Applied == nil:
+					fmt.Printf("%s\tpending\n", status.Migration)
+				case status.Applied.IsZero():
+					fmt.Printf("%s\tapplied (db.sql)\n", status.Migration)
+				default:
+					fmt.Printf("%s\tapplied %s\n", status.Migration, status.Applied.Format(time.RFC3339))
+				}
+			}
+		}
+	case "up":
+		err = migrator.Up(ctx, number, func(migration Migration) {
+			fmt.Printf("applied %s\n", migration)
+		})
+		if err == nil {
+			err = migrator.ApplyProfile(ctx, config.Database.Profile, func(table string) {
+				fmt.Printf("altered %s for %s profile\n", table, config.Database.Profile)
+			})
+		}
+	case "down":
+		if len(args) == 1 {
+			number = 1
+		}
+		err = migrator.Down(ctx, number, func(migration Migration) {
+			fmt.Printf("reverted %s\n", migration)
+		})
+	case "settings":
+		var pendingRestart []string
+		if pendingRestart, err = migrator.ApplySettings(ctx, config.Database.Profile); err == nil {
+			fmt.Printf("applied %s settings\n", config.Database.Profile)
+			if len(pendingRestart) > 0 {
+				fmt.Printf("restart PostgreSQL to apply: %s\n", strings.Join(pendingRestart, ", "))
+			}
+		}
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "migrate: unknown command %q\n", args[0])
+		return 2
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,10 @@
+DROP TABLE forum_user;
+DROP TABLE vote;
+DROP TABLE post;
+DROP TABLE thread;
+DROP TABLE forum;
+DROP TABLE profile;
+
+DROP TYPE voice;
+
+DROP EXTENSION IF EXISTS citext;
@@ -0,0 +1,59 @@
+CREATE EXTENSION IF NOT EXISTS citext;
+
+CREATE TYPE voice AS ENUM ('1', '-1');
+
+CREATE UNLOGGED TABLE profile (
+    id SERIAL PRIMARY KEY,
+    nickname citext COLLATE "C" NOT NULL UNIQUE,
+    about TEXT NOT NULL DEFAULT '',
+    email citext NOT NULL UNIQUE,
+    fullname TEXT NOT NULL
+);
+
+CREATE UNLOGGED TABLE forum (
+    slug citext NOT NULL PRIMARY KEY,
+    title TEXT NOT NULL,
+    profile_nickname citext NOT NULL REFERENCES profile (nickname) ON DELETE CASCADE,
+    threads INT NOT NULL DEFAULT 0,
+    posts INT NOT NULL DEFAULT 0
+);
+
+CREATE UNLOGGED TABLE thread (
+    id SERIAL PRIMARY KEY,
+    profile_nickname citext NOT NULL REFERENCES profile (nickname) ON DELETE CASCADE,
+    created TIMESTAMPTZ NOT NULL,
+    forum_slug citext NOT NULL REFERENCES forum ON DELETE CASCADE,
+    message TEXT NOT NULL,
+    slug citext UNIQUE,
+    title TEXT NOT NULL,
+    votes INT NOT NULL DEFAULT 0
+);
+
+CREATE UNLOGGED TABLE post (
+    id BIGSERIAL PRIMARY KEY,
+    profile_nickname citext NOT NULL REFERENCES profile (nickname) ON DELETE CASCADE,
+    created TIMESTAMP NOT NULL,
+    is_edited BOOLEAN NOT NULL DEFAULT FALSE,
+    message TEXT NOT NULL,
+    post_root_id BIGINT NOT NULL REFERENCES post ON DELETE CASCADE,
+    post_parent_id BIGINT REFERENCES post ON DELETE CASCADE,
+    path_ BIGINT[] NOT NULL,
+    thread_id INT NOT NULL REFERENCES thread ON DELETE CASCADE,
+    forum_slug citext NOT NULL REFERENCES forum ON DELETE CASCADE
+);
+
+CREATE UNLOGGED TABLE vote (
+    profile_id INT NOT NULL REFERENCES profile ON DELETE CASCADE,
+    thread_id INT NOT NULL REFERENCES thread ON DELETE CASCADE,
+    PRIMARY KEY (profile_id, thread_id),
+    voice voice NOT NULL
+);
+
+CREATE UNLOGGED TABLE forum_user (
+    forum_slug citext NOT NULL REFERENCES forum ON DELETE CASCADE,
+    profile_nickname citext COLLATE "C" NOT NULL REFERENCES profile (nickname) ON DELETE CASCADE,
+    PRIMARY KEY (forum_slug, profile_nickname),
+    profile_about TEXT NOT NULL,
+    profile_email citext NOT NULL REFERENCES profile (email) ON DELETE CASCADE ON UPDATE CASCADE,
+    profile_fullname TEXT NOT NULL
+);
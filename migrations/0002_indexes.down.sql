@@ -0,0 +1,18 @@
+DROP INDEX forum_user_forum_slug_idx;
+
+DROP INDEX post_thread_id_created_id_idx;
+DROP INDEX post_post_root_id_path__created_id_idx;
+DROP INDEX post_post_root_id_idx;
+DROP INDEX post_thread_id_post_root_id_id_id_idx;
+DROP INDEX post_thread_id_id_id_idx;
+DROP INDEX post_thread_id_path__created_id_idx;
+DROP INDEX post_thread_id_idx;
+
+DROP INDEX thread_forum_slug_created_idx;
+DROP INDEX thread_forum_slug_idx;
+DROP INDEX thread_slug_idx;
+
+DROP INDEX forum_slug_idx;
+
+DROP INDEX profile_email_idx;
+DROP INDEX profile_nickname_idx;
@@ -0,0 +1,26 @@
+-- Имена индексов совпадают с теми, что PostgreSQL выбирал для безымянных индексов из db.sql, чтобы схема,
+-- созданная db.sql, не отличалась от созданной миграциями.
+
+CREATE INDEX profile_nickname_idx ON profile USING hash (nickname);
+CREATE INDEX profile_email_idx ON profile USING hash (email);
+
+CREATE INDEX forum_slug_idx ON forum USING hash (slug);
+
+CREATE INDEX thread_slug_idx ON thread USING hash (slug)
+    WHERE slug IS NOT NULL;
+CREATE INDEX thread_forum_slug_idx ON thread USING hash (forum_slug);
+CREATE INDEX thread_forum_slug_created_idx ON thread (forum_slug, created);
+
+CREATE INDEX post_thread_id_idx ON post USING hash (thread_id);
+CREATE INDEX post_thread_id_path__created_id_idx ON post (thread_id, path_, created, id);
+CREATE INDEX post_thread_id_id_id_idx ON post (thread_id, id)
+    INCLUDE (id)
+    WHERE post_parent_id IS NULL;
+CREATE INDEX post_thread_id_post_root_id_id_id_idx ON post (thread_id, post_root_id, id)
+    INCLUDE (id)
+    WHERE post_parent_id IS NULL;
+CREATE INDEX post_post_root_id_idx ON post USING hash (post_root_id);
+CREATE INDEX post_post_root_id_path__created_id_idx ON post (post_root_id, path_, created, id);
+CREATE INDEX post_thread_id_created_id_idx ON post (thread_id, created, id);
+
+CREATE INDEX forum_user_forum_slug_idx ON forum_user USING hash (forum_slug);
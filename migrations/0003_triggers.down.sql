@@ -0,0 +1,19 @@
+DROP TRIGGER after_update ON vote;
+DROP FUNCTION trigger_vote_after_update();
+DROP TRIGGER after_insert ON vote;
+DROP FUNCTION trigger_vote_after_insert();
+
+DROP TRIGGER before_update ON post;
+DROP FUNCTION trigger_post_before_update();
+DROP TRIGGER after_insert ON post;
+DROP FUNCTION trigger_post_after_insert();
+DROP TRIGGER before_insert ON post;
+DROP FUNCTION trigger_post_before_insert();
+
+DROP TRIGGER after_insert ON thread;
+DROP FUNCTION trigger_thread_after_insert();
+DROP TRIGGER before_insert ON thread;
+DROP FUNCTION trigger_thread_before_insert();
+
+DROP TRIGGER after_update ON profile;
+DROP FUNCTION trigger_profile_after_update();
@@ -0,0 +1,15 @@
+DROP TRIGGER after_soft_delete ON post;
+DROP FUNCTION trigger_post_after_soft_delete();
+
+CREATE OR REPLACE FUNCTION trigger_post_before_update()
+    RETURNS TRIGGER
+AS $trigger_post_before_insert$
+BEGIN
+    NEW.is_edited := TRUE;
+    RETURN NEW;
+END;
+$trigger_post_before_insert$ LANGUAGE plpgsql;
+
+UPDATE forum SET posts = (SELECT COUNT(*) FROM post WHERE post.forum_slug = forum.slug);
+
+ALTER TABLE post DROP COLUMN deleted;
@@ -0,0 +1,29 @@
+-- Удаление поста оставляет вместо него "надгробие": текст стирается, но id, path_ и post_root_id сохраняются,
+-- чтобы не ломать дерево ответов. deleted - кто удалил пост (автор или модератор), NULL - пост не удалён.
+ALTER TABLE post ADD COLUMN deleted TEXT CHECK (deleted IN ('author', 'moderator'));
+
+CREATE OR REPLACE FUNCTION trigger_post_before_update()
+    RETURNS TRIGGER
+AS $trigger_post_before_update$
+BEGIN
+    IF NEW.deleted IS NULL THEN
+        NEW.is_edited := TRUE;
+    END IF;
+    RETURN NEW;
+END;
+$trigger_post_before_update$ LANGUAGE plpgsql;
+
+CREATE FUNCTION trigger_post_after_soft_delete()
+    RETURNS TRIGGER
+AS $trigger_post_after_soft_delete$
+BEGIN
+    UPDATE forum SET posts = posts - 1 WHERE forum.slug = NEW.forum_slug;
+    RETURN NEW;
+END;
+$trigger_post_after_soft_delete$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_soft_delete AFTER UPDATE OF deleted
+    ON post
+    FOR EACH ROW
+    WHEN (OLD.deleted IS NULL AND NEW.deleted IS NOT NULL)
+    EXECUTE PROCEDURE trigger_post_after_soft_delete();
@@ -0,0 +1 @@
+ALTER TABLE thread DROP COLUMN archived;
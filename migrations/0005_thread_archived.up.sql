@@ -0,0 +1,2 @@
+-- Архивная ветка доступна только для чтения и по умолчанию не попадает в список веток форума.
+ALTER TABLE thread ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,19 @@
+ALTER TABLE forum
+    DROP CONSTRAINT forum_profile_nickname_fkey,
+    ADD CONSTRAINT forum_profile_nickname_fkey FOREIGN KEY (profile_nickname)
+        REFERENCES profile (nickname) ON DELETE CASCADE;
+
+ALTER TABLE thread
+    DROP CONSTRAINT thread_profile_nickname_fkey,
+    ADD CONSTRAINT thread_profile_nickname_fkey FOREIGN KEY (profile_nickname)
+        REFERENCES profile (nickname) ON DELETE CASCADE;
+
+ALTER TABLE post
+    DROP CONSTRAINT post_profile_nickname_fkey,
+    ADD CONSTRAINT post_profile_nickname_fkey FOREIGN KEY (profile_nickname)
+        REFERENCES profile (nickname) ON DELETE CASCADE;
+
+ALTER TABLE forum_user
+    DROP CONSTRAINT forum_user_profile_nickname_fkey,
+    ADD CONSTRAINT forum_user_profile_nickname_fkey FOREIGN KEY (profile_nickname)
+        REFERENCES profile (nickname) ON DELETE CASCADE;
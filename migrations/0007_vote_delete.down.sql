@@ -0,0 +1,2 @@
+DROP TRIGGER after_delete ON vote;
+DROP FUNCTION trigger_vote_after_delete();
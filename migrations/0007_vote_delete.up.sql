@@ -0,0 +1,18 @@
+-- Отозванный голос удаляется из vote, thread.votes уменьшается на его значение.
+CREATE FUNCTION trigger_vote_after_delete()
+    RETURNS TRIGGER
+AS $trigger_vote_after_delete$
+BEGIN
+    IF OLD.voice = '1' THEN
+        UPDATE thread SET votes = votes - 1 WHERE thread.id = OLD.thread_id;
+    ELSE
+        UPDATE thread SET votes = votes + 1 WHERE thread.id = OLD.thread_id;
+    END IF;
+    RETURN OLD;
+END;
+$trigger_vote_after_delete$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_delete AFTER DELETE
+    ON vote
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_vote_after_delete();
@@ -0,0 +1,13 @@
+CREATE OR REPLACE FUNCTION trigger_post_after_soft_delete()
+    RETURNS TRIGGER
+AS $trigger_post_after_soft_delete$
+BEGIN
+    UPDATE forum SET posts = posts - 1 WHERE forum.slug = NEW.forum_slug;
+    RETURN NEW;
+END;
+$trigger_post_after_soft_delete$ LANGUAGE plpgsql;
+
+DROP TRIGGER after_edit ON post;
+DROP FUNCTION trigger_post_after_edit();
+
+DROP TABLE post_revision;
@@ -0,0 +1,37 @@
+-- История правок: при каждом изменении текста поста сохраняется прежний текст, автор правки и её время.
+-- При удалении поста ("надгробие") история стирается вместе с текстом.
+CREATE UNLOGGED TABLE post_revision (
+    id BIGSERIAL PRIMARY KEY,
+    post_id BIGINT NOT NULL REFERENCES post ON DELETE CASCADE,
+    profile_nickname citext COLLATE "C" NOT NULL REFERENCES profile (nickname) ON DELETE CASCADE ON UPDATE CASCADE,
+    edited TIMESTAMPTZ NOT NULL,
+    message TEXT NOT NULL
+);
+
+CREATE INDEX post_revision_post_id_id_idx ON post_revision (post_id, id);
+
+CREATE FUNCTION trigger_post_after_edit()
+    RETURNS TRIGGER
+AS $trigger_post_after_edit$
+BEGIN
+    INSERT INTO post_revision (post_id, profile_nickname, edited, message)
+        VALUES (OLD.id, NEW.profile_nickname, now(), OLD.message);
+    RETURN NEW;
+END;
+$trigger_post_after_edit$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_edit AFTER UPDATE OF message
+    ON post
+    FOR EACH ROW
+    WHEN (NEW.deleted IS NULL AND OLD.message IS DISTINCT FROM NEW.message)
+    EXECUTE PROCEDURE trigger_post_after_edit();
+
+CREATE OR REPLACE FUNCTION trigger_post_after_soft_delete()
+    RETURNS TRIGGER
+AS $trigger_post_after_soft_delete$
+BEGIN
+    UPDATE forum SET posts = posts - 1 WHERE forum.slug = NEW.forum_slug;
+    DELETE FROM post_revision WHERE post_revision.post_id = NEW.id;
+    RETURN NEW;
+END;
+$trigger_post_after_soft_delete$ LANGUAGE plpgsql;
@@ -0,0 +1,2 @@
+ALTER TABLE post DROP COLUMN tsv;
+ALTER TABLE thread DROP COLUMN tsv;
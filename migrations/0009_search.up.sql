@@ -0,0 +1,9 @@
+-- Полнотекстовый поиск: в конфигурации russian слова латиницей стеммируются как английские.
+-- В ветке заголовок важнее текста (вес A против B).
+ALTER TABLE thread ADD COLUMN tsv tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('russian', title), 'A') || setweight(to_tsvector('russian', message), 'B')
+) STORED;
+ALTER TABLE post ADD COLUMN tsv tsvector GENERATED ALWAYS AS (to_tsvector('russian', message)) STORED;
+
+CREATE INDEX thread_tsv_idx ON thread USING gin (tsv);
+CREATE INDEX post_tsv_idx ON post USING gin (tsv);
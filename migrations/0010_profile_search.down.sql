@@ -0,0 +1,2 @@
+DROP INDEX profile_fullname_trgm_idx;
+DROP INDEX profile_nickname_prefix_idx;
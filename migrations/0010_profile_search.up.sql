@@ -0,0 +1,5 @@
+-- Поиск пользователей: префикс никнейма без учёта регистра и нечёткое совпадение имени (pg_trgm).
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX profile_nickname_prefix_idx ON profile (lower(nickname::TEXT) text_pattern_ops);
+CREATE INDEX profile_fullname_trgm_idx ON profile USING gin (fullname gin_trgm_ops);
@@ -0,0 +1,2 @@
+CREATE INDEX thread_forum_slug_created_idx ON thread (forum_slug, created);
+DROP INDEX thread_forum_slug_created_id_idx;
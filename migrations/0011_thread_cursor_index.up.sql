@@ -0,0 +1,4 @@
+-- Ветки форума упорядочиваются по (created, id), чтобы курсор не пропускал и не повторял ветки с одинаковым
+-- created.
+CREATE INDEX thread_forum_slug_created_id_idx ON thread (forum_slug, created, id);
+DROP INDEX thread_forum_slug_created_idx;
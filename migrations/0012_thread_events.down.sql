@@ -0,0 +1,8 @@
+DROP TRIGGER after_vote_notify ON thread;
+DROP FUNCTION trigger_thread_after_vote_notify();
+
+DROP TRIGGER after_edit_notify ON post;
+DROP FUNCTION trigger_post_after_edit_notify();
+
+DROP TRIGGER after_insert_notify ON post;
+DROP FUNCTION trigger_post_after_insert_notify();
@@ -0,0 +1,46 @@
+-- События веток для GET /api/thread/{slug_or_id}/stream: уведомления в канале thread_events доставляются всем
+-- экземплярам сервера после коммита. В payload только идентификаторы (ограничение NOTIFY - 8000 байт), пост
+-- сервер читает сам.
+CREATE FUNCTION trigger_post_after_insert_notify()
+    RETURNS TRIGGER
+AS $trigger_post_after_insert_notify$
+BEGIN
+    PERFORM pg_notify('thread_events', json_build_object('type', 'post', 'thread', NEW.thread_id, 'id', NEW.id)::TEXT);
+    RETURN NEW;
+END;
+$trigger_post_after_insert_notify$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_insert_notify AFTER INSERT
+    ON post
+    FOR EACH ROW
+    EXECUTE PROCEDURE trigger_post_after_insert_notify();
+
+CREATE FUNCTION trigger_post_after_edit_notify()
+    RETURNS TRIGGER
+AS $trigger_post_after_edit_notify$
+BEGIN
+    PERFORM pg_notify('thread_events', json_build_object('type', 'edit', 'thread', NEW.thread_id, 'id', NEW.id)::TEXT);
+    RETURN NEW;
+END;
+$trigger_post_after_edit_notify$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_edit_notify AFTER UPDATE OF message, deleted
+    ON post
+    FOR EACH ROW
+    WHEN (OLD.message IS DISTINCT FROM NEW.message OR OLD.deleted IS DISTINCT FROM NEW.deleted)
+    EXECUTE PROCEDURE trigger_post_after_edit_notify();
+
+CREATE FUNCTION trigger_thread_after_vote_notify()
+    RETURNS TRIGGER
+AS $trigger_thread_after_vote_notify$
+BEGIN
+    PERFORM pg_notify('thread_events', json_build_object('type', 'vote', 'thread', NEW.id, 'votes', NEW.votes)::TEXT);
+    RETURN NEW;
+END;
+$trigger_thread_after_vote_notify$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_vote_notify AFTER UPDATE OF votes
+    ON thread
+    FOR EACH ROW
+    WHEN (OLD.votes != NEW.votes)
+    EXECUTE PROCEDURE trigger_thread_after_vote_notify();
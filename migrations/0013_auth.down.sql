@@ -0,0 +1,3 @@
+DROP TABLE profile_session;
+
+ALTER TABLE profile DROP COLUMN password_hash;
@@ -0,0 +1,12 @@
+-- Аутентификация: bcrypt-хеш пароля (NULL - пароль не задан) и сессии, которые выдаются при входе. Токен
+-- содержит id сессии, поэтому выход и смена пароля отзывают его сразу.
+ALTER TABLE profile ADD COLUMN password_hash TEXT;
+
+CREATE UNLOGGED TABLE profile_session (
+    id TEXT PRIMARY KEY,
+    profile_id INT NOT NULL REFERENCES profile ON DELETE CASCADE,
+    created TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX profile_session_profile_id_idx ON profile_session (profile_id);
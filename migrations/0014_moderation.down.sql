@@ -0,0 +1,15 @@
+DROP TRIGGER after_edit_notify ON post;
+
+CREATE TRIGGER after_edit_notify AFTER UPDATE OF message, deleted
+    ON post
+    FOR EACH ROW
+    WHEN (OLD.message IS DISTINCT FROM NEW.message OR OLD.deleted IS DISTINCT FROM NEW.deleted)
+    EXECUTE PROCEDURE trigger_post_after_edit_notify();
+
+ALTER TABLE thread DROP COLUMN locked;
+
+ALTER TABLE post DROP COLUMN hidden;
+
+DROP TABLE moderation_log;
+DROP TABLE forum_ban;
+DROP TABLE forum_moderator;
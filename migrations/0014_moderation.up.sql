@@ -0,0 +1,44 @@
+-- Модерация форумов: модераторы (владелец - forum.profile_nickname, остальные пользователи - участники),
+-- скрытые посты, закрытые ветки, баны и журнал действий модераторов.
+CREATE UNLOGGED TABLE forum_moderator (
+    forum_slug citext NOT NULL REFERENCES forum ON DELETE CASCADE,
+    profile_id INT NOT NULL REFERENCES profile ON DELETE CASCADE,
+    created TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (forum_slug, profile_id)
+);
+
+CREATE UNLOGGED TABLE forum_ban (
+    forum_slug citext NOT NULL REFERENCES forum ON DELETE CASCADE,
+    profile_id INT NOT NULL REFERENCES profile ON DELETE CASCADE,
+    moderator citext COLLATE "C" REFERENCES profile (nickname) ON DELETE SET NULL ON UPDATE CASCADE,
+    reason TEXT NOT NULL DEFAULT '',
+    created TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (forum_slug, profile_id)
+);
+
+CREATE UNLOGGED TABLE moderation_log (
+    id BIGSERIAL PRIMARY KEY,
+    forum_slug citext NOT NULL REFERENCES forum ON DELETE CASCADE,
+    moderator citext COLLATE "C" REFERENCES profile (nickname) ON DELETE SET NULL ON UPDATE CASCADE,
+    action TEXT NOT NULL,
+    target TEXT NOT NULL,
+    details TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    created TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX moderation_log_forum_slug_id_idx ON moderation_log (forum_slug, id);
+
+-- Скрытый пост остаётся в дереве, но текст видят только модераторы; в отличие от удаления это обратимо.
+ALTER TABLE post ADD COLUMN hidden BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- В закрытой ветке новые посты могут писать только модераторы.
+ALTER TABLE thread ADD COLUMN locked BOOLEAN NOT NULL DEFAULT FALSE;
+
+DROP TRIGGER after_edit_notify ON post;
+
+CREATE TRIGGER after_edit_notify AFTER UPDATE OF message, deleted, hidden
+    ON post
+    FOR EACH ROW
+    WHEN (OLD.message IS DISTINCT FROM NEW.message OR OLD.deleted IS DISTINCT FROM NEW.deleted OR OLD.hidden != NEW.hidden)
+    EXECUTE PROCEDURE trigger_post_after_edit_notify();
@@ -0,0 +1,3 @@
+DROP TABLE profile_suspension;
+
+ALTER TABLE forum_ban DROP COLUMN expires;
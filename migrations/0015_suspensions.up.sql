@@ -0,0 +1,11 @@
+-- Срок бана в форуме (NULL - бессрочный) и блокировки пользователей на всём сайте, которые выдают
+-- администраторы (auth.admins). Истёкшие баны и блокировки не действуют, но остаются в таблицах до снятия.
+ALTER TABLE forum_ban ADD COLUMN expires TIMESTAMPTZ;
+
+CREATE UNLOGGED TABLE profile_suspension (
+    profile_id INT PRIMARY KEY REFERENCES profile ON DELETE CASCADE,
+    moderator citext COLLATE "C" REFERENCES profile (nickname) ON DELETE SET NULL ON UPDATE CASCADE,
+    reason TEXT NOT NULL DEFAULT '',
+    created TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires TIMESTAMPTZ
+);
@@ -0,0 +1,3 @@
+DROP INDEX thread_forum_slug_pinned_idx;
+
+ALTER TABLE thread DROP COLUMN pinned;
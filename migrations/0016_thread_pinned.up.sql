@@ -0,0 +1,4 @@
+-- Закреплённые ветки выводятся в начале списка веток форума.
+ALTER TABLE thread ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX thread_forum_slug_pinned_idx ON thread (forum_slug, created, id) WHERE pinned;
@@ -0,0 +1,17 @@
+UPDATE post_revision SET profile_nickname = post.profile_nickname
+    FROM post WHERE post.id = post_revision.post_id AND post_revision.profile_nickname IS NULL;
+
+ALTER TABLE post_revision DROP CONSTRAINT post_revision_profile_nickname_fkey;
+ALTER TABLE post_revision ADD CONSTRAINT post_revision_profile_nickname_fkey FOREIGN KEY (profile_nickname)
+    REFERENCES profile (nickname) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE post_revision ALTER COLUMN profile_nickname SET NOT NULL;
+
+CREATE OR REPLACE FUNCTION trigger_post_after_edit()
+    RETURNS TRIGGER
+AS $trigger_post_after_edit$
+BEGIN
+    INSERT INTO post_revision (post_id, profile_nickname, edited, message)
+        VALUES (OLD.id, NEW.profile_nickname, now(), OLD.message);
+    RETURN NEW;
+END;
+$trigger_post_after_edit$ LANGUAGE plpgsql;
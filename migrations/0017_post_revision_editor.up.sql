@@ -0,0 +1,18 @@
+-- Автор правки - тот, кто её внёс (владелец или модератор форума может править чужие посты), а не автор поста.
+-- PostUpdate передаёт его в настройке forums.post_editor своей транзакции. Правки удалённого пользователя
+-- остаются в истории без автора.
+CREATE OR REPLACE FUNCTION trigger_post_after_edit()
+    RETURNS TRIGGER
+AS $trigger_post_after_edit$
+BEGIN
+    INSERT INTO post_revision (post_id, profile_nickname, edited, message)
+        VALUES (OLD.id, COALESCE(NULLIF(current_setting('forums.post_editor', TRUE), ''), NEW.profile_nickname),
+            now(), OLD.message);
+    RETURN NEW;
+END;
+$trigger_post_after_edit$ LANGUAGE plpgsql;
+
+ALTER TABLE post_revision ALTER COLUMN profile_nickname DROP NOT NULL;
+ALTER TABLE post_revision DROP CONSTRAINT post_revision_profile_nickname_fkey;
+ALTER TABLE post_revision ADD CONSTRAINT post_revision_profile_nickname_fkey FOREIGN KEY (profile_nickname)
+    REFERENCES profile (nickname) ON DELETE SET NULL ON UPDATE CASCADE;
@@ -0,0 +1,10 @@
+CREATE OR REPLACE FUNCTION trigger_post_before_update()
+    RETURNS TRIGGER
+AS $trigger_post_before_update$
+BEGIN
+    IF NEW.deleted IS NULL THEN
+        NEW.is_edited := TRUE;
+    END IF;
+    RETURN NEW;
+END;
+$trigger_post_before_update$ LANGUAGE plpgsql;
@@ -0,0 +1,12 @@
+-- Пост считается изменённым, только если изменился его текст: скрытие модератором, перенос ветки в другой
+-- форум и переименование автора (ON UPDATE CASCADE) тоже обновляют строку post, но правками не являются.
+CREATE OR REPLACE FUNCTION trigger_post_before_update()
+    RETURNS TRIGGER
+AS $trigger_post_before_update$
+BEGIN
+    IF NEW.deleted IS NULL AND NEW.message IS DISTINCT FROM OLD.message THEN
+        NEW.is_edited := TRUE;
+    END IF;
+    RETURN NEW;
+END;
+$trigger_post_before_update$ LANGUAGE plpgsql;
@@ -0,0 +1,9 @@
+CREATE OR REPLACE FUNCTION trigger_post_after_soft_delete()
+    RETURNS TRIGGER
+AS $trigger_post_after_soft_delete$
+BEGIN
+    UPDATE forum SET posts = posts - 1 WHERE forum.slug = NEW.forum_slug;
+    DELETE FROM post_revision WHERE post_revision.post_id = NEW.id;
+    RETURN NEW;
+END;
+$trigger_post_after_soft_delete$ LANGUAGE plpgsql;
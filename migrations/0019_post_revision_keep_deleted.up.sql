@@ -0,0 +1,13 @@
+-- Удаление поста не стирает его историю: модераторы по-прежнему видят прежние версии, а удалённый текст
+-- сохраняется последней правкой. Её автор - удаливший пост (модератора PostDelete передаёт в forums.post_editor).
+CREATE OR REPLACE FUNCTION trigger_post_after_soft_delete()
+    RETURNS TRIGGER
+AS $trigger_post_after_soft_delete$
+BEGIN
+    UPDATE forum SET posts = posts - 1 WHERE forum.slug = NEW.forum_slug;
+    INSERT INTO post_revision (post_id, profile_nickname, edited, message)
+        VALUES (OLD.id, COALESCE(NULLIF(current_setting('forums.post_editor', TRUE), ''), NEW.profile_nickname),
+            now(), OLD.message);
+    RETURN NEW;
+END;
+$trigger_post_after_soft_delete$ LANGUAGE plpgsql;
@@ -0,0 +1,2 @@
+DROP TRIGGER after_archive_notify ON thread;
+DROP FUNCTION trigger_thread_after_archive_notify();
@@ -0,0 +1,15 @@
+-- Подписчики ветки узнают о её переносе в архив, как о постах и голосах (см. 0012_thread_events).
+CREATE FUNCTION trigger_thread_after_archive_notify()
+    RETURNS TRIGGER
+AS $trigger_thread_after_archive_notify$
+BEGIN
+    PERFORM pg_notify('thread_events', json_build_object('type', 'archive', 'thread', NEW.id)::TEXT);
+    RETURN NEW;
+END;
+$trigger_thread_after_archive_notify$ LANGUAGE plpgsql;
+
+CREATE TRIGGER after_archive_notify AFTER UPDATE OF archived
+    ON thread
+    FOR EACH ROW
+    WHEN (NOT OLD.archived AND NEW.archived)
+    EXECUTE PROCEDURE trigger_thread_after_archive_notify();
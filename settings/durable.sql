@@ -0,0 +1,11 @@
+-- Безопасные настройки: значения по умолчанию для WAL и сброса на диск, размеры памяти - как в benchmark.
+
+ALTER SYSTEM RESET max_wal_senders;
+ALTER SYSTEM RESET wal_level;
+ALTER SYSTEM SET fsync = ON;
+ALTER SYSTEM SET full_page_writes = ON;
+ALTER SYSTEM SET synchronous_commit = ON;
+ALTER SYSTEM RESET archive_mode;
+ALTER SYSTEM SET shared_buffers = '400 MB';
+ALTER SYSTEM SET effective_cache_size = '1 GB';
+ALTER SYSTEM SET work_mem = '32 MB';
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func errUserNotFound(nickname string) error {
+	return NotFound("Can't find user with nickname " + nickname)
+}
+
+func errUserOwnsForums(nickname string) error {
+	return Conflict("User " + nickname + " owns forums, transfer them to another user first")
+}
+
+func errNicknameConflict(nickname string) error {
+	return Conflict("Nickname " + nickname + " is already taken")
+}
+
+func errSessionNotFound() error {
+	return Unauthorized("Invalid or expired token")
+}
+
+func errForumNotFound(slug string) error {
+	return NotFound("Can't find forum with slug " + slug)
+}
+
+func errThreadNotFound(key ThreadKey) error {
+	return NotFound("Can't find thread with " + key.String())
+}
+
+func errPostNotFound(id uint64) error {
+	return NotFound("Can't find post with id " + strconv.FormatUint(id, 10))
+}
+
+func errThreadArchived(key ThreadKey) error {
+	return Conflict("Thread with " + key.String() + " is archived")
+}
+
+func errPostDeleted(id uint64) error {
+	return Conflict("Post with id " + strconv.FormatUint(id, 10) + " was deleted")
+}
+
+func errThreadAuthorNotFound(thread Thread) error {
+	return NotFound("Can't find user with nickname " + thread.ProfileNickname + " or forum with slug " +
+		thread.ForumSlug)
+}
+
+func errPostAuthorNotFound(nickname string) error {
+	return NotFound("Can't find post author by nickname " + nickname)
+}
+
+func errPostParentConflict() error {
+	return Conflict("One of parent posts doesn't exists or it was created in another thread")
+}
+
+func errVoteNotFound(nickname string, key ThreadKey) error {
+	return NotFound("Can't find user by nickname " + nickname + " or thread by " + key.String())
+}
+
+func errThreadLocked(key ThreadKey) error {
+	return Forbidden("Thread with " + key.String() + " is locked")
+}
+
+func errPostHidden(id uint64) error {
+	return Conflict("Post with id " + strconv.FormatUint(id, 10) + " is hidden")
+}
+
+func errForumBanned(ban ForumBan) error {
+	message := "User " + ban.Nickname + " is banned from forum " + ban.Forum
+	if ban.Forum == "" {
+		message = "User " + ban.Nickname + " is suspended"
+	}
+	if ban.Expires != nil {
+		message += " until " + ban.Expires.Format(time.RFC3339)
+	}
+	if ban.Reason != "" {
+		message += ": " + ban.Reason
+	}
+	return Forbidden(message)
+}
+
+func errBanNotFound(nickname, slug string) error {
+	return NotFound("User " + nickname + " is not banned from forum " + slug)
+}
+
+func errSuspensionNotFound(nickname string) error {
+	return NotFound("User " + nickname + " is not suspended")
+}
+
+func errModeratorNotFound(nickname, slug string) error {
+	return NotFound("User " + nickname + " is not a moderator of forum " + slug)
+}
+
+func errForumOwner(nickname, slug string) error {
+	return Conflict("User " + nickname + " owns forum " + slug)
+}
+
+func errEmailConflict(nickname string) error {
+	return Conflict("This email is already registered by user " + nickname)
+}
+
+// Ветка адресуется в API либо по id, либо по slug (параметр :slug_or_id).
+type ThreadKey struct {
+	Id   uint32
+	Slug string
+}
+
+func ParseThreadKey(slugOrId string) ThreadKey {
+	if id, err := strconv.ParseUint(slugOrId, 10, 32); err == nil {
+		return ThreadKey{Id: uint32(id)}
+	}
+	return ThreadKey{Slug: slugOrId}
+}
+
+func (key ThreadKey) String() string {
+	if key.Slug == "" {
+		return "id " + strconv.FormatUint(uint64(key.Id), 10)
+	}
+	return "slug " + key.Slug
+}
+
+// Limit == 0 означает отсутствие ограничения. Закреплённые ветки в ForumGetThreads не учитываются в Limit.
+type ThreadsFilter struct {
+	Limit    int
+	Since    *time.Time
+	Cursor   *Cursor //вместо Since: строго после (created, id)
+	Desc     bool
+	Archived bool //включать ли архивные ветки
+}
+
+type UsersFilter struct {
+	Limit  int
+	Since  string
+	Cursor *Cursor //вместо Since
+	Desc   bool
+}
+
+type PostsFilter struct {
+	Limit  int
+	Since  uint64
+	Cursor *Cursor //вместо Since: (created, id), path_ или id корневого поста
+	Desc   bool
+	Sort   string //flat, tree или parent_tree
+}
+
+type ModerationFilter struct {
+	Limit int
+	Since uint64 //id записи
+	Desc  bool
+}
+
+// Поиск по заголовкам и текстам веток и текстам постов. Результаты упорядочены по релевантности, затем по дате
+// создания; Since и Desc - как в ThreadsFilter. Со Since - только по дате создания, чтобы страницы шли подряд.
+type SearchFilter struct {
+	Query  string //в синтаксисе websearch_to_tsquery
+	Forum  string
+	Author string
+	Limit  int
+	Since  *time.Time
+	Desc   bool
+}
+
+type Store interface {
+	UserCreate(ctx context.Context, profile Profile, passwordHash string) ([]Profile, error) //при конфликте возвращает уже существующих пользователей
+	UserGetOne(ctx context.Context, nickname string) (Profile, error)
+	UserUpdate(ctx context.Context, profile Profile) error
+	UserAnonymize(ctx context.Context, nickname string) (Profile, error)                 //никнейм deleted-<id>, личные данные стираются
+	UserDelete(ctx context.Context, nickname string) error                               //вместе с ветками, постами и голосами; чужие посты остаются
+	UserSearch(ctx context.Context, query string, filter UsersFilter) ([]Profile, error) //по префиксу никнейма или похожему имени
+
+	UserGetPassword(ctx context.Context, nickname string) (Profile, string, error) //bcrypt-хеш пароля; "" - пароль не задан
+	UserSetPassword(ctx context.Context, nickname, passwordHash string) error      //отзывает все сессии пользователя
+	SessionCreate(ctx context.Context, session Session) error
+	SessionGetOne(ctx context.Context, id string) (Session, error) //истёкшая сессия не находится
+	SessionDelete(ctx context.Context, id string) error
+
+	ForumCreate(ctx context.Context, forum Forum) (Forum, error) //при конфликте возвращает уже существующий форум
+	ForumGetOne(ctx context.Context, slug string) (Forum, error)
+	ForumUpdate(ctx context.Context, forum Forum) (Forum, error) //title и владелец (profile_nickname)
+	ForumDelete(ctx context.Context, slug string) error          //вместе с ветками, постами, голосами и forum_user
+	ForumGetThreads(ctx context.Context, slug string, filter ThreadsFilter) ([]Thread, error)
+	ForumGetUsers(ctx context.Context, slug string, filter UsersFilter) ([]Profile, error)
+
+	//изменения модераторов, банов, веток и постов записываются в журнал entry той же транзакцией
+	ForumGetRole(ctx context.Context, slug, nickname string) (string, error)  //owner, moderator или member
+	ForumGetModerators(ctx context.Context, slug string) ([]ForumRole, error) //владелец, затем модераторы по никнейму
+	ForumModeratorCreate(ctx context.Context, slug, nickname string, entry ModerationEntry) (ForumRole, error)
+	ForumModeratorDelete(ctx context.Context, slug, nickname string, entry ModerationEntry) error
+	ForumBanCreate(ctx context.Context, ban ForumBan, entry ModerationEntry) (ForumBan, error) //повторный бан меняет причину и срок
+	ForumBanDelete(ctx context.Context, slug, nickname string, entry ModerationEntry) error
+	ForumGetBans(ctx context.Context, slug string) ([]ForumBan, error) //действующие баны по никнейму
+	ForumGetLog(ctx context.Context, slug string, filter ModerationFilter) ([]ModerationEntry, error)
+
+	//блокировки на всём сайте - ForumBan с пустым Forum
+	SuspensionCreate(ctx context.Context, suspension ForumBan) (ForumBan, error) //повторная блокировка меняет причину и срок
+	SuspensionDelete(ctx context.Context, nickname string) error
+	SuspensionGetAll(ctx context.Context) ([]ForumBan, error) //действующие блокировки по никнейму
+	//действующие блокировки и баны в форуме перечисленных пользователей, блокировки - первыми
+	UserGetBans(ctx context.Context, forumSlug string, nicknames []string) ([]ForumBan, error)
+
+	ThreadCreate(ctx context.Context, thread Thread) (Thread, error) //при конфликте возвращает уже существующую ветку
+	ThreadGetOne(ctx context.Context, key ThreadKey) (Thread, error)
+	ThreadUpdate(ctx context.Context, thread Thread) error
+	ThreadGetPosts(ctx context.Context, thread Thread, filter PostsFilter) ([]Post, error)
+	ThreadVote(ctx context.Context, key ThreadKey, vote Vote) (Thread, error)
+	ThreadArchive(ctx context.Context, key ThreadKey, moderation *ModerationEntry) (Thread, error) //nil - автором
+	ThreadDelete(ctx context.Context, key ThreadKey) error                                         //вместе с постами и голосами
+	ThreadLock(ctx context.Context, key ThreadKey, locked bool, entry ModerationEntry) (Thread, error)
+	ThreadPin(ctx context.Context, key ThreadKey, pinned bool, entry ModerationEntry) (Thread, error)
+	ThreadMove(ctx context.Context, key ThreadKey, forumSlug string, entry ModerationEntry) (Thread, error) //вместе с постами
+
+	PostsCreate(ctx context.Context, thread Thread, posts []*Post) error
+	PostGetOne(ctx context.Context, id uint64) (Post, error)
+	PostUpdate(ctx context.Context, post Post, editor string) error                       //editor - автор правки; удалённый пост не изменяется
+	PostDelete(ctx context.Context, id uint64, moderation *ModerationEntry) (Post, error) //nil - автором; повторное удаление ничего не меняет
+	PostHide(ctx context.Context, id uint64, hidden bool, entry ModerationEntry) (Post, error)
+	PostHistory(ctx context.Context, id uint64) ([]PostEdit, error) //правки в порядке внесения
+
+	Search(ctx context.Context, filter SearchFilter) ([]SearchResult, error)
+
+	ServiceClear(ctx context.Context) error
+	ServiceStatus(ctx context.Context) (Status, error)
+
+	Subscribe(ctx context.Context, threadId uint32) (<-chan ThreadEvent, error) //события ветки до отмены ctx
+
+	Close() error //откатывает незавершённые транзакции и освобождает ресурсы
+}
+
+func (result SearchResult) created() time.Time {
+	if result.Thread != nil {
+		return result.Thread.Created
+	}
+	return result.Post.Created
+}
+
+// Объединяет найденные ветки и посты: по убыванию релевантности (без filter.Since), затем по дате создания (ветки
+// раньше постов).
+func mergeSearchResults(threads, posts []SearchResult, filter SearchFilter) []SearchResult {
+	results := append(threads, posts...)
+	sort.SliceStable(results, func(i, j int) bool {
+		if filter.Since == nil && results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		left, right := results[i].created(), results[j].created()
+		return !left.Equal(right) && left.Before(right) != filter.Desc
+	})
+	if filter.Limit > 0 && len(results) > filter.Limit {
+		results = results[:filter.Limit]
+	}
+	return results
+}
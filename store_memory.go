@@ -0,0 +1,1695 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Хранилище в памяти процесса для тестов и локальной разработки. Повторяет семантику db.sql: citext-сравнения
+// никнеймов, email и slug'ов, упорядочивание постов по path_, счётчики форумов и веток, которые в PostgreSQL
+// поддерживаются триггерами, и таблицу forum_user.
+type MemoryStore struct {
+	mutex sync.RWMutex
+
+	profiles           []*Profile //profiles[id - 1]; nil - пользователь удалён
+	profilesByNickname map[string]*Profile
+	profilesByEmail    map[string]*Profile
+	deletedProfiles    uint32
+	passwords          map[uint32]string //profile.id -> password_hash
+	sessions           map[string]*Session
+
+	forums map[string]*Forum
+
+	threads        []*Thread //threads[id - 1]; nil - ветка удалена
+	threadsBySlug  map[string]*Thread
+	deletedThreads uint32
+
+	posts         []*memoryPost //posts[id - 1]; nil - пост удалён вместе с веткой
+	postsByThread map[uint32][]*memoryPost
+	deletedPosts  uint64 //"надгробия" и посты удалённых веток
+
+	votes      map[memoryVoteKey]int8
+	forumUsers map[string]map[uint32]struct{} //forum.slug -> profile.id
+
+	moderators    map[string]map[uint32]time.Time //forum.slug -> profile.id -> created
+	bans          map[string]map[uint32]*ForumBan //forum.slug -> profile.id
+	moderationLog []*ModerationEntry              //moderationLog[id - 1]; nil - запись удалена вместе с форумом
+	suspensions   map[uint32]*ForumBan            //profile.id
+
+	events *threadEvents //не сбрасывается в clear()
+}
+
+type memoryPost struct {
+	Post
+	rootId uint64
+	path   []uint64
+	edits  []PostEdit //post_revision
+}
+
+type memoryVoteKey struct {
+	profileId uint32
+	threadId  uint32
+}
+
+func NewMemoryStore() *MemoryStore {
+	store := &MemoryStore{events: newThreadEvents()}
+	store.clear()
+	return store
+}
+
+func (store *MemoryStore) clear() {
+	store.profiles = nil
+	store.profilesByNickname = make(map[string]*Profile)
+	store.profilesByEmail = make(map[string]*Profile)
+	store.deletedProfiles = 0
+	store.passwords = make(map[uint32]string)
+	store.sessions = make(map[string]*Session)
+	store.forums = make(map[string]*Forum)
+	store.threads = nil
+	store.threadsBySlug = make(map[string]*Thread)
+	store.deletedThreads = 0
+	store.posts = nil
+	store.postsByThread = make(map[uint32][]*memoryPost)
+	store.deletedPosts = 0
+	store.votes = make(map[memoryVoteKey]int8)
+	store.forumUsers = make(map[string]map[uint32]struct{})
+	store.moderators = make(map[string]map[uint32]time.Time)
+	store.bans = make(map[string]map[uint32]*ForumBan)
+	store.moderationLog = nil
+	store.suspensions = make(map[uint32]*ForumBan)
+}
+
+// citext сравнивает значения без учёта регистра
+func citext(value string) string {
+	return strings.ToLower(value)
+}
+
+func comparePaths(left, right []uint64) int {
+	for i := 0; i < len(left) && i < len(right); i++ {
+		if left[i] < right[i] {
+			return -1
+		} else if left[i] > right[i] {
+			return 1
+		}
+	}
+	return len(left) - len(right)
+}
+
+func applyLimit(length, limit int) int {
+	if limit > 0 && limit < length {
+		return limit
+	}
+	return length
+}
+
+func (store *MemoryStore) addForumUser(forumSlug string, profile *Profile) {
+	users, ok := store.forumUsers[citext(forumSlug)]
+	if !ok {
+		users = make(map[uint32]struct{})
+		store.forumUsers[citext(forumSlug)] = users
+	}
+	users[profile.Id] = struct{}{}
+}
+
+func (store *MemoryStore) UserCreate(ctx context.Context, profile Profile, passwordHash string) ([]Profile, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	byNickname, nicknameTaken := store.profilesByNickname[citext(profile.Nickname)]
+	byEmail, emailTaken := store.profilesByEmail[citext(profile.Email)]
+	if nicknameTaken || emailTaken {
+		var existingProfiles []Profile
+		for _, existingProfile := range store.profiles {
+			if existingProfile != nil && (existingProfile == byNickname || existingProfile == byEmail) {
+				existingProfiles = append(existingProfiles, *existingProfile)
+			}
+		}
+		return existingProfiles, ErrConflict
+	}
+
+	profile.Id = uint32(len(store.profiles) + 1)
+	store.profiles = append(store.profiles, &profile)
+	store.profilesByNickname[citext(profile.Nickname)] = &profile
+	store.profilesByEmail[citext(profile.Email)] = &profile
+	if passwordHash != "" {
+		store.passwords[profile.Id] = passwordHash
+	}
+	return nil, nil
+}
+
+func (store *MemoryStore) UserGetOne(ctx context.Context, nickname string) (Profile, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return Profile{}, errUserNotFound(nickname)
+	}
+	return *profile, nil
+}
+
+func (store *MemoryStore) UserUpdate(ctx context.Context, profile Profile) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existingProfile, ok := store.profilesByNickname[citext(profile.Nickname)]
+	if !ok {
+		return errUserNotFound(profile.Nickname)
+	}
+	if byEmail, ok := store.profilesByEmail[citext(profile.Email)]; ok && byEmail != existingProfile {
+		return errEmailConflict(byEmail.Nickname)
+	}
+
+	delete(store.profilesByEmail, citext(existingProfile.Email))
+	existingProfile.About = profile.About
+	existingProfile.Email = profile.Email
+	existingProfile.Fullname = profile.Fullname
+	store.profilesByEmail[citext(existingProfile.Email)] = existingProfile
+	return nil
+}
+
+func (store *MemoryStore) UserAnonymize(ctx context.Context, nickname string) (Profile, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return Profile{}, errUserNotFound(nickname)
+	}
+	if err := store.anonymize(profile); err != nil {
+		return Profile{}, err
+	}
+	return *profile, nil
+}
+
+func (store *MemoryStore) anonymize(profile *Profile) error {
+	nickname := profile.Nickname
+	anonymous := "deleted-" + strconv.FormatUint(uint64(profile.Id), 10)
+	if other, ok := store.profilesByNickname[citext(anonymous)]; ok && other != profile {
+		return errNicknameConflict(anonymous)
+	}
+
+	delete(store.profilesByNickname, citext(profile.Nickname))
+	delete(store.profilesByEmail, citext(profile.Email))
+	profile.Nickname = anonymous
+	profile.Email = anonymous + "@deleted.invalid"
+	profile.About = ""
+	profile.Fullname = ""
+	store.profilesByNickname[citext(profile.Nickname)] = profile
+	store.profilesByEmail[citext(profile.Email)] = profile
+	delete(store.passwords, profile.Id)
+	store.deleteSessions(profile.Id)
+
+	//ON UPDATE CASCADE ссылок на profile (nickname)
+	for _, forum := range store.forums {
+		if forum.ProfileId == profile.Id {
+			forum.ProfileNickname = profile.Nickname
+		}
+	}
+	for _, thread := range store.threads {
+		if thread != nil && thread.ProfileId == profile.Id {
+			thread.ProfileNickname = profile.Nickname
+		}
+	}
+	for _, post := range store.posts {
+		if post != nil && post.ProfileId == profile.Id {
+			post.ProfileNickname = profile.Nickname
+		}
+	}
+	store.renameEditor(nickname, profile.Nickname)
+	store.renameModerator(nickname, profile.Nickname)
+	return nil
+}
+
+func (store *MemoryStore) UserDelete(ctx context.Context, nickname string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return errUserNotFound(nickname)
+	}
+	for _, forum := range store.forums {
+		if forum.ProfileId == profile.Id {
+			return errUserOwnsForums(profile.Nickname)
+		}
+	}
+
+	//ветки и посты, в которых есть посты других пользователей, остаются "надгробиями" обезличенного пользователя
+	keptThreads := make(map[uint32]struct{})
+	kept := make(map[uint64]struct{})
+	for _, thread := range store.threads {
+		if thread != nil && thread.ProfileId == profile.Id && store.threadHasOtherAuthors(thread.Id, nil, profile.Id) {
+			keptThreads[thread.Id] = struct{}{}
+		}
+	}
+	for _, post := range store.posts {
+		if post != nil && post.ProfileId == profile.Id &&
+			store.threadHasOtherAuthors(post.ThreadId, map[uint64]struct{}{post.Id: {}}, profile.Id) {
+			kept[post.Id] = struct{}{}
+		}
+	}
+	remains := len(keptThreads) > 0 || len(kept) > 0
+	if remains {
+		if err := store.anonymize(profile); err != nil {
+			return err
+		}
+	}
+
+	for voteKey, voice := range store.votes {
+		if voteKey.profileId == profile.Id {
+			store.threads[voteKey.threadId-1].Votes -= int32(voice)
+			delete(store.votes, voteKey)
+		}
+	}
+
+	forums := make(map[string]*Forum)
+	for _, thread := range store.threads {
+		if thread == nil || thread.ProfileId != profile.Id {
+			continue
+		}
+		forum := store.forums[citext(thread.ForumSlug)]
+		forums[citext(forum.Slug)] = forum
+		if _, ok := keptThreads[thread.Id]; ok {
+			thread.Message = ""
+			continue
+		}
+		forum.Posts -= store.removeThread(thread)
+		forum.Threads--
+	}
+
+	//остальные посты пользователя удаляются вместе с его же ответами на них (post_parent_id ON DELETE CASCADE)
+	removed := make(map[uint64]struct{})
+	threads := make(map[uint32]struct{})
+	for _, post := range store.posts {
+		if post == nil || post.ProfileId != profile.Id {
+			continue
+		}
+		threads[post.ThreadId] = struct{}{}
+		if _, ok := kept[post.Id]; !ok {
+			removed[post.Id] = struct{}{}
+			continue
+		}
+		post.edits = nil
+		if post.Deleted == "" { //как PostDelete
+			post.Message = ""
+			post.Deleted = "author"
+			store.forums[citext(post.ForumSlug)].Posts--
+			store.deletedPosts++
+			store.events.publish(post.ThreadId, ThreadEvent{Type: "edit", Post: post.Post})
+		}
+	}
+	for threadId := range threads {
+		forum := store.forums[citext(store.threads[threadId-1].ForumSlug)]
+		forums[citext(forum.Slug)] = forum
+		remaining := store.postsByThread[threadId][:0]
+		for _, post := range store.postsByThread[threadId] {
+			if !memoryPathContains(post.path, removed) {
+				remaining = append(remaining, post)
+				continue
+			}
+			store.posts[post.Id-1] = nil
+			if post.Deleted == "" {
+				forum.Posts--
+				store.deletedPosts++
+			}
+		}
+		store.postsByThread[threadId] = remaining
+	}
+
+	if remains {
+		for _, forum := range forums {
+			store.refreshForumUsers(forum)
+		}
+		return nil
+	}
+
+	store.profiles[profile.Id-1] = nil
+	delete(store.profilesByNickname, citext(profile.Nickname))
+	delete(store.profilesByEmail, citext(profile.Email))
+	store.deletedProfiles++
+	delete(store.passwords, profile.Id)
+	store.deleteSessions(profile.Id)
+	for _, moderators := range store.moderators {
+		delete(moderators, profile.Id)
+	}
+	for _, bans := range store.bans {
+		delete(bans, profile.Id)
+	}
+	delete(store.suspensions, profile.Id)
+	store.renameEditor(profile.Nickname, "") //ON DELETE SET NULL
+	store.renameModerator(profile.Nickname, "")
+
+	for _, forum := range forums {
+		store.refreshForumUsers(forum)
+	}
+	return nil
+}
+
+// Ссылка post_revision.profile_nickname на profile (nickname).
+func (store *MemoryStore) renameEditor(nickname, newNickname string) {
+	for _, post := range store.posts {
+		if post == nil {
+			continue
+		}
+		for i := range post.edits {
+			if post.edits[i].ProfileNickname != "" && citext(post.edits[i].ProfileNickname) == citext(nickname) {
+				post.edits[i].ProfileNickname = newNickname
+			}
+		}
+	}
+}
+
+// Ссылки forum_ban.moderator, profile_suspension.moderator и moderation_log.moderator на profile (nickname).
+func (store *MemoryStore) renameModerator(nickname, newNickname string) {
+	rename := func(bans map[uint32]*ForumBan) {
+		for _, ban := range bans {
+			if ban.Moderator != "" && citext(ban.Moderator) == citext(nickname) {
+				ban.Moderator = newNickname
+			}
+		}
+	}
+	rename(store.suspensions)
+	for _, bans := range store.bans {
+		rename(bans)
+	}
+	for _, entry := range store.moderationLog {
+		if entry != nil && entry.Moderator != "" && citext(entry.Moderator) == citext(nickname) {
+			entry.Moderator = newNickname
+		}
+	}
+}
+
+func memoryPathContains(path []uint64, ids map[uint64]struct{}) bool {
+	for _, id := range path {
+		if _, ok := ids[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Есть ли в ветке посты других пользователей (в поддеревьях постов subtrees, если они заданы).
+func (store *MemoryStore) threadHasOtherAuthors(threadId uint32, subtrees map[uint64]struct{}, profileId uint32) bool {
+	for _, post := range store.postsByThread[threadId] {
+		if post.ProfileId != profileId && (subtrees == nil || memoryPathContains(post.path, subtrees)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Пересчитывает участников форума по оставшимся в нём веткам и постам.
+func (store *MemoryStore) refreshForumUsers(forum *Forum) {
+	users := make(map[uint32]struct{})
+	for _, thread := range store.threads {
+		if thread != nil && citext(thread.ForumSlug) == citext(forum.Slug) {
+			users[thread.ProfileId] = struct{}{}
+		}
+	}
+	for _, post := range store.posts {
+		if post != nil && citext(post.ForumSlug) == citext(forum.Slug) {
+			users[post.ProfileId] = struct{}{}
+		}
+	}
+	store.forumUsers[citext(forum.Slug)] = users
+}
+
+func (store *MemoryStore) UserGetPassword(ctx context.Context, nickname string) (Profile, string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return Profile{}, "", errUserNotFound(nickname)
+	}
+	return *profile, store.passwords[profile.Id], nil
+}
+
+func (store *MemoryStore) UserSetPassword(ctx context.Context, nickname, passwordHash string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return errUserNotFound(nickname)
+	}
+	store.passwords[profile.Id] = passwordHash
+	store.deleteSessions(profile.Id)
+	return nil
+}
+
+func (store *MemoryStore) deleteSessions(profileId uint32) {
+	for id, session := range store.sessions {
+		if session.ProfileId == profileId {
+			delete(store.sessions, id)
+		}
+	}
+}
+
+func (store *MemoryStore) SessionCreate(ctx context.Context, session Session) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	for id, existing := range store.sessions {
+		if existing.ProfileId == session.ProfileId && !existing.Expires.After(now) {
+			delete(store.sessions, id)
+		}
+	}
+	store.sessions[session.Id] = &session
+	return nil
+}
+
+func (store *MemoryStore) SessionGetOne(ctx context.Context, id string) (Session, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	session, ok := store.sessions[id]
+	if !ok || !session.Expires.After(time.Now()) {
+		return Session{Id: id}, errSessionNotFound()
+	}
+	result := *session
+	result.ProfileNickname = store.profiles[session.ProfileId-1].Nickname
+	return result, nil
+}
+
+func (store *MemoryStore) SessionDelete(ctx context.Context, id string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.sessions, id)
+	return nil
+}
+
+func (store *MemoryStore) UserSearch(ctx context.Context, query string, filter UsersFilter) ([]Profile, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	//profile.nickname имеет тип citext COLLATE "C": сравнение побайтовое после приведения к нижнему регистру
+	prefix, since := citext(query), citext(filter.Since)
+	var profiles = make([]Profile, 0)
+	for _, profile := range store.profiles {
+		if profile == nil {
+			continue
+		}
+		if filter.Since != "" {
+			if !filter.Desc && citext(profile.Nickname) <= since || filter.Desc && citext(profile.Nickname) >= since {
+				continue
+			}
+		}
+		if strings.HasPrefix(citext(profile.Nickname), prefix) || wordSimilarity(query, profile.Fullname) >= 0.6 {
+			profiles = append(profiles, *profile)
+		}
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		if filter.Desc {
+			return citext(profiles[i].Nickname) > citext(profiles[j].Nickname)
+		}
+		return citext(profiles[i].Nickname) < citext(profiles[j].Nickname)
+	})
+
+	return profiles[:applyLimit(len(profiles), filter.Limit)], nil
+}
+
+// Триграммы слов как в pg_trgm: слово в нижнем регистре дополняется двумя пробелами слева и одним справа.
+func trigrams(words []string) map[string]struct{} {
+	result := make(map[string]struct{})
+	for _, word := range words {
+		runes := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(runes); i++ {
+			result[string(runes[i:i+3])] = struct{}{}
+		}
+	}
+	return result
+}
+
+func trigramWords(text string) []string {
+	return strings.FieldsFunc(citext(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Приближение word_similarity (оператор <%, порог pg_trgm.word_similarity_threshold = 0.6): наибольшее сходство
+// триграмм запроса с триграммами подряд идущих слов текста.
+func wordSimilarity(query, text string) float64 {
+	queryTrigrams := trigrams(trigramWords(query))
+	words := trigramWords(text)
+	var best float64
+	for start := range words {
+		for end := start + 1; end <= len(words); end++ {
+			extent := trigrams(words[start:end])
+			common := 0
+			for trigram := range queryTrigrams {
+				if _, ok := extent[trigram]; ok {
+					common++
+				}
+			}
+			if union := len(queryTrigrams) + len(extent) - common; union > 0 {
+				if similarity := float64(common) / float64(union); similarity > best {
+					best = similarity
+				}
+			}
+		}
+	}
+	return best
+}
+
+func (store *MemoryStore) ForumCreate(ctx context.Context, forum Forum) (Forum, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(forum.ProfileNickname)]
+	if !ok {
+		return forum, errUserNotFound(forum.ProfileNickname)
+	}
+	if existingForum, ok := store.forums[citext(forum.Slug)]; ok {
+		return Forum{
+			Slug:            existingForum.Slug,
+			Title:           existingForum.Title,
+			ProfileNickname: existingForum.ProfileNickname,
+		}, ErrConflict
+	}
+
+	forum.ProfileId = profile.Id
+	forum.ProfileNickname = profile.Nickname
+	forum.Threads = 0
+	forum.Posts = 0
+	store.forums[citext(forum.Slug)] = &forum
+	return forum, nil
+}
+
+func (store *MemoryStore) ForumGetOne(ctx context.Context, slug string) (Forum, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	forum, ok := store.forums[citext(slug)]
+	if !ok {
+		return Forum{}, errForumNotFound(slug)
+	}
+	return *forum, nil
+}
+
+func (store *MemoryStore) ForumUpdate(ctx context.Context, forum Forum) (Forum, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existingForum, ok := store.forums[citext(forum.Slug)]
+	if !ok {
+		return forum, errForumNotFound(forum.Slug)
+	}
+	profile, ok := store.profilesByNickname[citext(forum.ProfileNickname)]
+	if !ok {
+		return forum, errUserNotFound(forum.ProfileNickname)
+	}
+
+	existingForum.Title = forum.Title
+	existingForum.ProfileId = profile.Id
+	existingForum.ProfileNickname = profile.Nickname
+	return *existingForum, nil
+}
+
+func (store *MemoryStore) ForumDelete(ctx context.Context, slug string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	forum, ok := store.forums[citext(slug)]
+	if !ok {
+		return errForumNotFound(slug)
+	}
+	for _, thread := range store.threads {
+		if thread != nil && citext(thread.ForumSlug) == citext(forum.Slug) {
+			store.removeThread(thread)
+		}
+	}
+	delete(store.forumUsers, citext(forum.Slug))
+	delete(store.moderators, citext(forum.Slug))
+	delete(store.bans, citext(forum.Slug))
+	for i, entry := range store.moderationLog {
+		if entry != nil && citext(entry.Forum) == citext(forum.Slug) {
+			store.moderationLog[i] = nil
+		}
+	}
+	delete(store.forums, citext(forum.Slug))
+	return nil
+}
+
+func (store *MemoryStore) ForumGetRole(ctx context.Context, slug, nickname string) (string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	forum, ok := store.forums[citext(slug)]
+	if !ok {
+		return "", errForumNotFound(slug)
+	}
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return "member", nil
+	}
+	if forum.ProfileId == profile.Id {
+		return "owner", nil
+	}
+	if _, ok := store.moderators[citext(forum.Slug)][profile.Id]; ok {
+		return "moderator", nil
+	}
+	return "member", nil
+}
+
+func (store *MemoryStore) ForumGetModerators(ctx context.Context, slug string) ([]ForumRole, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	forum, ok := store.forums[citext(slug)]
+	if !ok {
+		return nil, errForumNotFound(slug)
+	}
+
+	roles := []ForumRole{{Nickname: forum.ProfileNickname, Role: "owner"}}
+	for profileId, created := range store.moderators[citext(forum.Slug)] {
+		if profileId == forum.ProfileId {
+			continue
+		}
+		created := created
+		roles = append(roles, ForumRole{Nickname: store.profiles[profileId-1].Nickname, Role: "moderator",
+			Created: &created})
+	}
+	sort.Slice(roles[1:], func(i, j int) bool {
+		return citext(roles[i+1].Nickname) < citext(roles[j+1].Nickname)
+	})
+	return roles, nil
+}
+
+func (store *MemoryStore) logModeration(entry ModerationEntry) {
+	entry.Id = uint64(len(store.moderationLog) + 1)
+	entry.Created = time.Now().UTC().Round(time.Microsecond)
+	if forum, ok := store.forums[citext(entry.Forum)]; ok {
+		entry.Forum = forum.Slug
+	}
+	store.moderationLog = append(store.moderationLog, &entry)
+}
+
+func (store *MemoryStore) ForumModeratorCreate(ctx context.Context, slug, nickname string, entry ModerationEntry) (ForumRole, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	forum, forumExists := store.forums[citext(slug)]
+	profile, profileExists := store.profilesByNickname[citext(nickname)]
+	if !forumExists || !profileExists {
+		return ForumRole{}, errUserNotFound(nickname)
+	}
+	if forum.ProfileId == profile.Id {
+		return ForumRole{}, errForumOwner(profile.Nickname, forum.Slug)
+	}
+
+	moderators, ok := store.moderators[citext(forum.Slug)]
+	if !ok {
+		moderators = make(map[uint32]time.Time)
+		store.moderators[citext(forum.Slug)] = moderators
+	}
+	created, ok := moderators[profile.Id]
+	if !ok {
+		created = time.Now().UTC().Round(time.Microsecond)
+		moderators[profile.Id] = created
+		store.logModeration(entry)
+	}
+	return ForumRole{Nickname: profile.Nickname, Role: "moderator", Created: &created}, nil
+}
+
+func (store *MemoryStore) ForumModeratorDelete(ctx context.Context, slug, nickname string, entry ModerationEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return errModeratorNotFound(nickname, slug)
+	}
+	if _, ok := store.moderators[citext(slug)][profile.Id]; !ok {
+		return errModeratorNotFound(nickname, slug)
+	}
+	delete(store.moderators[citext(slug)], profile.Id)
+	store.logModeration(entry)
+	return nil
+}
+
+func (store *MemoryStore) ForumBanCreate(ctx context.Context, ban ForumBan, entry ModerationEntry) (ForumBan, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(ban.Nickname)]
+	if !ok {
+		return ban, errUserNotFound(ban.Nickname)
+	}
+	forum, ok := store.forums[citext(ban.Forum)]
+	if !ok {
+		return ban, errForumNotFound(ban.Forum)
+	}
+
+	bans, ok := store.bans[citext(forum.Slug)]
+	if !ok {
+		bans = make(map[uint32]*ForumBan)
+		store.bans[citext(forum.Slug)] = bans
+	}
+	ban.ProfileId = profile.Id
+	if existingBan, ok := bans[profile.Id]; ok {
+		ban.Created = existingBan.Created
+	} else {
+		ban.Created = time.Now().UTC().Round(time.Microsecond)
+	}
+	stored := ban
+	bans[profile.Id] = &stored
+	store.logModeration(entry)
+	return ban, nil
+}
+
+func (store *MemoryStore) ForumBanDelete(ctx context.Context, slug, nickname string, entry ModerationEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return errBanNotFound(nickname, slug)
+	}
+	if _, ok := store.bans[citext(slug)][profile.Id]; !ok {
+		return errBanNotFound(nickname, slug)
+	}
+	delete(store.bans[citext(slug)], profile.Id)
+	store.logModeration(entry)
+	return nil
+}
+
+// Истёкший бан или блокировка не действует.
+func banActive(ban *ForumBan, now time.Time) bool {
+	return ban.Expires == nil || ban.Expires.After(now)
+}
+
+// Действующие баны по никнейму.
+func (store *MemoryStore) activeBans(bans map[uint32]*ForumBan) []ForumBan {
+	now := time.Now()
+	result := make([]ForumBan, 0)
+	for profileId, ban := range bans {
+		if banActive(ban, now) {
+			active := *ban
+			active.Nickname = store.profiles[profileId-1].Nickname
+			result = append(result, active)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return citext(result[i].Nickname) < citext(result[j].Nickname)
+	})
+	return result
+}
+
+func (store *MemoryStore) ForumGetBans(ctx context.Context, slug string) ([]ForumBan, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	forum, ok := store.forums[citext(slug)]
+	if !ok {
+		return nil, errForumNotFound(slug)
+	}
+	return store.activeBans(store.bans[citext(forum.Slug)]), nil
+}
+
+func (store *MemoryStore) SuspensionCreate(ctx context.Context, suspension ForumBan) (ForumBan, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(suspension.Nickname)]
+	if !ok {
+		return suspension, errUserNotFound(suspension.Nickname)
+	}
+	suspension.ProfileId = profile.Id
+	if existing, ok := store.suspensions[profile.Id]; ok {
+		suspension.Created = existing.Created
+	} else {
+		suspension.Created = time.Now().UTC().Round(time.Microsecond)
+	}
+	stored := suspension
+	store.suspensions[profile.Id] = &stored
+	return suspension, nil
+}
+
+func (store *MemoryStore) SuspensionDelete(ctx context.Context, nickname string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, ok := store.profilesByNickname[citext(nickname)]
+	if !ok {
+		return errSuspensionNotFound(nickname)
+	}
+	if _, ok := store.suspensions[profile.Id]; !ok {
+		return errSuspensionNotFound(nickname)
+	}
+	delete(store.suspensions, profile.Id)
+	return nil
+}
+
+func (store *MemoryStore) SuspensionGetAll(ctx context.Context) ([]ForumBan, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.activeBans(store.suspensions), nil
+}
+
+func (store *MemoryStore) UserGetBans(ctx context.Context, forumSlug string, nicknames []string) ([]ForumBan, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	now := time.Now()
+	var suspensions, bans []ForumBan
+	for _, nickname := range nicknames {
+		profile, ok := store.profilesByNickname[citext(nickname)]
+		if !ok {
+			continue
+		}
+		if suspension, ok := store.suspensions[profile.Id]; ok && banActive(suspension, now) {
+			result := *suspension
+			result.Nickname = profile.Nickname
+			suspensions = append(suspensions, result)
+		}
+		if ban, ok := store.bans[citext(forumSlug)][profile.Id]; ok && banActive(ban, now) {
+			result := *ban
+			result.Nickname = profile.Nickname
+			bans = append(bans, result)
+		}
+	}
+	for _, list := range [][]ForumBan{suspensions, bans} {
+		sort.Slice(list, func(i, j int) bool {
+			return citext(list[i].Nickname) < citext(list[j].Nickname)
+		})
+	}
+	return append(append(make([]ForumBan, 0, len(suspensions)+len(bans)), suspensions...), bans...), nil
+}
+
+func (store *MemoryStore) ForumGetLog(ctx context.Context, slug string, filter ModerationFilter) ([]ModerationEntry, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	forum, ok := store.forums[citext(slug)]
+	if !ok {
+		return nil, errForumNotFound(slug)
+	}
+
+	entries := make([]ModerationEntry, 0)
+	for _, entry := range store.moderationLog {
+		if entry == nil || citext(entry.Forum) != citext(forum.Slug) || filter.Since != 0 &&
+			(!filter.Desc && entry.Id <= filter.Since || filter.Desc && entry.Id >= filter.Since) {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	if filter.Desc {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return entries[:applyLimit(len(entries), filter.Limit)], nil
+}
+
+// Порядок веток форума: (created, id).
+func threadCreatedLess(thread *Thread, created time.Time, id uint64) bool {
+	if !thread.Created.Equal(created) {
+		return thread.Created.Before(created)
+	}
+	return uint64(thread.Id) < id
+}
+
+func (store *MemoryStore) ForumGetThreads(ctx context.Context, slug string, filter ThreadsFilter) ([]Thread, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	forum, ok := store.forums[citext(slug)]
+	if !ok {
+		return nil, errForumNotFound(slug)
+	}
+
+	var pinned, threads = make([]Thread, 0), make([]Thread, 0)
+	for _, thread := range store.threads {
+		if thread == nil || citext(thread.ForumSlug) != citext(forum.Slug) || thread.Archived && !filter.Archived {
+			continue
+		}
+		if thread.Pinned {
+			if filter.Cursor == nil {
+				pinned = append(pinned, *thread)
+			}
+			continue
+		}
+		if filter.Cursor != nil {
+			if threadCreatedLess(thread, *filter.Cursor.Created, filter.Cursor.Id) != filter.Desc ||
+				thread.Created.Equal(*filter.Cursor.Created) && uint64(thread.Id) == filter.Cursor.Id {
+				continue
+			}
+		} else if filter.Since != nil {
+			if !filter.Desc && thread.Created.Before(*filter.Since) ||
+				filter.Desc && thread.Created.After(*filter.Since) {
+				continue
+			}
+		}
+		threads = append(threads, *thread)
+	}
+
+	sort.Slice(threads, func(i, j int) bool {
+		return threadCreatedLess(&threads[i], threads[j].Created, uint64(threads[j].Id)) != filter.Desc
+	})
+	sort.Slice(pinned, func(i, j int) bool {
+		return threadCreatedLess(&pinned[i], pinned[j].Created, uint64(pinned[j].Id))
+	})
+
+	return append(pinned, threads[:applyLimit(len(threads), filter.Limit)]...), nil
+}
+
+func (store *MemoryStore) ForumGetUsers(ctx context.Context, slug string, filter UsersFilter) ([]Profile, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	forum, ok := store.forums[citext(slug)]
+	if !ok {
+		return nil, errForumNotFound(slug)
+	}
+
+	//forum_user.profile_nickname имеет тип citext COLLATE "C": сравнение побайтовое после приведения к нижнему регистру
+	since := citext(filter.Since)
+	if filter.Cursor != nil {
+		since = citext(filter.Cursor.Nickname)
+	}
+	var profiles = make([]Profile, 0)
+	for profileId := range store.forumUsers[citext(forum.Slug)] {
+		profile := store.profiles[profileId-1]
+		if since != "" {
+			if !filter.Desc && citext(profile.Nickname) <= since || filter.Desc && citext(profile.Nickname) >= since {
+				continue
+			}
+		}
+		profiles = append(profiles, *profile)
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		if filter.Desc {
+			return citext(profiles[i].Nickname) > citext(profiles[j].Nickname)
+		}
+		return citext(profiles[i].Nickname) < citext(profiles[j].Nickname)
+	})
+
+	return profiles[:applyLimit(len(profiles), filter.Limit)], nil
+}
+
+func (store *MemoryStore) ThreadCreate(ctx context.Context, thread Thread) (Thread, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, profileExists := store.profilesByNickname[citext(thread.ProfileNickname)]
+	forum, forumExists := store.forums[citext(thread.ForumSlug)]
+	if !profileExists || !forumExists {
+		return thread, errThreadAuthorNotFound(thread)
+	}
+	if thread.Slug != "" {
+		if existingThread, ok := store.threadsBySlug[citext(thread.Slug)]; ok {
+			conflictingThread := *existingThread
+			conflictingThread.Votes = 0
+			return conflictingThread, ErrConflict
+		}
+	}
+
+	thread.Id = uint32(len(store.threads) + 1)
+	thread.ProfileId = profile.Id
+	thread.ProfileNickname = profile.Nickname
+	thread.ForumSlug = forum.Slug
+	thread.Votes = 0
+	stored := thread
+	store.threads = append(store.threads, &stored)
+	if thread.Slug != "" {
+		store.threadsBySlug[citext(thread.Slug)] = &stored
+	}
+
+	//trigger_thread_after_insert
+	forum.Threads++
+	store.addForumUser(forum.Slug, profile)
+
+	return thread, nil
+}
+
+func (store *MemoryStore) threadGet(key ThreadKey) (*Thread, bool) {
+	if key.Slug == "" {
+		if key.Id == 0 || int(key.Id) > len(store.threads) {
+			return nil, false
+		}
+		thread := store.threads[key.Id-1]
+		return thread, thread != nil
+	}
+	thread, ok := store.threadsBySlug[citext(key.Slug)]
+	return thread, ok
+}
+
+func (store *MemoryStore) ThreadGetOne(ctx context.Context, key ThreadKey) (Thread, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	thread, ok := store.threadGet(key)
+	if !ok {
+		return Thread{}, errThreadNotFound(key)
+	}
+	return *thread, nil
+}
+
+func (store *MemoryStore) ThreadUpdate(ctx context.Context, thread Thread) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existingThread, ok := store.threadGet(ThreadKey{Id: thread.Id})
+	if !ok {
+		return errThreadNotFound(ThreadKey{Id: thread.Id})
+	}
+	existingThread.Message = thread.Message
+	existingThread.Title = thread.Title
+	return nil
+}
+
+func (store *MemoryStore) ThreadArchive(ctx context.Context, key ThreadKey, moderation *ModerationEntry) (Thread, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	thread, ok := store.threadGet(key)
+	if !ok {
+		return Thread{}, errThreadNotFound(key)
+	}
+	if !thread.Archived {
+		thread.Archived = true
+		store.events.publish(thread.Id, ThreadEvent{Type: "archive"}) //trigger_thread_after_archive_notify
+	}
+	if moderation != nil {
+		store.logModeration(*moderation)
+	}
+	return *thread, nil
+}
+
+func (store *MemoryStore) ThreadLock(ctx context.Context, key ThreadKey, locked bool, entry ModerationEntry) (Thread, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	thread, ok := store.threadGet(key)
+	if !ok {
+		return Thread{}, errThreadNotFound(key)
+	}
+	thread.Locked = locked
+	store.logModeration(entry)
+	return *thread, nil
+}
+
+func (store *MemoryStore) ThreadMove(ctx context.Context, key ThreadKey, forumSlug string, entry ModerationEntry) (Thread, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	thread, ok := store.threadGet(key)
+	if !ok {
+		return Thread{}, errThreadNotFound(key)
+	}
+	to, ok := store.forums[citext(forumSlug)]
+	if !ok {
+		return Thread{}, errForumNotFound(forumSlug)
+	}
+	from := store.forums[citext(thread.ForumSlug)]
+	if from == to {
+		return *thread, nil
+	}
+
+	thread.ForumSlug = to.Slug
+	from.Threads--
+	to.Threads++
+	for _, post := range store.postsByThread[thread.Id] {
+		post.ForumSlug = to.Slug
+		if post.Deleted == "" {
+			from.Posts--
+			to.Posts++
+		}
+	}
+	store.refreshForumUsers(from)
+	store.refreshForumUsers(to)
+	store.logModeration(entry)
+	return *thread, nil
+}
+
+func (store *MemoryStore) ThreadPin(ctx context.Context, key ThreadKey, pinned bool, entry ModerationEntry) (Thread, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	thread, ok := store.threadGet(key)
+	if !ok {
+		return Thread{}, errThreadNotFound(key)
+	}
+	thread.Pinned = pinned
+	store.logModeration(entry)
+	return *thread, nil
+}
+
+func (store *MemoryStore) ThreadDelete(ctx context.Context, key ThreadKey) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	thread, ok := store.threadGet(key)
+	if !ok {
+		return errThreadNotFound(key)
+	}
+	forum := store.forums[citext(thread.ForumSlug)]
+
+	authors := map[uint32]struct{}{thread.ProfileId: {}}
+	for _, post := range store.postsByThread[thread.Id] {
+		authors[post.ProfileId] = struct{}{}
+	}
+	forum.Posts -= store.removeThread(thread)
+	forum.Threads--
+
+	//участник форума остаётся в forum_user, только если у него есть другие ветки или посты в этом форуме
+	for _, other := range store.threads {
+		if other != nil && citext(other.ForumSlug) == citext(forum.Slug) {
+			delete(authors, other.ProfileId)
+		}
+	}
+	for _, post := range store.posts {
+		if post != nil && citext(post.ForumSlug) == citext(forum.Slug) {
+			delete(authors, post.ProfileId)
+		}
+	}
+	for profileId := range authors {
+		delete(store.forumUsers[citext(forum.Slug)], profileId)
+	}
+	return nil
+}
+
+// Удаляет ветку с постами и голосами; счётчики форума не меняет. Возвращает число удалённых постов
+// (без "надгробий", которые уже не учтены в forum.posts).
+func (store *MemoryStore) removeThread(thread *Thread) uint64 {
+	var removedPosts uint64
+	for _, post := range store.postsByThread[thread.Id] {
+		store.posts[post.Id-1] = nil
+		if post.Deleted == "" {
+			removedPosts++
+		}
+	}
+	store.deletedPosts += removedPosts
+	delete(store.postsByThread, thread.Id)
+
+	for voteKey := range store.votes {
+		if voteKey.threadId == thread.Id {
+			delete(store.votes, voteKey)
+		}
+	}
+
+	store.threads[thread.Id-1] = nil
+	if thread.Slug != "" {
+		delete(store.threadsBySlug, citext(thread.Slug))
+	}
+	store.deletedThreads++
+	return removedPosts
+}
+
+func (store *MemoryStore) ThreadGetPosts(ctx context.Context, thread Thread, filter PostsFilter) ([]Post, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	threadPosts := store.postsByThread[thread.Id]
+	var selected []*memoryPost
+	switch filter.Sort {
+	case "tree":
+		var since []uint64
+		if filter.Cursor != nil {
+			since = filter.Cursor.Path
+		} else if filter.Since != 0 {
+			post := store.postGet(filter.Since)
+			if post == nil {
+				break
+			}
+			since = post.path
+		}
+		for _, post := range threadPosts {
+			if since == nil || !filter.Desc && comparePaths(post.path, since) > 0 ||
+				filter.Desc && comparePaths(post.path, since) < 0 {
+				selected = append(selected, post)
+			}
+		}
+		sort.Slice(selected, func(i, j int) bool {
+			if order := comparePaths(selected[i].path, selected[j].path); order != 0 {
+				return order < 0 != filter.Desc
+			}
+			return memoryPostCreatedLess(selected[i], selected[j])
+		})
+		selected = selected[:applyLimit(len(selected), filter.Limit)]
+		break
+	case "parent_tree":
+		var since uint64
+		if filter.Cursor != nil {
+			since = filter.Cursor.Id
+		} else if filter.Since != 0 {
+			post := store.postGet(filter.Since)
+			if post == nil {
+				break
+			}
+			since = post.rootId
+		}
+		var roots []uint64
+		for _, post := range threadPosts {
+			if post.ParentPost != 0 {
+				continue
+			}
+			if since == 0 || !filter.Desc && post.rootId > since || filter.Desc && post.rootId < since {
+				roots = append(roots, post.Id)
+			}
+		}
+		sort.Slice(roots, func(i, j int) bool {
+			return roots[i] < roots[j] != filter.Desc
+		})
+		roots = roots[:applyLimit(len(roots), filter.Limit)]
+
+		selectedRoots := make(map[uint64]struct{}, len(roots))
+		for _, root := range roots {
+			selectedRoots[root] = struct{}{}
+		}
+		for _, post := range threadPosts {
+			if _, ok := selectedRoots[post.rootId]; ok {
+				selected = append(selected, post)
+			}
+		}
+		sort.Slice(selected, func(i, j int) bool {
+			if selected[i].rootId != selected[j].rootId {
+				return selected[i].rootId < selected[j].rootId != filter.Desc
+			}
+			if order := comparePaths(selected[i].path, selected[j].path); order != 0 {
+				return order < 0
+			}
+			return memoryPostCreatedLess(selected[i], selected[j])
+		})
+		break
+	default: //flat
+		var cursor *memoryPost
+		if filter.Cursor != nil {
+			cursor = &memoryPost{Post: Post{Id: filter.Cursor.Id, Created: *filter.Cursor.Created}}
+		}
+		for _, post := range threadPosts {
+			if cursor != nil {
+				if memoryPostCreatedLess(post, cursor) != filter.Desc || post.Id == cursor.Id {
+					continue
+				}
+			} else if filter.Since != 0 && (!filter.Desc && post.Id <= filter.Since || filter.Desc && post.Id >= filter.Since) {
+				continue
+			}
+			selected = append(selected, post)
+		}
+		sort.Slice(selected, func(i, j int) bool {
+			if !selected[i].Created.Equal(selected[j].Created) {
+				return selected[i].Created.Before(selected[j].Created) != filter.Desc
+			}
+			return selected[i].Id < selected[j].Id != filter.Desc
+		})
+		selected = selected[:applyLimit(len(selected), filter.Limit)]
+		break
+	}
+
+	var posts = make([]Post, 0, len(selected))
+	for _, post := range selected {
+		result := post.Post
+		if filter.Sort == "tree" {
+			result.Path = post.path
+		}
+		posts = append(posts, result)
+	}
+	return posts, nil
+}
+
+func memoryPostCreatedLess(left, right *memoryPost) bool {
+	if !left.Created.Equal(right.Created) {
+		return left.Created.Before(right.Created)
+	}
+	return left.Id < right.Id
+}
+
+func (store *MemoryStore) ThreadVote(ctx context.Context, key ThreadKey, vote Vote) (Thread, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	profile, profileExists := store.profilesByNickname[citext(vote.ProfileNickname)]
+	thread, threadExists := store.threadGet(key)
+	if !profileExists || !threadExists {
+		return Thread{}, errVoteNotFound(vote.ProfileNickname, key)
+	}
+	if thread.Archived {
+		return Thread{}, errThreadArchived(key)
+	}
+
+	//trigger_vote_after_insert, trigger_vote_after_update, trigger_vote_after_delete
+	voteKey := memoryVoteKey{profile.Id, thread.Id}
+	if vote.Voice != store.votes[voteKey] {
+		thread.Votes += int32(vote.Voice - store.votes[voteKey])
+		store.events.publish(thread.Id, ThreadEvent{Type: "vote", Votes: thread.Votes}) //trigger_thread_after_vote_notify
+	}
+	if vote.Voice == 0 {
+		delete(store.votes, voteKey)
+	} else {
+		store.votes[voteKey] = vote.Voice
+	}
+
+	return *thread, nil
+}
+
+func (store *MemoryStore) PostsCreate(ctx context.Context, thread Thread, posts []*Post) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Round(time.Microsecond)
+
+	//все посты создаются в одной транзакции: сначала проверяем весь пакет, затем вставляем;
+	//родителем может быть и пост, созданный раньше в этом же пакете
+	authors := make([]*Profile, len(posts))
+	firstId := uint64(len(store.posts) + 1)
+	for i, post := range posts {
+		profile, ok := store.profilesByNickname[citext(post.ProfileNickname)]
+		if !ok {
+			return errPostAuthorNotFound(post.ProfileNickname)
+		}
+		authors[i] = profile
+
+		if post.ParentPost == 0 || post.ParentPost >= firstId && post.ParentPost < firstId+uint64(i) {
+			continue
+		}
+		if parent := store.postGet(post.ParentPost); parent == nil || parent.ThreadId != thread.Id {
+			return errPostParentConflict()
+		}
+	}
+
+	forum := store.forums[citext(thread.ForumSlug)]
+	for i, post := range posts {
+		if post.Created.IsZero() {
+			post.Created = now
+		}
+		post.Id = uint64(len(store.posts) + 1)
+		post.ProfileId = authors[i].Id
+		post.ProfileNickname = authors[i].Nickname
+		post.ThreadId = thread.Id
+		post.ForumSlug = thread.ForumSlug
+		post.IsEdited = false
+
+		//trigger_post_before_insert
+		stored := &memoryPost{Post: *post}
+		if post.ParentPost != 0 {
+			parent := store.postGet(post.ParentPost)
+			stored.path = append(append(make([]uint64, 0, len(parent.path)+1), parent.path...), post.Id)
+		} else {
+			stored.path = []uint64{post.Id}
+		}
+		stored.rootId = stored.path[0]
+		store.posts = append(store.posts, stored)
+		store.postsByThread[thread.Id] = append(store.postsByThread[thread.Id], stored)
+
+		//trigger_post_after_insert
+		forum.Posts++
+		store.addForumUser(forum.Slug, authors[i])
+
+		//trigger_post_after_insert_notify
+		store.events.publish(thread.Id, ThreadEvent{Type: "post", Post: stored.Post})
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) postGet(id uint64) *memoryPost {
+	if id == 0 || id > uint64(len(store.posts)) {
+		return nil
+	}
+	return store.posts[id-1]
+}
+
+func (store *MemoryStore) PostGetOne(ctx context.Context, id uint64) (Post, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	post := store.postGet(id)
+	if post == nil {
+		return Post{}, errPostNotFound(id)
+	}
+	return post.Post, nil
+}
+
+func (store *MemoryStore) PostUpdate(ctx context.Context, post Post, editor string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	existingPost := store.postGet(post.Id)
+	if existingPost == nil {
+		return errPostNotFound(post.Id)
+	}
+	if existingPost.Deleted != "" {
+		return errPostDeleted(post.Id)
+	}
+	edited := existingPost.Message != post.Message
+	if edited { //trigger_post_after_edit
+		if profile, ok := store.profilesByNickname[citext(editor)]; ok {
+			editor = profile.Nickname
+		} else {
+			editor = existingPost.ProfileNickname
+		}
+		existingPost.edits = append(existingPost.edits, PostEdit{
+			ProfileNickname: editor,
+			Edited:          time.Now().UTC().Round(time.Microsecond),
+			Message:         existingPost.Message,
+		})
+	}
+	existingPost.Message = post.Message
+	existingPost.IsEdited = true //trigger_post_before_update
+
+	if edited { //trigger_post_after_edit_notify
+		store.events.publish(existingPost.ThreadId, ThreadEvent{Type: "edit", Post: existingPost.Post})
+	}
+	return nil
+}
+
+func (store *MemoryStore) PostDelete(ctx context.Context, id uint64, moderation *ModerationEntry) (Post, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	post := store.postGet(id)
+	if post == nil {
+		return Post{}, errPostNotFound(id)
+	}
+	if post.Deleted == "" {
+		message, editor := post.Message, post.ProfileNickname
+		post.Message = ""
+		post.Deleted = "author"
+		if moderation != nil {
+			post.Deleted = "moderator"
+			editor = moderation.Moderator
+			store.logModeration(*moderation)
+		}
+
+		//trigger_post_after_soft_delete
+		post.edits = append(post.edits, PostEdit{
+			ProfileNickname: editor,
+			Edited:          time.Now().UTC().Round(time.Microsecond),
+			Message:         message,
+		})
+		store.forums[citext(post.ForumSlug)].Posts--
+		store.deletedPosts++
+
+		//trigger_post_after_edit_notify
+		store.events.publish(post.ThreadId, ThreadEvent{Type: "edit", Post: post.Post})
+	}
+	return post.Post, nil
+}
+
+func (store *MemoryStore) PostHide(ctx context.Context, id uint64, hidden bool, entry ModerationEntry) (Post, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	post := store.postGet(id)
+	if post == nil {
+		return Post{}, errPostNotFound(id)
+	}
+	if post.Deleted != "" {
+		return Post{}, errPostDeleted(id)
+	}
+	store.logModeration(entry)
+	if post.Hidden != hidden {
+		post.Hidden = hidden
+
+		//trigger_post_after_edit_notify
+		store.events.publish(post.ThreadId, ThreadEvent{Type: "edit", Post: post.Post})
+	}
+	return post.Post, nil
+}
+
+func (store *MemoryStore) PostHistory(ctx context.Context, id uint64) ([]PostEdit, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	post := store.postGet(id)
+	if post == nil {
+		return nil, errPostNotFound(id)
+	}
+	return append([]PostEdit{}, post.edits...), nil
+}
+
+// Приближение полнотекстового поиска: слово документа подходит, если начинается со слова запроса (вместо
+// стемминга); найдены должны быть все слова запроса. Синтаксис websearch_to_tsquery не поддерживается.
+func searchTerms(query string) []string {
+	var terms []string
+	for _, token := range diffTokens(query) {
+		if term := searchWord(token); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+func searchWord(token string) string {
+	return citext(strings.TrimFunc(token, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}))
+}
+
+// Экранирование HTML, как replace в PostgresStore.Search.
+var snippetEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Возвращает число совпавших слов и фрагмент текста (до 35 слов, как ts_headline) с выделенными словами; текст
+// экранируется.
+func searchMatch(text string, terms []string, found map[string]struct{}) (int, string) {
+	tokens := diffTokens(text)
+	matches, first := 0, -1
+	highlighted := make([]string, len(tokens))
+	for i, token := range tokens {
+		highlighted[i] = snippetEscaper.Replace(token)
+		word := searchWord(token)
+		for _, term := range terms {
+			if word != "" && strings.HasPrefix(word, term) {
+				found[term] = struct{}{}
+				highlighted[i] = "<b>" + highlighted[i] + "</b>"
+				matches++
+				if first < 0 {
+					first = i
+				}
+				break
+			}
+		}
+	}
+	if first < 0 {
+		first = 0
+	}
+	start := first - 10
+	if start < 0 {
+		start = 0
+	}
+	end := start + 2*35 - 1 //слова и промежутки между ними
+	if end > len(highlighted) {
+		end = len(highlighted)
+	}
+	return matches, strings.TrimSpace(strings.Join(highlighted[start:end], ""))
+}
+
+func searchSince(created time.Time, filter SearchFilter) bool {
+	return filter.Since == nil || !filter.Desc && !created.Before(*filter.Since) ||
+		filter.Desc && !created.After(*filter.Since)
+}
+
+func (store *MemoryStore) Search(ctx context.Context, filter SearchFilter) ([]SearchResult, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	terms := searchTerms(filter.Query)
+	if len(terms) == 0 {
+		return make([]SearchResult, 0), nil
+	}
+
+	threads := make([]SearchResult, 0)
+	for _, thread := range store.threads {
+		if thread == nil || filter.Forum != "" && citext(thread.ForumSlug) != citext(filter.Forum) ||
+			filter.Author != "" && citext(thread.ProfileNickname) != citext(filter.Author) ||
+			!searchSince(thread.Created, filter) {
+			continue
+		}
+		found := make(map[string]struct{})
+		titleMatches, _ := searchMatch(thread.Title, terms, found)
+		messageMatches, _ := searchMatch(thread.Message, terms, found)
+		if len(found) < len(terms) {
+			continue
+		}
+		_, snippet := searchMatch(thread.Title+" "+thread.Message, terms, found)
+		result := *thread
+		threads = append(threads, SearchResult{
+			Thread:  &result,
+			Rank:    float32(titleMatches) + 0.4*float32(messageMatches), //веса A и B
+			Snippet: snippet,
+		})
+	}
+
+	posts := make([]SearchResult, 0)
+	for _, post := range store.posts {
+		if post == nil || post.Deleted != "" || post.Hidden ||
+			filter.Forum != "" && citext(post.ForumSlug) != citext(filter.Forum) ||
+			filter.Author != "" && citext(post.ProfileNickname) != citext(filter.Author) ||
+			!searchSince(post.Created, filter) {
+			continue
+		}
+		found := make(map[string]struct{})
+		matches, snippet := searchMatch(post.Message, terms, found)
+		if len(found) < len(terms) {
+			continue
+		}
+		result := post.Post
+		posts = append(posts, SearchResult{
+			Post:    &result,
+			Rank:    0.1 * float32(matches), //вес D по умолчанию
+			Snippet: snippet,
+		})
+	}
+
+	return mergeSearchResults(threads, posts, filter), nil
+}
+
+func (store *MemoryStore) ServiceClear(ctx context.Context) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.clear()
+	return nil
+}
+
+func (store *MemoryStore) ServiceStatus(ctx context.Context) (Status, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return Status{
+		Forum:  uint32(len(store.forums)),
+		Post:   uint64(len(store.posts)) - store.deletedPosts,
+		Thread: uint32(len(store.threads)) - store.deletedThreads,
+		User:   uint32(len(store.profiles)) - store.deletedProfiles,
+	}, nil
+}
+
+func (store *MemoryStore) Subscribe(ctx context.Context, threadId uint32) (<-chan ThreadEvent, error) {
+	return store.events.subscribe(ctx, threadId), nil
+}
+
+func (store *MemoryStore) Close() error {
+	store.events.close()
+	return nil
+}
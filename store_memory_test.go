@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Скрытие поста и перенос ветки не правят текст: isEdited остаётся false (trigger_post_before_update).
+func TestModerationKeepsPostsUnedited(t *testing.T) {
+	ctx := context.Background()
+	store := newTestHandler(t).Store
+	entry := ModerationEntry{Forum: "f1", Moderator: "alice"}
+	if _, err := store.PostHide(ctx, 1, true, entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.PostHide(ctx, 1, false, entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ThreadMove(ctx, ThreadKey{Slug: "th1"}, "f2", entry); err != nil {
+		t.Fatal(err)
+	}
+	post, err := store.PostGetOne(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.IsEdited || post.ForumSlug != "f2" {
+		t.Errorf("post after hide and move: %+v", post)
+	}
+}
+
+// Переименование автора в deleted-<id> (ON UPDATE CASCADE в post) правкой его постов не считается.
+func TestAnonymizeKeepsPostsUnedited(t *testing.T) {
+	ctx := context.Background()
+	store := newTestHandler(t).Store
+	profile, err := store.UserAnonymize(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := store.PostGetOne(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.IsEdited || post.ProfileNickname != profile.Nickname {
+		t.Errorf("post of anonymized user %s: %+v", profile.Nickname, post)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	store := newTestHandler(t).Store
+	thread, err := store.ThreadGetOne(ctx, ThreadKey{Slug: "th1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	posts := []*Post{
+		{ProfileNickname: "bob", Message: "cat cat cat", Created: created.Add(3 * time.Hour)},
+		{ProfileNickname: "bob", Message: "cat", Created: created.Add(time.Hour)},
+		{ProfileNickname: "bob", Message: "cat <script>", Created: created.Add(2 * time.Hour)},
+	}
+	if err := store.PostsCreate(ctx, thread, posts); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter SearchFilter
+		ids    []uint64
+	}{
+		{"by rank", SearchFilter{Query: "cat"}, []uint64{3, 4, 5}},
+		//страницы по since идут по дате создания и не пропускают менее релевантные результаты
+		{"since", SearchFilter{Query: "cat", Since: &created, Limit: 2}, []uint64{4, 5}},
+		{"since desc", SearchFilter{Query: "cat", Since: &posts[2].Created, Desc: true}, []uint64{5, 4}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			results, err := store.Search(ctx, test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]uint64, 0)
+			for _, result := range results {
+				ids = append(ids, result.Post.Id)
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("post ids %v, want %v", ids, test.ids)
+			}
+		})
+	}
+
+	results, err := store.Search(ctx, SearchFilter{Query: "script"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Snippet != "cat <b>&lt;script&gt;</b>" {
+		t.Errorf("results %+v, want escaped snippet", results)
+	}
+}
+
+// Посты других пользователей при полном удалении автора остаются вместе с тем, на чём они держатся.
+func TestPurgeKeepsOtherUsersPosts(t *testing.T) {
+	ctx := context.Background()
+	store := newTestHandler(t).Store
+	th1, err := store.ThreadGetOne(ctx, ThreadKey{Slug: "th1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	th2, err := store.ThreadGetOne(ctx, ThreadKey{Slug: "th2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &Post{ProfileNickname: "alice", Message: "reply", ParentPost: 1}
+	if err := store.PostsCreate(ctx, th1, []*Post{reply}); err != nil {
+		t.Fatal(err)
+	}
+	own := &Post{ProfileNickname: "bob", Message: "own", ParentPost: 2}
+	if err := store.PostsCreate(ctx, th2, []*Post{own}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UserDelete(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if post, err := store.PostGetOne(ctx, reply.Id); err != nil || post.Message != "reply" || post.ParentPost != 1 {
+		t.Errorf("reply after purge: %+v, %v", post, err)
+	}
+	if post, err := store.PostGetOne(ctx, 1); err != nil || post.Message != "" || post.Deleted != "author" ||
+		post.ProfileNickname != "deleted-2" {
+		t.Errorf("replied post after purge: %+v, %v", post, err)
+	}
+	if thread, err := store.ThreadGetOne(ctx, ThreadKey{Slug: "th1"}); err != nil || thread.Message != "" ||
+		thread.ProfileNickname != "deleted-2" {
+		t.Errorf("thread after purge: %+v, %v", thread, err)
+	}
+	if _, err := store.PostGetOne(ctx, own.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("own post after purge: %v, want not found", err)
+	}
+	if _, err := store.UserGetOne(ctx, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("user after purge: %v, want not found", err)
+	}
+	if forum, err := store.ForumGetOne(ctx, "f1"); err != nil || forum.Posts != 1 || forum.Threads != 1 {
+		t.Errorf("forum after purge: %+v, %v", forum, err)
+	}
+}
@@ -0,0 +1,1563 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PostgresStore struct {
+	db *sql.DB
+
+	//контекст транзакций: отменяется в Close, и PostgreSQL откатывает всё, что не успело закоммититься
+	transactions       context.Context
+	cancelTransactions context.CancelFunc
+
+	//LISTEN thread_events на отдельном соединении; открывается при первой подписке на события ветки
+	dsn         string
+	events      *threadEvents
+	listenMutex sync.Mutex
+	listener    *pq.Listener
+}
+
+func NewPostgresStore(db *sql.DB, dsn string) *PostgresStore {
+	transactions, cancelTransactions := context.WithCancel(context.Background())
+	return &PostgresStore{
+		db:                 db,
+		transactions:       transactions,
+		cancelTransactions: cancelTransactions,
+		dsn:                dsn,
+		events:             newThreadEvents(),
+	}
+}
+
+// Транзакция откатывается и при отмене запроса клиента (или его тайм-ауте), и при остановке сервера.
+func (store *PostgresStore) transactionContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-store.transactions.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func sqlLimit(limit int) interface{} {
+	if limit == 0 {
+		return nil
+	}
+	return limit
+}
+
+func (store *PostgresStore) UserCreate(ctx context.Context, profile Profile, passwordHash string) ([]Profile, error) {
+	_, err := store.db.ExecContext(ctx, "INSERT INTO profile (nickname, about, email, fullname, password_hash) VALUES ($1, $2, $3, $4, NULLIF($5, ''));",
+		profile.Nickname, profile.About, profile.Email, profile.Fullname, passwordHash)
+	if err == nil {
+		return nil, nil
+	}
+
+	rows, err := store.db.QueryContext(ctx, "SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE profile.nickname = $1 OR profile.email = $2;",
+		profile.Nickname, profile.Email)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var existingProfiles []Profile
+	for rows.Next() {
+		var existingProfile Profile
+		if err := rows.Scan(&existingProfile.Nickname, &existingProfile.About, &existingProfile.Email,
+			&existingProfile.Fullname); err != nil {
+			return nil, err
+		}
+		existingProfiles = append(existingProfiles, existingProfile)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return existingProfiles, ErrConflict
+}
+
+func (store *PostgresStore) UserGetOne(ctx context.Context, nickname string) (Profile, error) {
+	var profile Profile
+	if err := store.db.QueryRowContext(ctx, "SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE profile.nickname = $1;",
+		nickname).Scan(&profile.Nickname, &profile.About, &profile.Email, &profile.Fullname); err != nil {
+		if err == sql.ErrNoRows {
+			return profile, errUserNotFound(nickname)
+		}
+		return profile, err
+	}
+
+	return profile, nil
+}
+
+func (store *PostgresStore) UserUpdate(ctx context.Context, profile Profile) error {
+	var nickname string
+	err := store.db.QueryRowContext(ctx, "SELECT profile.nickname FROM profile WHERE profile.email = $1 AND profile.nickname != $2;",
+		profile.Email, profile.Nickname).Scan(&nickname)
+	if err == nil {
+		return errEmailConflict(nickname)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = store.db.ExecContext(ctx, "UPDATE profile SET about = $2, email = $3, fullname = $4 WHERE nickname = $1;",
+		profile.Nickname, profile.About, profile.Email, profile.Fullname)
+	return err
+}
+
+// Ветки, посты и голоса остаются; ссылки на никнейм обновляются каскадно (ON UPDATE CASCADE).
+func (store *PostgresStore) UserAnonymize(ctx context.Context, nickname string) (Profile, error) {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Profile{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var profile Profile
+	if err := tx.QueryRowContext(ctx, "SELECT profile.id FROM profile WHERE profile.nickname = $1 FOR UPDATE;",
+		nickname).Scan(&profile.Id); err != nil {
+		if err == sql.ErrNoRows {
+			return profile, errUserNotFound(nickname)
+		}
+		return profile, err
+	}
+	if err := anonymizeProfile(ctx, tx, &profile); err != nil {
+		return profile, err
+	}
+
+	return profile, tx.Commit()
+}
+
+func anonymizeProfile(ctx context.Context, tx *sql.Tx, profile *Profile) error {
+	if err := tx.QueryRowContext(ctx, "UPDATE profile SET nickname = 'deleted-' || profile.id, email = 'deleted-' || profile.id || '@deleted.invalid', about = '', fullname = '', password_hash = NULL WHERE profile.id = $1 RETURNING profile.nickname, profile.about, profile.email, profile.fullname;",
+		profile.Id).Scan(&profile.Nickname, &profile.About, &profile.Email, &profile.Fullname); err != nil {
+		if err, ok := err.(*pq.Error); ok && err.Code == "23505" { //unique_violation
+			return errNicknameConflict("deleted-" + strconv.FormatUint(uint64(profile.Id), 10))
+		}
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE forum_user SET profile_about = '', profile_fullname = '' WHERE forum_user.profile_nickname = $1;",
+		profile.Nickname); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM profile_session WHERE profile_session.profile_id = $1;", profile.Id)
+	return err
+}
+
+// Голоса (trigger_vote_after_delete вычитает их из thread.votes), ветки и посты удаляются вместе с ответами
+// пользователя на них, после чего счётчики затронутых форумов и forum_user пересчитываются. Посты с ответами
+// других пользователей становятся "надгробиями", у веток с их постами стирается текст; если такие остались,
+// пользователь вместо удаления обезличивается.
+func (store *PostgresStore) UserDelete(ctx context.Context, nickname string) error {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var profile Profile
+	if err := tx.QueryRowContext(ctx, "SELECT profile.id, profile.nickname FROM profile WHERE profile.nickname = $1 FOR UPDATE;",
+		nickname).Scan(&profile.Id, &profile.Nickname); err != nil {
+		if err == sql.ErrNoRows {
+			return errUserNotFound(nickname)
+		}
+		return err
+	}
+
+	var ownsForums bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM forum WHERE forum.profile_nickname = $1);",
+		profile.Nickname).Scan(&ownsForums); err != nil {
+		return err
+	}
+	if ownsForums {
+		return errUserOwnsForums(profile.Nickname)
+	}
+
+	var forums pq.StringArray
+	if err := tx.QueryRowContext(ctx, "SELECT ARRAY(SELECT forum_user.forum_slug::TEXT FROM forum_user WHERE forum_user.profile_nickname = $1);",
+		profile.Nickname).Scan(&forums); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM vote USING profile WHERE vote.profile_id = profile.id AND profile.nickname = $1;",
+		"DELETE FROM thread WHERE thread.profile_nickname = $1 AND NOT EXISTS (SELECT FROM post WHERE post.thread_id = thread.id AND post.profile_nickname != $1);",
+		"DELETE FROM post WHERE post.profile_nickname = $1 AND NOT EXISTS (SELECT FROM post AS reply WHERE reply.thread_id = post.thread_id AND reply.path_ @> ARRAY[post.id] AND reply.profile_nickname != $1);",
+		//trigger_post_after_soft_delete сохраняет удалённый текст в истории, поэтому она стирается после
+		"UPDATE post SET message = '', deleted = 'author' WHERE post.profile_nickname = $1 AND post.deleted IS NULL;",
+		"DELETE FROM post_revision USING post WHERE post_revision.post_id = post.id AND post.profile_nickname = $1;",
+		"UPDATE thread SET message = '' WHERE thread.profile_nickname = $1;",
+	} {
+		if _, err := tx.ExecContext(ctx, query, profile.Nickname); err != nil {
+			return err
+		}
+	}
+	var remains bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT FROM thread WHERE thread.profile_nickname = $1) OR EXISTS (SELECT FROM post WHERE post.profile_nickname = $1);",
+		profile.Nickname).Scan(&remains); err != nil {
+		return err
+	}
+	if remains {
+		if err := anonymizeProfile(ctx, tx, &profile); err != nil {
+			return err
+		}
+	} else if _, err := tx.ExecContext(ctx, "DELETE FROM profile WHERE profile.id = $1;", profile.Id); err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"UPDATE forum SET threads = (SELECT COUNT(*) FROM thread WHERE thread.forum_slug = forum.slug), posts = (SELECT COUNT(*) FROM post WHERE post.forum_slug = forum.slug AND post.deleted IS NULL) WHERE forum.slug = ANY($1::citext[]);",
+		`DELETE FROM forum_user WHERE forum_user.forum_slug = ANY($1::citext[]) AND NOT EXISTS (SELECT FROM thread WHERE thread.forum_slug = forum_user.forum_slug AND thread.profile_nickname COLLATE "C" = forum_user.profile_nickname) AND NOT EXISTS (SELECT FROM post WHERE post.forum_slug = forum_user.forum_slug AND post.profile_nickname COLLATE "C" = forum_user.profile_nickname);`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, forums); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *PostgresStore) UserGetPassword(ctx context.Context, nickname string) (Profile, string, error) {
+	var profile Profile
+	var passwordHash string
+	if err := store.db.QueryRowContext(ctx, "SELECT profile.id, profile.nickname, profile.about, profile.email, profile.fullname, COALESCE(profile.password_hash, '') FROM profile WHERE profile.nickname = $1;",
+		nickname).Scan(&profile.Id, &profile.Nickname, &profile.About, &profile.Email, &profile.Fullname, &passwordHash); err != nil {
+		if err == sql.ErrNoRows {
+			return profile, "", errUserNotFound(nickname)
+		}
+		return profile, "", err
+	}
+
+	return profile, passwordHash, nil
+}
+
+func (store *PostgresStore) UserSetPassword(ctx context.Context, nickname, passwordHash string) error {
+	var id uint32
+	if err := store.db.QueryRowContext(ctx, "WITH updated AS (UPDATE profile SET password_hash = $2 WHERE profile.nickname = $1 RETURNING profile.id), revoked AS (DELETE FROM profile_session USING updated WHERE profile_session.profile_id = updated.id) SELECT updated.id FROM updated;",
+		nickname, passwordHash).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return errUserNotFound(nickname)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Заодно удаляет истёкшие сессии пользователя.
+func (store *PostgresStore) SessionCreate(ctx context.Context, session Session) error {
+	_, err := store.db.ExecContext(ctx, "WITH expired AS (DELETE FROM profile_session WHERE profile_session.profile_id = $2 AND profile_session.expires <= now()) INSERT INTO profile_session (id, profile_id, expires) VALUES ($1, $2, $3);",
+		session.Id, session.ProfileId, session.Expires)
+	return err
+}
+
+func (store *PostgresStore) SessionGetOne(ctx context.Context, id string) (Session, error) {
+	session := Session{Id: id}
+	if err := store.db.QueryRowContext(ctx, "SELECT profile_session.profile_id, profile.nickname, profile_session.expires FROM profile_session JOIN profile ON profile.id = profile_session.profile_id WHERE profile_session.id = $1 AND profile_session.expires > now();",
+		id).Scan(&session.ProfileId, &session.ProfileNickname, &session.Expires); err != nil {
+		if err == sql.ErrNoRows {
+			return session, errSessionNotFound()
+		}
+		return session, err
+	}
+
+	return session, nil
+}
+
+func (store *PostgresStore) SessionDelete(ctx context.Context, id string) error {
+	_, err := store.db.ExecContext(ctx, "DELETE FROM profile_session WHERE profile_session.id = $1;", id)
+	return err
+}
+
+// Никнейм ищется по префиксу (индекс по lower(nickname)), имя - по word_similarity из pg_trgm.
+func (store *PostgresStore) UserSearch(ctx context.Context, query string, filter UsersFilter) ([]Profile, error) {
+	prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(query)) + "%"
+
+	var rows *sql.Rows
+	var err error
+	if !filter.Desc {
+		if filter.Since == "" {
+			rows, err = store.db.QueryContext(ctx, "SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE (lower(profile.nickname::TEXT) LIKE $1 OR $2 <% profile.fullname) ORDER BY profile.nickname LIMIT $3;",
+				prefix, query, sqlLimit(filter.Limit))
+		} else {
+			rows, err = store.db.QueryContext(ctx, "SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE (lower(profile.nickname::TEXT) LIKE $1 OR $2 <% profile.fullname) AND profile.nickname > $3 ORDER BY profile.nickname LIMIT $4;",
+				prefix, query, filter.Since, sqlLimit(filter.Limit))
+		}
+	} else {
+		if filter.Since == "" {
+			rows, err = store.db.QueryContext(ctx, "SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE (lower(profile.nickname::TEXT) LIKE $1 OR $2 <% profile.fullname) ORDER BY profile.nickname DESC LIMIT $3;",
+				prefix, query, sqlLimit(filter.Limit))
+		} else {
+			rows, err = store.db.QueryContext(ctx, "SELECT profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE (lower(profile.nickname::TEXT) LIKE $1 OR $2 <% profile.fullname) AND profile.nickname < $3 ORDER BY profile.nickname DESC LIMIT $4;",
+				prefix, query, filter.Since, sqlLimit(filter.Limit))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var profiles = make([]Profile, 0)
+	for rows.Next() {
+		var profile Profile
+		if err := rows.Scan(&profile.Nickname, &profile.About, &profile.Email, &profile.Fullname); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, rows.Err()
+}
+
+func (store *PostgresStore) ForumCreate(ctx context.Context, forum Forum) (Forum, error) {
+	if err := store.db.QueryRowContext(ctx, "INSERT INTO forum (slug, title, profile_nickname) SELECT $1, $2, profile.nickname FROM profile WHERE profile.nickname = $3 RETURNING forum.profile_nickname;",
+		forum.Slug, forum.Title, forum.ProfileNickname).Scan(&forum.ProfileNickname); err != nil {
+		if err == sql.ErrNoRows {
+			return forum, errUserNotFound(forum.ProfileNickname)
+		}
+		if err := store.db.QueryRowContext(ctx, "SELECT forum.slug, forum.title, forum.profile_nickname FROM forum WHERE forum.slug = $1;",
+			forum.Slug).Scan(&forum.Slug, &forum.Title, &forum.ProfileNickname); err != nil {
+			return forum, err
+		}
+		return forum, ErrConflict
+	}
+
+	return forum, nil
+}
+
+func (store *PostgresStore) ForumGetOne(ctx context.Context, slug string) (Forum, error) {
+	var forum Forum
+	if err := store.db.QueryRowContext(ctx, "SELECT forum.slug, forum.title, forum.profile_nickname, forum.threads, forum.posts FROM forum WHERE forum.slug = $1;", //"EXECUTE prepared_forum_get_one($1);", //
+		slug).Scan(&forum.Slug, &forum.Title, &forum.ProfileNickname, &forum.Threads, &forum.Posts); err != nil {
+		if err == sql.ErrNoRows {
+			return forum, errForumNotFound(slug)
+		}
+		return forum, err
+	}
+
+	return forum, nil
+}
+
+func (store *PostgresStore) ForumUpdate(ctx context.Context, forum Forum) (Forum, error) {
+	if err := store.db.QueryRowContext(ctx, "UPDATE forum SET title = $2, profile_nickname = profile.nickname FROM profile WHERE forum.slug = $1 AND profile.nickname = $3 RETURNING forum.slug, forum.title, forum.profile_nickname, forum.threads, forum.posts;",
+		forum.Slug, forum.Title, forum.ProfileNickname).Scan(&forum.Slug, &forum.Title, &forum.ProfileNickname,
+		&forum.Threads, &forum.Posts); err != nil {
+		if err == sql.ErrNoRows {
+			if _, err := store.forumGetSlug(ctx, forum.Slug); err != nil {
+				return forum, err
+			}
+			return forum, errUserNotFound(forum.ProfileNickname)
+		}
+		return forum, err
+	}
+
+	return forum, nil
+}
+
+func (store *PostgresStore) ForumDelete(ctx context.Context, slug string) error {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := tx.QueryRowContext(ctx, "SELECT forum.slug FROM forum WHERE forum.slug = $1 FOR UPDATE;",
+		slug).Scan(&slug); err != nil {
+		if err == sql.ErrNoRows {
+			return errForumNotFound(slug)
+		}
+		return err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM vote USING thread WHERE vote.thread_id = thread.id AND thread.forum_slug = $1;",
+		"DELETE FROM post WHERE post.forum_slug = $1;",
+		"DELETE FROM thread WHERE thread.forum_slug = $1;",
+		"DELETE FROM forum_user WHERE forum_user.forum_slug = $1;",
+		"DELETE FROM forum WHERE forum.slug = $1;",
+	} {
+		if _, err := tx.ExecContext(ctx, query, slug); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *PostgresStore) forumGetSlug(ctx context.Context, slug string) (string, error) {
+	if err := store.db.QueryRowContext(ctx, "SELECT forum.slug FROM forum WHERE forum.slug = $1;",
+		slug).Scan(&slug); err != nil {
+		if err == sql.ErrNoRows {
+			return slug, errForumNotFound(slug)
+		}
+		return slug, err
+	}
+	return slug, nil
+}
+
+// Закреплённые ветки - в начале первой страницы (без курсора), по (created, id) и без учёта since, desc
+// и limit; остальные - как раньше.
+func (store *PostgresStore) ForumGetThreads(ctx context.Context, slug string, filter ThreadsFilter) ([]Thread, error) {
+	slug, err := store.forumGetSlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	var threads = make([]Thread, 0)
+	var rows *sql.Rows
+	if filter.Cursor == nil {
+		rows, err = store.db.QueryContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.forum_slug = $1 AND (NOT thread.archived OR $2) AND thread.pinned ORDER BY thread.created, thread.id;",
+			slug, filter.Archived)
+		if err != nil {
+			return nil, err
+		}
+		if threads, err = scanForumThreads(rows, slug, threads); err != nil {
+			return nil, err
+		}
+	}
+
+	if !filter.Desc {
+		if filter.Cursor != nil {
+			rows, err = store.db.QueryContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.forum_slug = $1 AND (NOT thread.archived OR $5) AND NOT thread.pinned AND (thread.created, thread.id) > ($2, $3) ORDER BY thread.created, thread.id LIMIT $4;",
+				slug, *filter.Cursor.Created, filter.Cursor.Id, sqlLimit(filter.Limit), filter.Archived)
+		} else if filter.Since == nil {
+			rows, err = store.db.QueryContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.forum_slug = $1 AND (NOT thread.archived OR $3) AND NOT thread.pinned ORDER BY thread.created, thread.id LIMIT $2;",
+				slug, sqlLimit(filter.Limit), filter.Archived)
+		} else {
+			rows, err = store.db.QueryContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.forum_slug = $1 AND (NOT thread.archived OR $4) AND NOT thread.pinned AND thread.created >= $2 ORDER BY thread.created, thread.id LIMIT $3;",
+				slug, *filter.Since, sqlLimit(filter.Limit), filter.Archived)
+		}
+	} else {
+		if filter.Cursor != nil {
+			rows, err = store.db.QueryContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.forum_slug = $1 AND (NOT thread.archived OR $5) AND NOT thread.pinned AND (thread.created, thread.id) < ($2, $3) ORDER BY thread.created DESC, thread.id DESC LIMIT $4;",
+				slug, *filter.Cursor.Created, filter.Cursor.Id, sqlLimit(filter.Limit), filter.Archived)
+		} else if filter.Since == nil {
+			rows, err = store.db.QueryContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.forum_slug = $1 AND (NOT thread.archived OR $3) AND NOT thread.pinned ORDER BY thread.created DESC, thread.id DESC LIMIT $2;",
+				slug, sqlLimit(filter.Limit), filter.Archived)
+		} else {
+			rows, err = store.db.QueryContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.forum_slug = $1 AND (NOT thread.archived OR $4) AND NOT thread.pinned AND thread.created <= $2 ORDER BY thread.created DESC, thread.id DESC LIMIT $3;",
+				slug, *filter.Since, sqlLimit(filter.Limit), filter.Archived)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return scanForumThreads(rows, slug, threads)
+}
+
+// Дописывает к threads ветки форума slug из rows и закрывает rows.
+func scanForumThreads(rows *sql.Rows, slug string, threads []Thread) ([]Thread, error) {
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var thread Thread
+		var threadSlug sql.NullString
+		if err := rows.Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.Message, &threadSlug,
+			&thread.Title, &thread.Votes, &thread.Archived, &thread.Locked, &thread.Pinned); err != nil {
+			return nil, err
+		}
+
+		if threadSlug.Valid {
+			thread.Slug = threadSlug.String
+		}
+		thread.ForumSlug = slug
+
+		threads = append(threads, thread)
+	}
+
+	return threads, rows.Err()
+}
+
+func (store *PostgresStore) ForumGetUsers(ctx context.Context, slug string, filter UsersFilter) ([]Profile, error) {
+	slug, err := store.forumGetSlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	since := filter.Since
+	if filter.Cursor != nil {
+		since = filter.Cursor.Nickname
+	}
+
+	var rows *sql.Rows
+	if !filter.Desc {
+		if since == "" {
+			rows, err = store.db.QueryContext(ctx, "SELECT forum_user.profile_nickname, forum_user.profile_about, forum_user.profile_email, forum_user.profile_fullname FROM forum_user WHERE forum_user.forum_slug = $1 ORDER BY forum_user.profile_nickname LIMIT $2;",
+				slug, sqlLimit(filter.Limit))
+		} else {
+			rows, err = store.db.QueryContext(ctx, "SELECT forum_user.profile_nickname, forum_user.profile_about, forum_user.profile_email, forum_user.profile_fullname FROM forum_user WHERE forum_user.forum_slug = $1 AND forum_user.profile_nickname > $2 ORDER BY forum_user.profile_nickname LIMIT $3;",
+				slug, since, sqlLimit(filter.Limit))
+		}
+	} else {
+		if since == "" {
+			rows, err = store.db.QueryContext(ctx, "SELECT forum_user.profile_nickname, forum_user.profile_about, forum_user.profile_email, forum_user.profile_fullname FROM forum_user WHERE forum_user.forum_slug = $1 ORDER BY forum_user.profile_nickname DESC LIMIT $2;",
+				slug, sqlLimit(filter.Limit))
+		} else {
+			rows, err = store.db.QueryContext(ctx, "SELECT forum_user.profile_nickname, forum_user.profile_about, forum_user.profile_email, forum_user.profile_fullname FROM forum_user WHERE forum_user.forum_slug = $1 AND forum_user.profile_nickname < $2 ORDER BY forum_user.profile_nickname DESC LIMIT $3;",
+				slug, since, sqlLimit(filter.Limit))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var profiles = make([]Profile, 0)
+	for rows.Next() {
+		var profile Profile
+		if err := rows.Scan(&profile.Nickname, &profile.About, &profile.Email, &profile.Fullname); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, rows.Err()
+}
+
+func (store *PostgresStore) ForumGetRole(ctx context.Context, slug, nickname string) (string, error) {
+	var role string
+	if err := store.db.QueryRowContext(ctx, "SELECT CASE WHEN forum.profile_nickname = $2 THEN 'owner' WHEN EXISTS (SELECT FROM forum_moderator JOIN profile ON profile.id = forum_moderator.profile_id WHERE forum_moderator.forum_slug = forum.slug AND profile.nickname = $2) THEN 'moderator' ELSE 'member' END FROM forum WHERE forum.slug = $1;",
+		slug, nickname).Scan(&role); err != nil {
+		if err == sql.ErrNoRows {
+			return role, errForumNotFound(slug)
+		}
+		return role, err
+	}
+
+	return role, nil
+}
+
+func (store *PostgresStore) ForumGetModerators(ctx context.Context, slug string) ([]ForumRole, error) {
+	forum, err := store.ForumGetOne(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := store.db.QueryContext(ctx, "SELECT profile.nickname, forum_moderator.created FROM forum_moderator JOIN profile ON profile.id = forum_moderator.profile_id WHERE forum_moderator.forum_slug = $1 AND profile.nickname != $2::citext ORDER BY profile.nickname;",
+		forum.Slug, forum.ProfileNickname)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	roles := []ForumRole{{Nickname: forum.ProfileNickname, Role: "owner"}}
+	for rows.Next() {
+		role := ForumRole{Role: "moderator"}
+		var created time.Time
+		if err := rows.Scan(&role.Nickname, &created); err != nil {
+			return nil, err
+		}
+		role.Created = &created
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// Запись журнала модерации в транзакции самого действия.
+func logModeration(ctx context.Context, tx *sql.Tx, entry ModerationEntry) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO moderation_log (forum_slug, moderator, action, target, details, reason) VALUES ($1, $2, $3, $4, $5, $6);",
+		entry.Forum, entry.Moderator, entry.Action, entry.Target, entry.Details, entry.Reason)
+	return err
+}
+
+// Повторное назначение ничего не меняет и в журнал не записывается.
+func (store *PostgresStore) ForumModeratorCreate(ctx context.Context, slug, nickname string, entry ModerationEntry) (ForumRole, error) {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ForumRole{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var profile Profile
+	var owner bool
+	if err := tx.QueryRowContext(ctx, "SELECT profile.id, profile.nickname, forum.profile_nickname = profile.nickname FROM profile, forum WHERE profile.nickname = $2 AND forum.slug = $1;",
+		slug, nickname).Scan(&profile.Id, &profile.Nickname, &owner); err != nil {
+		if err == sql.ErrNoRows {
+			return ForumRole{}, errUserNotFound(nickname)
+		}
+		return ForumRole{}, err
+	}
+	if owner {
+		return ForumRole{}, errForumOwner(profile.Nickname, slug)
+	}
+
+	role := ForumRole{Nickname: profile.Nickname, Role: "moderator"}
+	var created time.Time
+	err = tx.QueryRowContext(ctx, "INSERT INTO forum_moderator (forum_slug, profile_id) VALUES ($1, $2) ON CONFLICT (forum_slug, profile_id) DO NOTHING RETURNING forum_moderator.created;",
+		slug, profile.Id).Scan(&created)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRowContext(ctx, "SELECT forum_moderator.created FROM forum_moderator WHERE forum_moderator.forum_slug = $1 AND forum_moderator.profile_id = $2;",
+			slug, profile.Id).Scan(&created)
+	} else if err == nil {
+		err = logModeration(ctx, tx, entry)
+	}
+	if err != nil {
+		return ForumRole{}, err
+	}
+	role.Created = &created
+
+	return role, tx.Commit()
+}
+
+func (store *PostgresStore) ForumModeratorDelete(ctx context.Context, slug, nickname string, entry ModerationEntry) error {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM forum_moderator USING profile WHERE forum_moderator.profile_id = profile.id AND forum_moderator.forum_slug = $1 AND profile.nickname = $2;",
+		slug, nickname)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return errModeratorNotFound(nickname, slug)
+	}
+	if err := logModeration(ctx, tx, entry); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *PostgresStore) ForumBanCreate(ctx context.Context, ban ForumBan, entry ModerationEntry) (ForumBan, error) {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ban, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := tx.QueryRowContext(ctx, "INSERT INTO forum_ban (forum_slug, profile_id, moderator, reason, expires) SELECT $1, profile.id, $3, $4, $5 FROM profile WHERE profile.nickname = $2 ON CONFLICT (forum_slug, profile_id) DO UPDATE SET moderator = EXCLUDED.moderator, reason = EXCLUDED.reason, expires = EXCLUDED.expires RETURNING forum_ban.profile_id, forum_ban.created;",
+		ban.Forum, ban.Nickname, ban.Moderator, ban.Reason, ban.Expires).Scan(&ban.ProfileId, &ban.Created); err != nil {
+		if err == sql.ErrNoRows {
+			return ban, errUserNotFound(ban.Nickname)
+		}
+		return ban, err
+	}
+	if err := logModeration(ctx, tx, entry); err != nil {
+		return ban, err
+	}
+
+	return ban, tx.Commit()
+}
+
+func (store *PostgresStore) ForumBanDelete(ctx context.Context, slug, nickname string, entry ModerationEntry) error {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM forum_ban USING profile WHERE forum_ban.profile_id = profile.id AND forum_ban.forum_slug = $1 AND profile.nickname = $2;",
+		slug, nickname)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return errBanNotFound(nickname, slug)
+	}
+	if err := logModeration(ctx, tx, entry); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *PostgresStore) ForumGetBans(ctx context.Context, slug string) ([]ForumBan, error) {
+	slug, err := store.forumGetSlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.queryBans(ctx, "SELECT forum_ban.profile_id, forum_ban.forum_slug, profile.nickname, COALESCE(forum_ban.moderator, ''), forum_ban.reason, forum_ban.created, forum_ban.expires FROM forum_ban JOIN profile ON profile.id = forum_ban.profile_id WHERE forum_ban.forum_slug = $1 AND (forum_ban.expires IS NULL OR forum_ban.expires > now()) ORDER BY profile.nickname;",
+		slug)
+}
+
+func (store *PostgresStore) queryBans(ctx context.Context, query string, args ...interface{}) ([]ForumBan, error) {
+	rows, err := store.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	bans := make([]ForumBan, 0)
+	for rows.Next() {
+		var ban ForumBan
+		if err := rows.Scan(&ban.ProfileId, &ban.Forum, &ban.Nickname, &ban.Moderator, &ban.Reason, &ban.Created,
+			&ban.Expires); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+
+	return bans, rows.Err()
+}
+
+func (store *PostgresStore) ForumGetLog(ctx context.Context, slug string, filter ModerationFilter) ([]ModerationEntry, error) {
+	slug, err := store.forumGetSlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+	desc, compare := "", ">"
+	if filter.Desc {
+		desc, compare = "DESC", "<"
+	}
+
+	rows, err := store.db.QueryContext(ctx, fmt.Sprintf("SELECT moderation_log.id, moderation_log.forum_slug, COALESCE(moderation_log.moderator, ''), moderation_log.action, moderation_log.target, moderation_log.details, moderation_log.reason, moderation_log.created FROM moderation_log WHERE moderation_log.forum_slug = $1 AND ($2::BIGINT = 0 OR moderation_log.id %[2]s $2) ORDER BY moderation_log.id %[1]s LIMIT $3;", desc, compare),
+		slug, filter.Since, sqlLimit(filter.Limit))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	entries := make([]ModerationEntry, 0)
+	for rows.Next() {
+		var entry ModerationEntry
+		if err := rows.Scan(&entry.Id, &entry.Forum, &entry.Moderator, &entry.Action, &entry.Target, &entry.Details,
+			&entry.Reason, &entry.Created); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (store *PostgresStore) SuspensionCreate(ctx context.Context, suspension ForumBan) (ForumBan, error) {
+	if err := store.db.QueryRowContext(ctx, "INSERT INTO profile_suspension (profile_id, moderator, reason, expires) SELECT profile.id, $2, $3, $4 FROM profile WHERE profile.nickname = $1 ON CONFLICT (profile_id) DO UPDATE SET moderator = EXCLUDED.moderator, reason = EXCLUDED.reason, expires = EXCLUDED.expires RETURNING profile_suspension.profile_id, profile_suspension.created;",
+		suspension.Nickname, suspension.Moderator, suspension.Reason, suspension.Expires).Scan(&suspension.ProfileId,
+		&suspension.Created); err != nil {
+		if err == sql.ErrNoRows {
+			return suspension, errUserNotFound(suspension.Nickname)
+		}
+		return suspension, err
+	}
+
+	return suspension, nil
+}
+
+func (store *PostgresStore) SuspensionDelete(ctx context.Context, nickname string) error {
+	result, err := store.db.ExecContext(ctx, "DELETE FROM profile_suspension USING profile WHERE profile_suspension.profile_id = profile.id AND profile.nickname = $1;",
+		nickname)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return errSuspensionNotFound(nickname)
+	}
+
+	return nil
+}
+
+func (store *PostgresStore) SuspensionGetAll(ctx context.Context) ([]ForumBan, error) {
+	return store.queryBans(ctx, "SELECT profile_suspension.profile_id, '', profile.nickname, COALESCE(profile_suspension.moderator, ''), profile_suspension.reason, profile_suspension.created, profile_suspension.expires FROM profile_suspension JOIN profile ON profile.id = profile_suspension.profile_id WHERE profile_suspension.expires IS NULL OR profile_suspension.expires > now() ORDER BY profile.nickname;")
+}
+
+func (store *PostgresStore) UserGetBans(ctx context.Context, forumSlug string, nicknames []string) ([]ForumBan, error) {
+	if len(nicknames) == 0 {
+		return make([]ForumBan, 0), nil
+	}
+
+	return store.queryBans(ctx, "SELECT profile_suspension.profile_id, ''::citext, profile.nickname, COALESCE(profile_suspension.moderator, ''), profile_suspension.reason, profile_suspension.created, profile_suspension.expires FROM profile_suspension JOIN profile ON profile.id = profile_suspension.profile_id WHERE profile.nickname = ANY($2::citext[]) AND (profile_suspension.expires IS NULL OR profile_suspension.expires > now()) UNION ALL SELECT forum_ban.profile_id, forum_ban.forum_slug, profile.nickname, COALESCE(forum_ban.moderator, ''), forum_ban.reason, forum_ban.created, forum_ban.expires FROM forum_ban JOIN profile ON profile.id = forum_ban.profile_id WHERE forum_ban.forum_slug = $1 AND profile.nickname = ANY($2::citext[]) AND (forum_ban.expires IS NULL OR forum_ban.expires > now()) ORDER BY 2, 3;",
+		forumSlug, pq.StringArray(nicknames))
+}
+
+func (store *PostgresStore) ThreadCreate(ctx context.Context, thread Thread) (Thread, error) {
+	if err := store.db.QueryRowContext(ctx, "INSERT INTO thread (profile_nickname, created, forum_slug, message, slug, title) SELECT profile.nickname, $2, forum.slug, $4, $5, $6 FROM profile, forum WHERE profile.nickname = $1 AND forum.slug = $3 RETURNING thread.id, thread.profile_nickname, thread.forum_slug;",
+		thread.ProfileNickname, thread.Created, thread.ForumSlug, thread.Message, thread.Slug, thread.Title).
+		Scan(&thread.Id, &thread.ProfileNickname, &thread.ForumSlug); err != nil {
+		if err == sql.ErrNoRows {
+			return thread, errThreadAuthorNotFound(thread)
+		}
+		if err := store.db.QueryRowContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title FROM thread WHERE thread.slug = $1;",
+			thread.Slug).Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
+			&thread.Slug, &thread.Title); err != nil {
+			return thread, err
+		}
+		return thread, ErrConflict
+	}
+
+	return thread, nil
+}
+
+func (store *PostgresStore) ThreadGetOne(ctx context.Context, key ThreadKey) (Thread, error) {
+	var thread Thread
+	var threadSlug sql.NullString
+	var row *sql.Row
+	if key.Slug == "" {
+		row = store.db.QueryRowContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.id = $1;",
+			key.Id)
+	} else {
+		row = store.db.QueryRowContext(ctx, "SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned FROM thread WHERE thread.slug = $1;",
+			key.Slug)
+	}
+	if err := row.Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
+		&threadSlug, &thread.Title, &thread.Votes, &thread.Archived, &thread.Locked, &thread.Pinned); err != nil {
+		if err == sql.ErrNoRows {
+			return thread, errThreadNotFound(key)
+		}
+		return thread, err
+	}
+
+	if threadSlug.Valid {
+		thread.Slug = threadSlug.String
+	}
+
+	return thread, nil
+}
+
+func (store *PostgresStore) ThreadUpdate(ctx context.Context, thread Thread) error {
+	_, err := store.db.ExecContext(ctx, "UPDATE thread SET message = $2, title = $3 WHERE id = $1;",
+		thread.Id, thread.Message, thread.Title)
+	return err
+}
+
+// Событие archive рассылает trigger_thread_after_archive_notify.
+func (store *PostgresStore) ThreadArchive(ctx context.Context, key ThreadKey, moderation *ModerationEntry) (Thread, error) {
+	if moderation != nil {
+		return store.threadSetFlag(ctx, key, "UPDATE thread SET archived = $2 WHERE thread.id = $1 RETURNING thread.id;",
+			"UPDATE thread SET archived = $2 WHERE thread.slug = $1 RETURNING thread.id;", true, *moderation)
+	}
+
+	var err error
+	if key.Slug == "" {
+		_, err = store.db.ExecContext(ctx, "UPDATE thread SET archived = TRUE WHERE id = $1;", key.Id)
+	} else {
+		_, err = store.db.ExecContext(ctx, "UPDATE thread SET archived = TRUE WHERE slug = $1;", key.Slug)
+	}
+	if err != nil {
+		return Thread{}, err
+	}
+	return store.ThreadGetOne(ctx, key)
+}
+
+// Посты и голоса удаляются каскадно; счётчики форума и forum_user, которые при вставке поддерживаются
+// триггерами, пересчитываются здесь же в транзакции.
+func (store *PostgresStore) ThreadDelete(ctx context.Context, key ThreadKey) error {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var row *sql.Row
+	if key.Slug == "" {
+		row = tx.QueryRowContext(ctx, "SELECT thread.id, thread.forum_slug FROM thread WHERE thread.id = $1 FOR UPDATE;",
+			key.Id)
+	} else {
+		row = tx.QueryRowContext(ctx, "SELECT thread.id, thread.forum_slug FROM thread WHERE thread.slug = $1 FOR UPDATE;",
+			key.Slug)
+	}
+	var thread Thread
+	if err := row.Scan(&thread.Id, &thread.ForumSlug); err != nil {
+		if err == sql.ErrNoRows {
+			return errThreadNotFound(key)
+		}
+		return err
+	}
+
+	var authors pq.StringArray
+	if err := tx.QueryRowContext(ctx, "SELECT ARRAY(SELECT thread.profile_nickname::TEXT FROM thread WHERE thread.id = $1 UNION SELECT post.profile_nickname::TEXT FROM post WHERE post.thread_id = $1);",
+		thread.Id).Scan(&authors); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE forum SET threads = threads - 1, posts = posts - (SELECT COUNT(*) FROM post WHERE post.thread_id = $1 AND post.deleted IS NULL) WHERE forum.slug = $2;",
+		thread.Id, thread.ForumSlug); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM thread WHERE thread.id = $1;", thread.Id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM forum_user WHERE forum_user.forum_slug = $1 AND forum_user.profile_nickname = ANY($2::citext[]) AND NOT EXISTS (SELECT FROM thread WHERE thread.forum_slug = $1 AND thread.profile_nickname COLLATE "C" = forum_user.profile_nickname) AND NOT EXISTS (SELECT FROM post WHERE post.forum_slug = $1 AND post.profile_nickname COLLATE "C" = forum_user.profile_nickname);`,
+		thread.ForumSlug, authors); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *PostgresStore) ThreadLock(ctx context.Context, key ThreadKey, locked bool, entry ModerationEntry) (Thread, error) {
+	return store.threadSetFlag(ctx, key, "UPDATE thread SET locked = $2 WHERE thread.id = $1 RETURNING thread.id;",
+		"UPDATE thread SET locked = $2 WHERE thread.slug = $1 RETURNING thread.id;", locked, entry)
+}
+
+func (store *PostgresStore) ThreadPin(ctx context.Context, key ThreadKey, pinned bool, entry ModerationEntry) (Thread, error) {
+	return store.threadSetFlag(ctx, key, "UPDATE thread SET pinned = $2 WHERE thread.id = $1 RETURNING thread.id;",
+		"UPDATE thread SET pinned = $2 WHERE thread.slug = $1 RETURNING thread.id;", pinned, entry)
+}
+
+// Меняет флаг ветки запросом byId или bySlug ($1 - ключ, $2 - значение) и записывает действие в журнал.
+func (store *PostgresStore) threadSetFlag(ctx context.Context, key ThreadKey, byId, bySlug string, value bool, entry ModerationEntry) (Thread, error) {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Thread{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var row *sql.Row
+	if key.Slug == "" {
+		row = tx.QueryRowContext(ctx, byId, key.Id, value)
+	} else {
+		row = tx.QueryRowContext(ctx, bySlug, key.Slug, value)
+	}
+	var id uint32
+	if err := row.Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return Thread{}, errThreadNotFound(key)
+		}
+		return Thread{}, err
+	}
+	if err := logModeration(ctx, tx, entry); err != nil {
+		return Thread{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Thread{}, err
+	}
+
+	return store.ThreadGetOne(ctx, ThreadKey{Id: id})
+}
+
+// Посты переносятся вместе с веткой; счётчики обоих форумов и forum_user пересчитываются в той же транзакции.
+func (store *PostgresStore) ThreadMove(ctx context.Context, key ThreadKey, forumSlug string, entry ModerationEntry) (Thread, error) {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Thread{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var row *sql.Row
+	if key.Slug == "" {
+		row = tx.QueryRowContext(ctx, "SELECT thread.id, thread.forum_slug, thread.forum_slug = $2::citext FROM thread WHERE thread.id = $1 FOR UPDATE;",
+			key.Id, forumSlug)
+	} else {
+		row = tx.QueryRowContext(ctx, "SELECT thread.id, thread.forum_slug, thread.forum_slug = $2::citext FROM thread WHERE thread.slug = $1 FOR UPDATE;",
+			key.Slug, forumSlug)
+	}
+	var thread Thread
+	var unchanged bool
+	if err := row.Scan(&thread.Id, &thread.ForumSlug, &unchanged); err != nil {
+		if err == sql.ErrNoRows {
+			return Thread{}, errThreadNotFound(key)
+		}
+		return Thread{}, err
+	}
+	if unchanged {
+		return store.ThreadGetOne(ctx, ThreadKey{Id: thread.Id})
+	}
+
+	var authors pq.StringArray
+	if err := tx.QueryRowContext(ctx, "SELECT ARRAY(SELECT thread.profile_nickname::TEXT FROM thread WHERE thread.id = $1 UNION SELECT post.profile_nickname::TEXT FROM post WHERE post.thread_id = $1);",
+		thread.Id).Scan(&authors); err != nil {
+		return Thread{}, err
+	}
+
+	for _, query := range []string{
+		"UPDATE thread SET forum_slug = $2 WHERE thread.id = $1;",
+		"UPDATE post SET forum_slug = $2 WHERE post.thread_id = $1;",
+	} {
+		if _, err := tx.ExecContext(ctx, query, thread.Id, forumSlug); err != nil {
+			return Thread{}, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE forum SET threads = (SELECT COUNT(*) FROM thread WHERE thread.forum_slug = forum.slug), posts = (SELECT COUNT(*) FROM post WHERE post.forum_slug = forum.slug AND post.deleted IS NULL) WHERE forum.slug = ANY($1::citext[]);",
+		pq.StringArray{thread.ForumSlug, forumSlug}); err != nil {
+		return Thread{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO forum_user (forum_slug, profile_nickname, profile_about, profile_email, profile_fullname) SELECT $1, profile.nickname, profile.about, profile.email, profile.fullname FROM profile WHERE profile.nickname = ANY($2::citext[]) ON CONFLICT (forum_slug, profile_nickname) DO NOTHING;",
+		forumSlug, authors); err != nil {
+		return Thread{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM forum_user WHERE forum_user.forum_slug = $1 AND forum_user.profile_nickname = ANY($2::citext[]) AND NOT EXISTS (SELECT FROM thread WHERE thread.forum_slug = $1 AND thread.profile_nickname COLLATE "C" = forum_user.profile_nickname) AND NOT EXISTS (SELECT FROM post WHERE post.forum_slug = $1 AND post.profile_nickname COLLATE "C" = forum_user.profile_nickname);`,
+		thread.ForumSlug, authors); err != nil {
+		return Thread{}, err
+	}
+	if err := logModeration(ctx, tx, entry); err != nil {
+		return Thread{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Thread{}, err
+	}
+
+	return store.ThreadGetOne(ctx, ThreadKey{Id: thread.Id})
+}
+
+func (store *PostgresStore) ThreadGetPosts(ctx context.Context, thread Thread, filter PostsFilter) ([]Post, error) {
+	var desc string
+	if filter.Desc {
+		desc = "DESC"
+	}
+	limit := sqlLimit(filter.Limit)
+
+	var rows *sql.Rows
+	var err error
+	switch filter.Sort { //TODO: заменить " на `
+	case "tree":
+		if filter.Cursor != nil {
+			if desc == "" {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden, post.path_ FROM post WHERE post.thread_id = $1 AND post.path_ > $2 ORDER BY post.path_, post.created, post.id LIMIT $3;",
+					thread.Id, pq.Array(filter.Cursor.Path), limit)
+			} else {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden, post.path_ FROM post WHERE post.thread_id = $1 AND post.path_ < $2 ORDER BY post.path_ DESC, post.created, post.id LIMIT $3;",
+					thread.Id, pq.Array(filter.Cursor.Path), limit)
+			}
+		} else if filter.Since == 0 {
+			rows, err = store.db.QueryContext(ctx, fmt.Sprintf("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden, post.path_ FROM post WHERE post.thread_id = $1 ORDER BY post.path_ %s, post.created, post.id LIMIT $2;", desc),
+				thread.Id, limit)
+		} else {
+			if desc == "" {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden, post.path_ FROM post WHERE post.thread_id = $1 AND post.path_ > (SELECT post.path_ FROM post WHERE post.id = $2) ORDER BY post.path_, post.created, post.id LIMIT $3;",
+					thread.Id, filter.Since, limit)
+			} else {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden, post.path_ FROM post WHERE post.thread_id = $1 AND post.path_ < (SELECT post.path_ FROM post WHERE post.id = $2) ORDER BY post.path_ DESC, post.created, post.id LIMIT $3;",
+					thread.Id, filter.Since, limit)
+			}
+		}
+		break
+	case "parent_tree":
+		if filter.Cursor != nil {
+			if desc == "" {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.post_root_id IN (SELECT post.id FROM post WHERE post.post_parent_id IS NULL AND post.thread_id = $1 AND post.post_root_id > $2 ORDER BY post.id LIMIT $3) ORDER BY post.post_root_id, post.path_, post.created, post.id;",
+					thread.Id, filter.Cursor.Id, limit)
+			} else {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.post_root_id IN (SELECT post.id FROM post WHERE post.post_parent_id IS NULL AND post.thread_id = $1 AND post.post_root_id < $2 ORDER BY post.id DESC LIMIT $3) ORDER BY post.post_root_id DESC, post.path_, post.created, post.id;",
+					thread.Id, filter.Cursor.Id, limit)
+			}
+		} else if filter.Since == 0 {
+			rows, err = store.db.QueryContext(ctx, fmt.Sprintf("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.post_root_id IN (SELECT post.id FROM post WHERE post.post_parent_id IS NULL AND post.thread_id = $1 ORDER BY post.id %s LIMIT $2) ORDER BY post.post_root_id %s, post.path_, post.created, post.id;", desc, desc),
+				thread.Id, limit)
+		} else {
+			if desc == "" {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.post_root_id IN (SELECT post.id FROM post WHERE post.post_parent_id IS NULL AND post.thread_id = $1 AND post.post_root_id > (SELECT post.post_root_id FROM post WHERE post.id = $2) ORDER BY post.id LIMIT $3) ORDER BY post.post_root_id, post.path_, post.created, post.id;",
+					thread.Id, filter.Since, limit)
+			} else {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.post_root_id IN (SELECT post.id FROM post WHERE post.post_parent_id IS NULL AND post.thread_id = $1 AND post.post_root_id < (SELECT post.post_root_id FROM post WHERE post.id = $2) ORDER BY post.id DESC LIMIT $3) ORDER BY post.post_root_id DESC, post.path_, post.created, post.id;",
+					thread.Id, filter.Since, limit)
+			}
+		}
+		break
+	default: //flat
+		if filter.Cursor != nil {
+			if desc == "" {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.thread_id = $1 AND (post.created, post.id) > ($2, $3) ORDER BY post.created, post.id LIMIT $4;",
+					thread.Id, *filter.Cursor.Created, filter.Cursor.Id, limit)
+			} else {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.thread_id = $1 AND (post.created, post.id) < ($2, $3) ORDER BY post.created DESC, post.id DESC LIMIT $4;",
+					thread.Id, *filter.Cursor.Created, filter.Cursor.Id, limit)
+			}
+		} else if filter.Since == 0 {
+			rows, err = store.db.QueryContext(ctx, fmt.Sprintf("SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.thread_id = $1 ORDER BY post.created %s, post.id %s LIMIT $2;", desc, desc),
+				thread.Id, limit)
+		} else {
+			if desc == "" {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.thread_id = $1 AND post.id > $2 ORDER BY post.created, post.id LIMIT $3;",
+					thread.Id, filter.Since, limit)
+			} else {
+				rows, err = store.db.QueryContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.deleted, post.hidden FROM post WHERE post.thread_id = $1 AND post.id < $2 ORDER BY post.created DESC, post.id DESC LIMIT $3;",
+					thread.Id, filter.Since, limit)
+			}
+		}
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var posts = make([]Post, 0)
+	for rows.Next() {
+		var post Post
+		var parentPostId sql.NullInt64
+		var deleted sql.NullString
+		var path pq.Int64Array
+		columns := []interface{}{&post.Id, &post.ProfileNickname, &post.Created, &post.IsEdited, &post.Message,
+			&parentPostId, &deleted, &post.Hidden}
+		if filter.Sort == "tree" { //path_ нужен для курсора
+			columns = append(columns, &path)
+		}
+		if err := rows.Scan(columns...); err != nil {
+			return nil, err
+		}
+		if parentPostId.Valid {
+			post.ParentPost = uint64(parentPostId.Int64)
+		}
+		post.Deleted = deleted.String
+		for _, id := range path {
+			post.Path = append(post.Path, uint64(id))
+		}
+
+		post.ForumSlug = thread.ForumSlug
+		post.ThreadId = thread.Id
+
+		posts = append(posts, post)
+	}
+
+	return posts, rows.Err()
+}
+
+func (store *PostgresStore) ThreadVote(ctx context.Context, key ThreadKey, vote Vote) (Thread, error) {
+	var row *sql.Row
+	switch {
+	case vote.Voice == 0 && key.Slug == "": //голос отзывается; ветка и пользователь должны существовать, даже если голоса не было
+		row = store.db.QueryRowContext(ctx, "WITH target AS (SELECT profile.id AS profile_id, thread.id AS thread_id FROM profile, thread WHERE profile.nickname = $1 AND thread.id = $2 AND NOT thread.archived), retracted AS (DELETE FROM vote USING target WHERE vote.profile_id = target.profile_id AND vote.thread_id = target.thread_id) SELECT target.thread_id FROM target;",
+			vote.ProfileNickname, key.Id)
+	case vote.Voice == 0:
+		row = store.db.QueryRowContext(ctx, "WITH target AS (SELECT profile.id AS profile_id, thread.id AS thread_id FROM profile, thread WHERE profile.nickname = $1 AND thread.slug = $2 AND NOT thread.archived), retracted AS (DELETE FROM vote USING target WHERE vote.profile_id = target.profile_id AND vote.thread_id = target.thread_id) SELECT target.thread_id FROM target;",
+			vote.ProfileNickname, key.Slug)
+	case key.Slug == "": //TODO: тут какая-то хрень, если делать Exec
+		row = store.db.QueryRowContext(ctx, "INSERT INTO vote (profile_id, thread_id, voice) SELECT profile.id, thread.id, $3 FROM profile, thread WHERE profile.nickname = $1 AND thread.id = $2 AND NOT thread.archived ON CONFLICT (profile_id, thread_id) DO UPDATE SET voice = $3 RETURNING vote.thread_id;",
+			vote.ProfileNickname, key.Id, vote.Voice)
+	default:
+		row = store.db.QueryRowContext(ctx, "INSERT INTO vote (profile_id, thread_id, voice) SELECT profile.id, thread.id, $3 FROM profile, thread WHERE profile.nickname = $1 AND thread.slug = $2 AND NOT thread.archived ON CONFLICT (profile_id, thread_id) DO UPDATE SET voice = $3 RETURNING vote.thread_id;",
+			vote.ProfileNickname, key.Slug, vote.Voice)
+	}
+	if err := row.Scan(&vote.ThreadId); err != nil {
+		if err != sql.ErrNoRows {
+			return Thread{}, err
+		}
+		if thread, err := store.ThreadGetOne(ctx, key); err == nil && thread.Archived {
+			return Thread{}, errThreadArchived(key)
+		} else if err != nil && !errors.Is(err, ErrNotFound) {
+			return Thread{}, err
+		}
+		return Thread{}, errVoteNotFound(vote.ProfileNickname, key)
+	}
+
+	return store.ThreadGetOne(ctx, ThreadKey{Id: vote.ThreadId})
+}
+
+func (store *PostgresStore) PostsCreate(ctx context.Context, thread Thread, posts []*Post) error {
+	location, _ := time.LoadLocation("UTC")
+	now := time.Now().In(location).Round(time.Microsecond)
+
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	statement, err := tx.PrepareContext(ctx, "INSERT INTO post (profile_nickname, created, message, post_parent_id, thread_id, forum_slug) SELECT profile.nickname, $2, $3, $4, $5, $6 FROM profile WHERE profile.nickname = $1 RETURNING post.id;")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = statement.Close()
+	}()
+
+	for _, post := range posts { //TODO: возможно везде заменить создание массивов/данных в стеке на make... везде так
+		if post.Created.IsZero() {
+			post.Created = now
+		}
+
+		if err = statement.QueryRowContext(ctx, post.ProfileNickname, post.Created, post.Message, post.ParentPost, thread.Id,
+			thread.ForumSlug).Scan(&post.Id); err != nil {
+			if err == sql.ErrNoRows {
+				return errPostAuthorNotFound(post.ProfileNickname)
+			}
+			//родитель в другой ветке (trigger_post_before_insert) или удалён параллельно
+			if err, ok := err.(*pq.Error); ok && (err.Code == "P0001" || //raise_exception
+				err.Code == "23503" && err.Constraint == "post_post_parent_id_fkey") { //foreign_key_violation
+				return errPostParentConflict()
+			}
+			return err
+		}
+
+		post.ThreadId = thread.Id
+		post.ForumSlug = thread.ForumSlug
+	}
+
+	return tx.Commit()
+}
+
+func (store *PostgresStore) PostGetOne(ctx context.Context, id uint64) (Post, error) {
+	var post Post
+	var parentPostId sql.NullInt64
+	var deleted sql.NullString
+	if err := store.db.QueryRowContext(ctx, "SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug, post.deleted, post.hidden FROM post WHERE post.id = $1;",
+		id).Scan(&post.Id, &post.ProfileNickname, &post.Created, &post.IsEdited, &post.Message, &parentPostId,
+		&post.ThreadId, &post.ForumSlug, &deleted, &post.Hidden); err != nil {
+		if err == sql.ErrNoRows {
+			return post, errPostNotFound(id)
+		}
+		return post, err
+	}
+	if parentPostId.Valid {
+		post.ParentPost = uint64(parentPostId.Int64)
+	}
+	post.Deleted = deleted.String
+
+	return post, nil
+}
+
+// Автора правки trigger_post_after_edit берёт из настройки forums.post_editor транзакции.
+func (store *PostgresStore) PostUpdate(ctx context.Context, post Post, editor string) error {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "SELECT set_config('forums.post_editor', $1, TRUE);", editor); err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, "UPDATE post SET message = $1 WHERE id = $2 AND deleted IS NULL;",
+		post.Message, post.Id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return errPostDeleted(post.Id)
+	}
+	return tx.Commit()
+}
+
+// forum.posts уменьшается, а удалённый текст сохраняется в истории триггером trigger_post_after_soft_delete.
+func (store *PostgresStore) PostDelete(ctx context.Context, id uint64, moderation *ModerationEntry) (Post, error) {
+	if moderation == nil {
+		if _, err := store.db.ExecContext(ctx, "UPDATE post SET message = '', deleted = 'author' WHERE id = $1 AND deleted IS NULL;",
+			id); err != nil {
+			return Post{}, err
+		}
+		return store.PostGetOne(ctx, id)
+	}
+
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Post{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, "SELECT set_config('forums.post_editor', $1, TRUE);", moderation.Moderator); err != nil {
+		return Post{}, err
+	}
+	result, err := tx.ExecContext(ctx, "UPDATE post SET message = '', deleted = 'moderator' WHERE id = $1 AND deleted IS NULL;",
+		id)
+	if err != nil {
+		return Post{}, err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return Post{}, err
+	} else if deleted > 0 {
+		if err := logModeration(ctx, tx, *moderation); err != nil {
+			return Post{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Post{}, err
+	}
+
+	return store.PostGetOne(ctx, id)
+}
+
+func (store *PostgresStore) PostHide(ctx context.Context, id uint64, hidden bool, entry ModerationEntry) (Post, error) {
+	ctx, cancel := store.transactionContext(ctx)
+	defer cancel()
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Post{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	var deleted sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT post.deleted FROM post WHERE post.id = $1 FOR UPDATE;",
+		id).Scan(&deleted); err != nil {
+		if err == sql.ErrNoRows {
+			return Post{}, errPostNotFound(id)
+		}
+		return Post{}, err
+	}
+	if deleted.Valid {
+		return Post{}, errPostDeleted(id)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE post SET hidden = $2 WHERE post.id = $1;", id, hidden); err != nil {
+		return Post{}, err
+	}
+	if err := logModeration(ctx, tx, entry); err != nil {
+		return Post{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Post{}, err
+	}
+
+	return store.PostGetOne(ctx, id)
+}
+
+func (store *PostgresStore) PostHistory(ctx context.Context, id uint64) ([]PostEdit, error) {
+	rows, err := store.db.QueryContext(ctx, "SELECT COALESCE(post_revision.profile_nickname, ''), post_revision.edited, post_revision.message FROM post_revision WHERE post_revision.post_id = $1 ORDER BY post_revision.id;",
+		id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	edits := make([]PostEdit, 0)
+	for rows.Next() {
+		var edit PostEdit
+		if err := rows.Scan(&edit.ProfileNickname, &edit.Edited, &edit.Message); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
+
+func (store *PostgresStore) Search(ctx context.Context, filter SearchFilter) ([]SearchResult, error) {
+	var since interface{}
+	if filter.Since != nil {
+		since = *filter.Since
+	}
+	desc, compare := "", ">="
+	if filter.Desc {
+		desc, compare = "DESC", "<="
+	}
+	rank := "rank DESC, "
+	if filter.Since != nil {
+		rank = "" //страницы по since идут по дате создания
+	}
+
+	//ts_headline считается только для попавших в limit строк; текст экранируется до выделения слов
+	rows, err := store.db.QueryContext(ctx, fmt.Sprintf("SELECT found.id, found.profile_nickname, found.created, found.forum_slug, found.message, found.slug, found.title, found.votes, found.archived, found.locked, found.pinned, found.rank, ts_headline('russian', replace(replace(replace(found.title || ' ' || found.message, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), query) FROM (SELECT thread.id, thread.profile_nickname, thread.created, thread.forum_slug, thread.message, thread.slug, thread.title, thread.votes, thread.archived, thread.locked, thread.pinned, ts_rank(thread.tsv, query) AS rank FROM thread, websearch_to_tsquery('russian', $1) AS query WHERE thread.tsv @@ query AND ($2::citext = '' OR thread.forum_slug = $2::citext) AND ($3::citext = '' OR thread.profile_nickname = $3::citext) AND ($4::timestamptz IS NULL OR thread.created %[2]s $4::timestamptz) ORDER BY %[3]sthread.created %[1]s LIMIT $5) AS found, websearch_to_tsquery('russian', $1) AS query ORDER BY %[3]sfound.created %[1]s;", desc, compare, rank),
+		filter.Query, filter.Forum, filter.Author, since, sqlLimit(filter.Limit))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	threads := make([]SearchResult, 0)
+	for rows.Next() {
+		var thread Thread
+		var threadSlug sql.NullString
+		var result SearchResult
+		if err := rows.Scan(&thread.Id, &thread.ProfileNickname, &thread.Created, &thread.ForumSlug, &thread.Message,
+			&threadSlug, &thread.Title, &thread.Votes, &thread.Archived, &thread.Locked, &thread.Pinned, &result.Rank, &result.Snippet); err != nil {
+			return nil, err
+		}
+		thread.Slug = threadSlug.String
+		result.Thread = &thread
+		threads = append(threads, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	//post.created хранится без часового пояса, в UTC
+	rows, err = store.db.QueryContext(ctx, fmt.Sprintf("SELECT found.id, found.profile_nickname, found.created, found.is_edited, found.message, found.post_parent_id, found.thread_id, found.forum_slug, found.rank, ts_headline('russian', replace(replace(replace(found.message, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), query) FROM (SELECT post.id, post.profile_nickname, post.created, post.is_edited, post.message, post.post_parent_id, post.thread_id, post.forum_slug, ts_rank(post.tsv, query) AS rank FROM post, websearch_to_tsquery('russian', $1) AS query WHERE post.tsv @@ query AND post.deleted IS NULL AND NOT post.hidden AND ($2::citext = '' OR post.forum_slug = $2::citext) AND ($3::citext = '' OR post.profile_nickname = $3::citext) AND ($4::timestamptz IS NULL OR post.created %[2]s $4::timestamptz AT TIME ZONE 'UTC') ORDER BY %[3]spost.created %[1]s LIMIT $5) AS found, websearch_to_tsquery('russian', $1) AS query ORDER BY %[3]sfound.created %[1]s;", desc, compare, rank),
+		filter.Query, filter.Forum, filter.Author, since, sqlLimit(filter.Limit))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	posts := make([]SearchResult, 0)
+	for rows.Next() {
+		var post Post
+		var parentPostId sql.NullInt64
+		var result SearchResult
+		if err := rows.Scan(&post.Id, &post.ProfileNickname, &post.Created, &post.IsEdited, &post.Message, &parentPostId,
+			&post.ThreadId, &post.ForumSlug, &result.Rank, &result.Snippet); err != nil {
+			return nil, err
+		}
+		post.ParentPost = uint64(parentPostId.Int64)
+		result.Post = &post
+		posts = append(posts, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return mergeSearchResults(threads, posts, filter), nil
+}
+
+func (store *PostgresStore) ServiceClear(ctx context.Context) error {
+	_, err := store.db.ExecContext(ctx, "TRUNCATE TABLE profile RESTART IDENTITY CASCADE;")
+	return err
+}
+
+func (store *PostgresStore) ServiceStatus(ctx context.Context) (Status, error) {
+	var status Status
+	err := store.db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM forum), (SELECT COUNT(*) FROM post WHERE post.deleted IS NULL), (SELECT COUNT(*) FROM thread), (SELECT COUNT(*) FROM profile);").
+		Scan(&status.Forum, &status.Post, &status.Thread, &status.User)
+	return status, err
+}
+
+func (store *PostgresStore) Subscribe(ctx context.Context, threadId uint32) (<-chan ThreadEvent, error) {
+	store.listenMutex.Lock()
+	defer store.listenMutex.Unlock()
+	if store.listener == nil {
+		listener := pq.NewListener(store.dsn, time.Second, time.Minute, nil)
+		if err := listener.Listen("thread_events"); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		store.listener = listener
+		go store.dispatchEvents(listener)
+	}
+	return store.events.subscribe(ctx, threadId), nil
+}
+
+// Уведомление из канала thread_events (см. миграцию 0012_thread_events).
+type threadNotification struct {
+	Type   string `json:"type"`
+	Thread uint32 `json:"thread"`
+	Id     uint64 `json:"id"`
+	Votes  int32  `json:"votes"`
+}
+
+// Рассылает уведомления подписчикам этого процесса. Пост читается один раз на уведомление и только если на ветку
+// кто-то подписан. События, пришедшие во время переподключения listener'а, теряются.
+func (store *PostgresStore) dispatchEvents(listener *pq.Listener) {
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case notification, ok := <-listener.Notify:
+			if !ok {
+				return
+			}
+			if notification == nil { //соединение восстановлено
+				continue
+			}
+			var payload threadNotification
+			if err := json.Unmarshal([]byte(notification.Extra), &payload); err != nil ||
+				!store.events.subscribed(payload.Thread) {
+				continue
+			}
+			event := ThreadEvent{Type: payload.Type, Votes: payload.Votes}
+			if payload.Type == "post" || payload.Type == "edit" {
+				ctx, cancel := context.WithTimeout(store.transactions, 5*time.Second)
+				post, err := store.PostGetOne(ctx, payload.Id)
+				cancel()
+				if err != nil {
+					continue
+				}
+				event.Post = post
+			}
+			store.events.publish(payload.Thread, event)
+		case <-ping.C:
+			go func() {
+				_ = listener.Ping()
+			}()
+		}
+	}
+}
+
+func (store *PostgresStore) Close() error {
+	store.cancelTransactions()
+	store.events.close()
+	store.listenMutex.Lock()
+	if store.listener != nil {
+		_ = store.listener.Close()
+	}
+	store.listenMutex.Unlock()
+	return store.db.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Размер очереди событий подписчика; подписчик, не успевающий их забирать, отключается.
+const threadEventsBuffer = 64
+
+// Событие ветки для GET /api/thread/{slug_or_id}/stream.
+type ThreadEvent struct {
+	Type  string //post (новый пост), edit (изменение или удаление поста), vote или archive
+	Post  Post   //post, edit
+	Votes int32  //vote: новый рейтинг ветки
+}
+
+// Подписки на события веток внутри одного процесса. Хранилища публикуют в них события: MemoryStore - сам,
+// PostgresStore - получив уведомление из канала thread_events.
+type threadEvents struct {
+	mutex       sync.Mutex
+	subscribers map[uint32]map[chan ThreadEvent]struct{}
+	closed      bool
+}
+
+func newThreadEvents() *threadEvents {
+	return &threadEvents{subscribers: make(map[uint32]map[chan ThreadEvent]struct{})}
+}
+
+// Канал закрывается при отмене ctx, отключении медленного подписчика или закрытии хранилища.
+func (events *threadEvents) subscribe(ctx context.Context, threadId uint32) <-chan ThreadEvent {
+	subscriber := make(chan ThreadEvent, threadEventsBuffer)
+
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	if events.closed {
+		close(subscriber)
+		return subscriber
+	}
+	if events.subscribers[threadId] == nil {
+		events.subscribers[threadId] = make(map[chan ThreadEvent]struct{})
+	}
+	events.subscribers[threadId][subscriber] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		events.mutex.Lock()
+		defer events.mutex.Unlock()
+		events.unsubscribe(threadId, subscriber)
+	}()
+	return subscriber
+}
+
+// Вызывается под mutex.
+func (events *threadEvents) unsubscribe(threadId uint32, subscriber chan ThreadEvent) {
+	if _, ok := events.subscribers[threadId][subscriber]; !ok {
+		return
+	}
+	delete(events.subscribers[threadId], subscriber)
+	if len(events.subscribers[threadId]) == 0 {
+		delete(events.subscribers, threadId)
+	}
+	close(subscriber)
+}
+
+func (events *threadEvents) subscribed(threadId uint32) bool {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	return len(events.subscribers[threadId]) > 0
+}
+
+func (events *threadEvents) publish(threadId uint32, event ThreadEvent) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	for subscriber := range events.subscribers[threadId] {
+		select {
+		case subscriber <- event:
+		default:
+			events.unsubscribe(threadId, subscriber)
+		}
+	}
+}
+
+func (events *threadEvents) close() {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+	for threadId, subscribers := range events.subscribers {
+		for subscriber := range subscribers {
+			events.unsubscribe(threadId, subscriber)
+		}
+	}
+	events.closed = true
+}
+
+// Ключ контекста запроса с его соединением (http.Server.ConnContext): поток событий снимает с соединения
+// дедлайн server.write_timeout, рассчитанный на обычные ответы.
+type connContextKey struct{}
+
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+func requestConn(ctx context.Context) (net.Conn, bool) {
+	conn, ok := ctx.Value(connContextKey{}).(net.Conn)
+	return conn, ok
+}